@@ -0,0 +1,76 @@
+package demux
+
+import "fmt"
+
+// AAC sampling_frequency_index values, by sample rate
+var adtsSampleRateIndex = map[int]int{
+	96000: 0,
+	88200: 1,
+	64000: 2,
+	48000: 3,
+	44100: 4,
+	32000: 5,
+	24000: 6,
+	22050: 7,
+	16000: 8,
+	12000: 9,
+	11025: 10,
+	8000:  11,
+	7350:  12,
+}
+
+// Protect cameras normally record a single (mono) audio channel, which is assumed if the channel count is unknown
+const adtsDefaultChannelConfig = 1
+
+// The largest frame_length an ADTS header can express (13 bits, including the header)
+const adtsMaxFrameLength = 1<<13 - 1
+
+const adtsHeaderSize = 7
+
+// Builds ADTS headers (AAC-LC, no CRC) for the raw AAC frames of a track
+type adtsHeader struct {
+	header [adtsHeaderSize]byte
+}
+
+func newADTSHeader(sampleRate int, channels int) (*adtsHeader, error) {
+	index, ok := adtsSampleRateIndex[sampleRate]
+	if !ok {
+		return nil, fmt.Errorf("no ADTS sampling frequency index for %d Hz", sampleRate)
+	}
+
+	// channel_configuration is the channel count for 1-6 channels, and 7 for 7.1
+	channelConfig := adtsDefaultChannelConfig
+	switch {
+	case channels >= 1 && channels <= 6:
+		channelConfig = channels
+	case channels == 8:
+		channelConfig = 7
+	case channels != 0:
+		return nil, fmt.Errorf("no ADTS channel configuration for %d channels", channels)
+	}
+
+	const profile = 1 // AAC-LC (audio object type 2, less 1)
+
+	h := &adtsHeader{}
+	h.header[0] = 0xFF
+	h.header[1] = 0xF1 // MPEG-4, layer 0, no CRC
+	h.header[2] = byte(profile<<6 | index<<2 | channelConfig>>2)
+	h.header[3] = byte(channelConfig&3) << 6
+	h.header[6] = 0xFC // buffer fullness 0x7FF (VBR), one raw data block
+
+	return h, nil
+}
+
+// The header for a frame of payloadSize bytes; the result is only valid until the next call
+func (h *adtsHeader) forFrame(payloadSize int) ([]byte, error) {
+	frameLength := payloadSize + adtsHeaderSize
+	if frameLength > adtsMaxFrameLength {
+		return nil, fmt.Errorf("AAC frame of %d bytes is too large for ADTS", payloadSize)
+	}
+
+	h.header[3] = h.header[3]&0xFC | byte(frameLength>>11)
+	h.header[4] = byte(frameLength >> 3)
+	h.header[5] = byte(frameLength&7)<<5 | 0x1F
+
+	return h.header[:], nil
+}
@@ -0,0 +1,79 @@
+package demux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestADTSHeader(t *testing.T) {
+	tests := []struct {
+		sampleRate  int
+		channels    int
+		payloadSize int
+		want        []byte
+	}{
+		{48000, 2, 100, []byte{0xFF, 0xF1, 0x4C, 0x80, 0x0D, 0x7F, 0xFC}},
+		{16000, 1, 200, []byte{0xFF, 0xF1, 0x60, 0x40, 0x19, 0xFF, 0xFC}},
+		// Unknown channel count is taken to be mono
+		{16000, 0, 200, []byte{0xFF, 0xF1, 0x60, 0x40, 0x19, 0xFF, 0xFC}},
+		// 7.1 is channel configuration 7, which spills into the third byte
+		{44100, 8, 1000, []byte{0xFF, 0xF1, 0x51, 0xC0, 0x7D, 0xFF, 0xFC}},
+		// A frame_length above 2047 uses the low 2 bits of the fourth byte
+		{16000, 1, 8000, []byte{0xFF, 0xF1, 0x60, 0x43, 0xE8, 0xFF, 0xFC}},
+	}
+
+	for _, test := range tests {
+		adts, err := newADTSHeader(test.sampleRate, test.channels)
+		if err != nil {
+			t.Errorf("ADTS header for %d Hz, %d channels failed: %v", test.sampleRate, test.channels, err)
+			continue
+		}
+
+		header, err := adts.forFrame(test.payloadSize)
+		if err != nil {
+			t.Errorf("ADTS header for a %d byte frame failed: %v", test.payloadSize, err)
+		} else if !bytes.Equal(header, test.want) {
+			t.Errorf("ADTS header for %d Hz, %d channels, %d bytes is incorrect, got: %x, want: %x.", test.sampleRate, test.channels, test.payloadSize, header, test.want)
+		}
+	}
+}
+
+// The header is reused from frame to frame, so a large frame's length must not leak into the next
+func TestADTSHeaderReuse(t *testing.T) {
+	adts, err := newADTSHeader(16000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := adts.forFrame(8000); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := adts.forFrame(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0xFF, 0xF1, 0x60, 0x40, 0x19, 0xFF, 0xFC}; !bytes.Equal(header, want) {
+		t.Errorf("Reused ADTS header is incorrect, got: %x, want: %x.", header, want)
+	}
+}
+
+func TestADTSHeaderFailures(t *testing.T) {
+	if _, err := newADTSHeader(22000, 1); err == nil {
+		t.Error("Expected an unsupported sample rate to fail")
+	}
+	if _, err := newADTSHeader(16000, 7); err == nil {
+		t.Error("Expected an unsupported channel count to fail")
+	}
+
+	adts, err := newADTSHeader(16000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adts.forFrame(adtsMaxFrameLength - adtsHeaderSize); err != nil {
+		t.Error("Expected the largest ADTS frame to succeed: ", err)
+	}
+	if _, err := adts.forFrame(adtsMaxFrameLength - adtsHeaderSize + 1); err == nil {
+		t.Error("Expected a frame too large for ADTS to fail")
+	}
+}
@@ -0,0 +1,134 @@
+package demux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"ubvremux/ubv"
+)
+
+// How many frames of the track to examine for a recognisable audio signature before giving up
+const audioProbeFrames = 10
+
+// Sniffs the codec of an audio track from the start of its first frames. Raw AAC (what Protect cameras normally
+// record) has no signature, so an error is returned if no frame is recognised
+func ProbeAudioCodec(ubvFilename string, partition *ubv.UbvPartition, audioTrackNum int) (string, error) {
+	track, ok := partition.Tracks[audioTrackNum]
+	if !ok || track.IsVideo {
+		return "", fmt.Errorf("partition %d has no audio track %d", partition.Index, audioTrackNum)
+	}
+
+	var codec string
+	err := probeAudioFrames(ubvFilename, partition, audioTrackNum, func(frame []byte) bool {
+		codec = sniffAudioCodec(frame)
+		return len(codec) > 0
+	})
+	if err != nil {
+		return "", err
+	} else if len(codec) == 0 {
+		return "", fmt.Errorf("no recognisable signature in the first %d frames of track %d", audioProbeFrames, audioTrackNum)
+	}
+
+	return codec, nil
+}
+
+// Determines the channel count of an audio track (of the given codec) from its first frames: from the ADTS header or
+// Opus identification header if there is one, otherwise from the first element of the raw AAC (a single channel or a
+// channel pair, so layouts beyond stereo are only recognised with a header)
+func ProbeAudioChannels(ubvFilename string, partition *ubv.UbvPartition, audioTrackNum int, codec string) (int, error) {
+	track, ok := partition.Tracks[audioTrackNum]
+	if !ok || track.IsVideo {
+		return 0, fmt.Errorf("partition %d has no audio track %d", partition.Index, audioTrackNum)
+	}
+
+	channels := 0
+	err := probeAudioFrames(ubvFilename, partition, audioTrackNum, func(frame []byte) bool {
+		channels = sniffAudioChannels(frame, codec)
+		return channels > 0
+	})
+	if err != nil {
+		return 0, err
+	} else if channels == 0 {
+		return 0, fmt.Errorf("no recognisable channel configuration in the first %d frames of track %d", audioProbeFrames, audioTrackNum)
+	}
+
+	return channels, nil
+}
+
+// Calls match with each of the first audioProbeFrames frames of the track, until it returns true
+func probeAudioFrames(ubvFilename string, partition *ubv.UbvPartition, audioTrackNum int, match func([]byte) bool) error {
+	ubvFile, err := os.Open(ubvFilename)
+	if err != nil {
+		return err
+	}
+	defer ubvFile.Close()
+
+	framesSearched := 0
+	for _, frame := range partition.Frames {
+		if frame.TrackNumber != audioTrackNum {
+			continue
+		} else if framesSearched++; framesSearched > audioProbeFrames {
+			break
+		}
+
+		data := make([]byte, frame.Size)
+		if _, err := ubvFile.ReadAt(data, int64(frame.Offset)); err != nil && err != io.EOF {
+			return fmt.Errorf("could not read frame at %d: %w", frame.Offset, err)
+		}
+
+		if match(data) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// The codec of an audio frame with a recognisable signature, or "" if there is none
+func sniffAudioCodec(frame []byte) string {
+	switch {
+	case len(frame) >= 2 && frame[0] == 0xFF && frame[1]&0xF6 == 0xF0:
+		// ADTS syncword (with layer 0)
+		return ubv.CodecAAC
+	case bytes.HasPrefix(frame, []byte("OggS")):
+		return ubv.CodecOpus
+	default:
+		return ""
+	}
+}
+
+// AAC raw_data_block syntactic elements that carry audio: a single channel, or a channel pair
+const (
+	aacElementSCE = 0
+	aacElementCPE = 1
+)
+
+// The channel count of an audio frame, or 0 if it cannot be told from this frame
+func sniffAudioChannels(frame []byte, codec string) int {
+	switch {
+	case sniffAudioCodec(frame) == ubv.CodecAAC && len(frame) >= 4:
+		// ADTS channel_configuration; 0 means the layout is given in-band instead
+		config := int(frame[2]&1)<<2 | int(frame[3]>>6)
+		if config == 7 {
+			return 8
+		}
+		return config
+	case codec == ubv.CodecOpus:
+		// The identification header holds the channel count right after its magic and version
+		if i := bytes.Index(frame, []byte("OpusHead")); i >= 0 && len(frame) > i+9 {
+			return int(frame[i+9])
+		}
+		return 0
+	case codec == ubv.CodecAAC && len(frame) > 0:
+		switch frame[0] >> 5 {
+		case aacElementSCE:
+			return 1
+		case aacElementCPE:
+			return 2
+		}
+		return 0
+	default:
+		return 0
+	}
+}
@@ -2,57 +2,295 @@ package demux
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"ubvremux/logging"
 	"ubvremux/ubv"
 )
 
-func DemuxSinglePartitionToNewFiles(ubvFilename string, videoFilename string, videoTrackNum int, audioFilename string, partition *ubv.UbvPartition) {
+// Video bitstream formats (see DemuxOptions.AVCC)
+const (
+	BitstreamAnnexB = "annexb"
+	BitstreamAVCC   = "avcc"
+)
 
-	// The input media file; N.B. we do not use a buffered reader for this because we will be seeking heavily
-	ubvFile, err := os.OpenFile(ubvFilename, os.O_RDONLY, 0)
-	if err != nil {
-		log.Fatal("Error opening UBV file", err)
+// Optional demuxer behaviour
+type DemuxOptions struct {
+	// If non-empty, these parameter sets (e.g. from SynthesiseParameterSets) open the video stream and any SPS NALs
+	// in the stream itself are dropped. Only applies to H.264 tracks
+	ReplacementParameterSets [][]byte
+
+	// If true, each NAL is preceded by a 3-byte start code, or a 4-byte one before parameter sets and IDR NALs, as is
+	// conventional. Otherwise (the default) every NAL is followed by a 4-byte start code after an opening one
+	ShortStartCodes bool
+
+	// If true, video frames are written as they are stored (AVCC: each NAL preceded by its 4-byte big-endian length)
+	// rather than converted to Annex-B, for tools that take length-prefixed H.264/H.265. As nothing is rewritten, the
+	// parameter set options and ShortStartCodes do not apply
+	AVCC bool
+
+	// If non-empty, these parameter sets (e.g. from FindParameterSets) are written at the start of the video stream
+	// if it does not open with parameter sets of its own, e.g. a partition that begins mid-GOP
+	FallbackParameterSets [][]byte
+
+	// If true, each audio frame is preceded by an ADTS header (computed from the track's sample rate) so the audio
+	// bitstream is playable as a standalone .aac
+	ADTS bool
+
+	// If true, DemuxSinglePartitionToNewFiles periodically checkpoints its progress, and carries on from the last
+	// checkpoint of an earlier interrupted demux of the same partition rather than starting again
+	Resume bool
+
+	// Where to start, and the report so far, when resuming
+	startFrame    int
+	resumedReport DemuxReport
+
+	// If non-nil, called (with the writers flushed) to record that frames before nextFrame have been written
+	checkpoint func(nextFrame int, report DemuxReport) error
+
+	// If set, called periodically (at most every progressInterval) and once the partition is complete
+	Progress func(DemuxProgress)
+}
+
+// How far through demuxing a partition we are; only frames of the streams being extracted are counted
+type DemuxProgress struct {
+	Partition   int
+	Frames      int
+	TotalFrames int
+	Bytes       int64
+	TotalBytes  int64
+}
+
+func (p DemuxProgress) String() string {
+	percent := 100.0
+	if p.TotalBytes > 0 {
+		percent = float64(p.Bytes) * 100 / float64(p.TotalBytes)
 	}
 
-	defer ubvFile.Close()
+	return fmt.Sprintf("partition %d: %.1f%% (%d/%d frames, %d/%d bytes)", p.Partition, percent, p.Frames, p.TotalFrames, p.Bytes, p.TotalBytes)
+}
+
+// Minimum time between Progress callbacks
+const progressInterval = time.Second
+
+// How many frames to demux between checks for cancellation
+const cancelCheckInterval = 100
+
+type flusher interface {
+	Flush() error
+}
+
+// Summary of the video NALs encountered while demuxing a single partition
+type DemuxReport struct {
+	VPSCount    int
+	SPSCount    int
+	PPSCount    int
+	IDRCount    int
+	NonIDRCount int
+	OtherCount  int
+
+	// Video frames skipped because their NAL lengths were corrupt
+	SkippedFrames int
+}
+
+func (r *DemuxReport) count(class nalClass) {
+	switch class {
+	case nalVPS:
+		r.VPSCount++
+	case nalSPS:
+		r.SPSCount++
+	case nalPPS:
+		r.PPSCount++
+	case nalIDR:
+		r.IDRCount++
+	case nalNonIDR:
+		r.NonIDRCount++
+	default:
+		r.OtherCount++
+	}
+}
+
+func (r DemuxReport) String() string {
+	s := fmt.Sprintf("SPS: %d, PPS: %d, IDR: %d, non-IDR: %d, other: %d", r.SPSCount, r.PPSCount, r.IDRCount, r.NonIDRCount, r.OtherCount)
+	if r.VPSCount > 0 {
+		s = fmt.Sprintf("VPS: %d, ", r.VPSCount) + s
+	}
+	if r.SkippedFrames > 0 {
+		s += fmt.Sprintf(", skipped corrupt frames: %d", r.SkippedFrames)
+	}
+
+	return s
+}
+
+// Demuxes a single partition into newly created raw bitstream files (either filename may be empty to skip that stream)
+// Outputs only appear under their final names once complete; on cancellation the partial files are removed (unless
+// opts.Resume, when they are kept along with a checkpoint so the demux can be resumed)
+func DemuxSinglePartitionToNewFiles(ctx context.Context, ubvFilename string, videoFilename string, videoTrackNum int, audioFilename string, audioTrackNum int, partition *ubv.UbvPartition, opts DemuxOptions) (DemuxReport, error) {
+	// Optionally write video (tracks without frames are skipped, rather than producing an empty output)
+	var finalNames []string
+	writeVideo := false
+	if track, ok := partition.Tracks[videoTrackNum]; len(videoFilename) > 0 && ok && track.FrameCount > 0 {
+		writeVideo = true
+		finalNames = append(finalNames, videoFilename)
+	} else if len(videoFilename) > 0 {
+		logging.Info("Partition ", partition.Index, " has no frames on video track ", videoTrackNum, ", not writing ", videoFilename)
+	}
+
+	// Optionally write audio
+	writeAudio := false
+	if track, ok := partition.Tracks[audioTrackNum]; len(audioFilename) > 0 && ok && track.FrameCount > 0 {
+		writeAudio = true
+		finalNames = append(finalNames, audioFilename)
+	} else if len(audioFilename) > 0 {
+		logging.Info("Partition ", partition.Index, " has no frames on audio track ", audioTrackNum, ", not writing ", audioFilename)
+	}
+
+	var checkpoint *demuxCheckpoint
+	if opts.Resume && len(finalNames) > 0 {
+		if checkpoint = loadCheckpoint(finalNames, partition); checkpoint != nil {
+			logging.Infof("Resuming partition %d from frame %d of %d", partition.Index, checkpoint.NextFrame, len(partition.Frames))
+			opts.startFrame = checkpoint.NextFrame
+			opts.resumedReport = checkpoint.Report
+		} else {
+			checkpoint = &demuxCheckpoint{Outputs: finalNames, FrameCount: len(partition.Frames), Sizes: make([]int64, len(finalNames))}
+		}
+	}
+
+	// Each output is written under a temporary name, and only renamed into place once the partition has been demuxed
+	var outputs []*os.File
+	create := func(description string) (io.Writer, error) {
+		filename := temporaryFilename(finalNames[len(outputs)])
 
-	// Optionally write video
-	var videoFile *bufio.Writer
-	if len(videoFilename) > 0 && partition.VideoTrackCount > 0 {
-		videoFileRaw, err := os.Create(videoFilename)
+		var f *os.File
+		var err error
+		if checkpoint != nil && checkpoint.NextFrame > 0 {
+			// Discard anything written after the checkpoint
+			size := checkpoint.Sizes[len(outputs)]
+			if f, err = os.OpenFile(filename, os.O_WRONLY, 0); err == nil {
+				if err = f.Truncate(size); err == nil {
+					_, err = f.Seek(size, io.SeekStart)
+				}
+			}
+		} else {
+			f, err = os.Create(filename)
+		}
 		if err != nil {
-			log.Fatal("Error opening video bitstream output", err)
+			return nil, fmt.Errorf("could not open %s bitstream output: %w", description, err)
 		}
 
-		defer videoFileRaw.Close()
-		videoFile = bufio.NewWriter(videoFileRaw)
-	} else {
-		videoFile = nil
+		outputs = append(outputs, f)
+		return bufio.NewWriter(f), nil
 	}
 
-	// Optionally write audio
-	var audioFile *bufio.Writer
-	if len(audioFilename) > 0 && partition.AudioTrackCount > 0 {
-		audioFileRaw, err := os.Create(audioFilename)
+	// If an output cannot be opened, those already opened are abandoned (but kept if they hold resumable progress)
+	abandon := func(err error) (DemuxReport, error) {
+		for _, f := range outputs {
+			f.Close()
+			if checkpoint == nil || checkpoint.NextFrame == 0 {
+				os.Remove(f.Name())
+			}
+		}
+
+		return DemuxReport{}, err
+	}
+
+	var videoFile io.Writer
+	var audioFile io.Writer
+	var err error
+	if writeVideo {
+		if videoFile, err = create("video"); err != nil {
+			return abandon(err)
+		}
+	}
+	if writeAudio {
+		if audioFile, err = create("audio"); err != nil {
+			return abandon(err)
+		}
+	}
+
+	if checkpoint != nil {
+		// Called once the writers have been flushed
+		opts.checkpoint = func(nextFrame int, report DemuxReport) error {
+			for i, f := range outputs {
+				size, err := f.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return err
+				}
+				checkpoint.Sizes[i] = size
+			}
+
+			checkpoint.NextFrame = nextFrame
+			checkpoint.Report = report
+			return checkpoint.save()
+		}
+	}
+
+	report, err := DemuxSinglePartitionToWriters(ctx, ubvFilename, partition, videoFile, videoTrackNum, audioFile, audioTrackNum, opts)
+
+	// An interrupted resumable demux keeps its partial outputs (if it got far enough to checkpoint them)
+	keepPartial := false
+	if checkpoint == nil && len(finalNames) > 0 {
+		// Any checkpoint left by an earlier resumable demux no longer applies
+		os.Remove(checkpointFilename(finalNames))
+	} else if checkpoint != nil {
+		if _, statErr := os.Stat(checkpointFilename(finalNames)); err != nil && statErr == nil {
+			keepPartial = true
+			logging.Info("Partition ", partition.Index, " is partially demuxed, run again with -resume to continue")
+		} else {
+			os.Remove(checkpointFilename(finalNames))
+		}
+	}
+
+	for i, f := range outputs {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+
 		if err != nil {
-			log.Fatal("Error opening audio bitstream output", err)
+			if !keepPartial {
+				os.Remove(f.Name())
+			}
+		} else if renameErr := os.Rename(f.Name(), finalNames[i]); renameErr != nil {
+			err = fmt.Errorf("could not move bitstream output into place as %s: %w", finalNames[i], renameErr)
 		}
+	}
+
+	return report, err
+}
 
-		defer audioFileRaw.Close()
+// The name to write an output to before it is complete, keeping the extension
+func temporaryFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".tmp" + ext
+}
 
-		audioFile = bufio.NewWriter(audioFileRaw)
-	} else {
-		audioFile = nil
+// Opens the .ubv and demuxes a single partition to the provided writers, either of which may be nil
+func DemuxSinglePartitionToWriters(ctx context.Context, ubvFilename string, partition *ubv.UbvPartition, videoFile io.Writer, videoTrackNum int, audioFile io.Writer, audioTrackNum int, opts DemuxOptions) (DemuxReport, error) {
+	// The input media file; N.B. DemuxSinglePartition does its own buffering of the partition's byte range
+	ubvFile, err := os.OpenFile(ubvFilename, os.O_RDONLY, 0)
+	if err != nil {
+		return DemuxReport{}, fmt.Errorf("could not open %s: %w", ubvFilename, err)
 	}
 
-	DemuxSinglePartition(ubvFilename, partition, videoFile, videoTrackNum, ubvFile, audioFile)
+	defer ubvFile.Close()
+
+	return DemuxSinglePartition(ctx, ubvFilename, partition, videoFile, videoTrackNum, ubvFile, audioFile, audioTrackNum, opts)
 }
 
-// Extract video and audio data from a given partition of a .ubv file into raw .H264 bitstream and/or raw .AAC bitstream file
-func DemuxSinglePartition(ubvFilename string, partition *ubv.UbvPartition, videoFile *bufio.Writer, videoTrackNum int, ubvFile *os.File, audioFile *bufio.Writer) {
+// Extract video and audio data from a given partition of a .ubv file into raw .H264/.H265 bitstream and/or raw .AAC bitstream file
+// Returns a summary of the video NAL types encountered
+// Writers with a Flush method (e.g. *bufio.Writer) are flushed once the partition has been written
+// If ctx is cancelled the demux stops early and returns ctx.Err()
+func DemuxSinglePartition(ctx context.Context, ubvFilename string, partition *ubv.UbvPartition, videoFile io.Writer, videoTrackNum int, ubvFile *os.File, audioFile io.Writer, audioTrackNum int, opts DemuxOptions) (DemuxReport, error) {
+	// Resuming carries on from a frame boundary, with the stream's opening already written
+	resuming := opts.startFrame > 0
+	report := opts.resumedReport
+
 	// Allocate a buffer large enough for the largest frame
 	var buffer []byte
 	{
@@ -65,83 +303,197 @@ func DemuxSinglePartition(ubvFilename string, partition *ubv.UbvPartition, video
 		buffer = make([]byte, bufferSize)
 	}
 
-	// Write opening NAL separator to video track
-	if videoFile != nil {
-		if bytesWritten, err := videoFile.Write([]byte{0, 0, 0, 1}); err != nil {
-			log.Fatal("Failed to write output NAL Separator! Only wrote ", bytesWritten, ". Error:", err)
-		} else if bytesWritten != 4 {
-			log.Fatal("Tried to write 4 bytes of NAL separator, but wrote ", bytesWritten)
+	progress := DemuxProgress{Partition: partition.Index}
+	for i, frame := range partition.Frames {
+		if (frame.TrackNumber == videoTrackNum && videoFile != nil) || (frame.TrackNumber == audioTrackNum && audioFile != nil) {
+			progress.TotalFrames++
+			progress.TotalBytes += int64(frame.Size)
+
+			if i < opts.startFrame {
+				progress.Frames++
+				progress.Bytes += int64(frame.Size)
+			}
 		}
 	}
+	lastProgress := time.Now()
+	lastCheckpoint := time.Now()
 
-	for _, frame := range partition.Frames {
-		if frame.TrackNumber == videoTrackNum && videoFile != nil {
-			// Video packet - contains one or more length-prefixed NALs
-			frameDataRead := 0
-
-			// N.B. perf of this loop could be improved by simply reading the whole record into
-			//      memory and then working on it as a byte array
-			for frameDataRead < frame.Size {
-				// Seek to H.264 NAL length prefix
-				if _, err := ubvFile.Seek(int64(frame.Offset+frameDataRead), io.SeekStart); err != nil {
-					log.Fatal("Failed to seek to ", int64(frame.Offset+frameDataRead), " in ", ubvFilename, ": ", err)
-				}
+	// Write opening NAL separator to video track (with short start codes, each NAL writes its own)
+	if videoFile != nil && !opts.ShortStartCodes && !opts.AVCC && !resuming {
+		if _, err := videoFile.Write([]byte{0, 0, 0, 1}); err != nil {
+			return report, fmt.Errorf("could not write video: %w", err)
+		}
+	}
 
-				var nalSize int32
-				if err := binary.Read(ubvFile, binary.BigEndian, &nalSize); err != nil {
-					log.Fatal("Failed to read H.264 NAL size from ", ubvFilename, err)
-				} else if frameDataRead+int(nalSize) > frame.Size {
-					// Warn if we would read beyond this Frame
-					log.Fatal("Read goes beyond frame size! pos within frame: ", frameDataRead, " nalSize: ", nalSize, ", frame.Size:", frame.Size)
-				}
+	codec := ubv.CodecH264
+	if track, ok := partition.Tracks[videoTrackNum]; ok && track.Codec == ubv.CodecHEVC {
+		codec = ubv.CodecHEVC
+	}
+
+	replaceParameterSets := len(opts.ReplacementParameterSets) > 0
+	if replaceParameterSets && codec != ubv.CodecH264 {
+		logging.Warn("Warning: SPS repair is only supported for H.264, ignoring for ", codec, " track ", videoTrackNum)
+		replaceParameterSets = false
+	}
 
-				frameDataRead += 4
+	var adts *adtsHeader
+	if audioFile != nil && opts.ADTS {
+		if track, ok := partition.Tracks[audioTrackNum]; ok && track.Codec != ubv.CodecAAC {
+			logging.Warn("Warning: ADTS headers only apply to AAC, not writing them for ", track.Codec, " track ", audioTrackNum)
+		} else if ok {
+			var err error
+			if adts, err = newADTSHeader(track.Rate, track.Channels); err != nil {
+				logging.Warn("Warning: not writing ADTS headers for partition ", partition.Index, ": ", err)
+			}
+		}
+	}
+
+	if opts.AVCC && (replaceParameterSets || len(opts.FallbackParameterSets) > 0) {
+		logging.Warn("Warning: parameter sets are not rewritten in AVCC output, ignoring them for partition ", partition.Index)
+		replaceParameterSets = false
+	}
+
+	// N.B. when resuming, the leading NALs were dealt with before the checkpoint (and AVCC frames are not reordered)
+	leading := &leadingNALReorderer{out: videoFile, codec: codec, shortStartCodes: opts.ShortStartCodes, fallbackParameterSets: opts.FallbackParameterSets, done: resuming || opts.AVCC}
+	reader := newSequentialReader(ubvFile, partition)
 
-				// Read
-				if _, err := io.ReadFull(ubvFile, buffer[0:nalSize]); err != nil {
-					log.Fatal("Failed to read ", frame.Size, " bytes of video essence at ", frame.Offset, err)
+	if videoFile != nil && replaceParameterSets && !resuming {
+		for _, nal := range opts.ReplacementParameterSets {
+			if err := leading.Write(nal); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// Records that the frames before nextFrame have been written, once nothing is held back. If the writers cannot be
+	// flushed, no checkpoint is saved (the outputs would not match it) and the error is returned
+	saveCheckpoint := func(nextFrame int) error {
+		if opts.checkpoint == nil || (videoFile != nil && !leading.done) {
+			return nil
+		}
+
+		for _, w := range []io.Writer{videoFile, audioFile} {
+			if flushable, ok := w.(flusher); ok {
+				if err := flushable.Flush(); err != nil {
+					return fmt.Errorf("could not write output: %w", err)
 				}
+			}
+		}
+
+		if err := opts.checkpoint(nextFrame, report); err != nil {
+			logging.Warn("Warning: could not save resume checkpoint for partition ", partition.Index, ": ", err)
+		}
+		lastCheckpoint = time.Now()
+		return nil
+	}
+
+	for i := opts.startFrame; i < len(partition.Frames); i++ {
+		frame := partition.Frames[i]
+
+		// Periodically check for cancellation
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			// The earlier checkpoint still applies if this one cannot be saved
+			saveCheckpoint(i)
+			return report, ctx.Err()
+		}
+
+		if frame.TrackNumber == videoTrackNum && videoFile != nil {
+			// Video packet - contains one or more length-prefixed NALs
+			// Read the whole frame with a single read, then walk its NALs in memory
+			if err := reader.readFrame(buffer[0:frame.Size], int64(frame.Offset)); err != nil {
+				return report, fmt.Errorf("could not read %d bytes of video at %d in %s: %w", frame.Size, frame.Offset, ubvFilename, err)
+			}
 
-				frameDataRead += int(nalSize)
+			// A corrupt frame (e.g. after an unclean shutdown) is dropped whole, rather than writing part of it
+			nals, err := splitNALs(buffer[0:frame.Size])
+			if err != nil {
+				logging.Debugf("Skipping corrupt video frame at offset %d in partition %d: %v", frame.Offset, partition.Index, err)
+				report.SkippedFrames++
+				continue
+			}
+
+			if opts.AVCC {
+				// Already length-prefixed, so the frame is copied as it is
+				for _, nal := range nals {
+					report.count(classifyNAL(codec, nal))
+				}
 
-				// Write H.264 essence
-				if bytesWritten, err := videoFile.Write(buffer[0:nalSize]); err != nil {
-					log.Fatal("Failed to write output video data! Only wrote ", bytesWritten, " bytes. Error:", err)
+				if _, err := videoFile.Write(buffer[0:frame.Size]); err != nil {
+					return report, fmt.Errorf("could not write video: %w", err)
 				}
-				// Write NAL separator
-				if bytesWritten, err := videoFile.Write([]byte{0, 0, 0, 1}); err != nil {
-					log.Fatal("Failed to write output NAL Separator! Only wrote ", bytesWritten, " bytes. Error:", err)
+			} else {
+				for _, nal := range nals {
+					class := classifyNAL(codec, nal)
+					report.count(class)
+
+					// Write H.264/H.265 essence (and NAL separator)
+					if class == nalSPS && replaceParameterSets {
+						// Drop the stream's own (presumed damaged) SPS
+						continue
+					}
+					if err := leading.Write(nal); err != nil {
+						return report, err
+					}
 				}
 			}
 
-		} else if frame.TrackNumber == ubv.TrackAudio && audioFile != nil {
+		} else if frame.TrackNumber == audioTrackNum && audioFile != nil {
 			// Audio packet - contains raw AAC bitstream
 
-			// Seek
-			if _, err := ubvFile.Seek(int64(frame.Offset), io.SeekStart); err != nil {
-				log.Fatal("Failed to seek to ", frame.Offset, "in ", ubvFilename, err)
+			if err := reader.readFrame(buffer[0:frame.Size], int64(frame.Offset)); err != nil {
+				return report, fmt.Errorf("could not read %d bytes of audio at %d in %s: %w", frame.Size, frame.Offset, ubvFilename, err)
 			}
 
-			// Read
-			if _, err := io.ReadFull(ubvFile, buffer[0:frame.Size]); err != nil {
-				log.Fatal("Failed to read ", frame.Size, " bytes at ", frame.Offset, err)
+			if adts != nil {
+				if header, err := adts.forFrame(frame.Size); err != nil {
+					logging.Warn("Warning: ", err, ", not writing an ADTS header for it")
+				} else if _, err := audioFile.Write(header); err != nil {
+					return report, fmt.Errorf("could not write audio: %w", err)
+				}
 			}
 
-			if bytesWritten, err := audioFile.Write(buffer[0:frame.Size]); err != nil {
-				log.Fatal("Failed to write output audio data! Only wrote ", bytesWritten, ". Error:", err)
+			if _, err := audioFile.Write(buffer[0:frame.Size]); err != nil {
+				return report, fmt.Errorf("could not write audio: %w", err)
 			}
 		} else {
 			continue
 		}
+
+		progress.Frames++
+		progress.Bytes += int64(frame.Size)
+		if opts.Progress != nil && time.Since(lastProgress) >= progressInterval {
+			opts.Progress(progress)
+			lastProgress = time.Now()
+		}
+
+		if opts.checkpoint != nil && time.Since(lastCheckpoint) >= checkpointInterval {
+			if err := saveCheckpoint(i + 1); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(progress)
 	}
 
-	// Flush all buffered output data
+	if report.SkippedFrames > 0 {
+		logging.Warnf("Warning: skipped %d corrupt video frames in partition %d (use -log-level debug for details)", report.SkippedFrames, partition.Index)
+	}
 
-	if audioFile != nil {
-		audioFile.Flush()
+	// Write out any NALs still held back (e.g. if the partition had very few NALs)
+	if err := leading.Flush(); err != nil {
+		return report, err
 	}
 
-	if videoFile != nil {
-		videoFile.Flush()
+	// Flush all buffered output data, failing if any of it could not be written (e.g. the disk is full)
+	for _, w := range []io.Writer{audioFile, videoFile} {
+		if flushable, ok := w.(flusher); ok {
+			if err := flushable.Flush(); err != nil {
+				return report, fmt.Errorf("could not write output: %w", err)
+			}
+		}
 	}
+
+	return report, nil
 }
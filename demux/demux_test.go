@@ -0,0 +1,91 @@
+package demux
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Writes frames to a .ubv in a temporary directory, returning its filename and index
+func writeTestUbv(t *testing.T, frames [][][]byte) (string, *ubv.UbvPartition) {
+	dir, err := ioutil.TempDir("", "ubvremux-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ubvFilename := filepath.Join(dir, "test.ubv")
+	ubvFile, err := os.Create(ubvFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ubvFile.Close()
+
+	partition, err := WriteSample(ubvFile, frames, 30, time.Date(2023, time.Month(5), 16, 11, 58, 26, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ubvFilename, partition
+}
+
+// An SPS, PPS and IDR in the first frame, then a non-IDR frame
+var testFrames = [][][]byte{
+	{{0x67, 0x01, 0x02}, {0x68, 0x03}, {0x65, 0x04, 0x05}},
+	{{0x41, 0x06}},
+}
+
+func TestDemuxStartCodes(t *testing.T) {
+	ubvFilename, partition := writeTestUbv(t, testFrames)
+
+	tests := []struct {
+		name string
+		opts DemuxOptions
+		want []byte
+	}{
+		{"default", DemuxOptions{}, []byte{
+			0, 0, 0, 1, 0x67, 0x01, 0x02, 0, 0, 0, 1, 0x68, 0x03, 0, 0, 0, 1, 0x65, 0x04, 0x05, 0, 0, 0, 1, 0x41, 0x06, 0, 0, 0, 1,
+		}},
+		{"short start codes", DemuxOptions{ShortStartCodes: true}, []byte{
+			0, 0, 0, 1, 0x67, 0x01, 0x02, 0, 0, 0, 1, 0x68, 0x03, 0, 0, 0, 1, 0x65, 0x04, 0x05, 0, 0, 1, 0x41, 0x06,
+		}},
+	}
+
+	for _, test := range tests {
+		var video bytes.Buffer
+		if _, err := DemuxSinglePartitionToWriters(context.Background(), ubvFilename, partition, &video, ubv.TrackVideo, nil, 0, test.opts); err != nil {
+			t.Errorf("%s: demux failed: %v", test.name, err)
+		} else if !bytes.Equal(video.Bytes(), test.want) {
+			t.Errorf("%s: video is incorrect, got: %x, want: %x.", test.name, video.Bytes(), test.want)
+		}
+	}
+}
+
+// AVCC output is the frames as stored, length prefixes and all
+func TestDemuxAVCC(t *testing.T) {
+	ubvFilename, partition := writeTestUbv(t, testFrames)
+
+	var video bytes.Buffer
+	report, err := DemuxSinglePartitionToWriters(context.Background(), ubvFilename, partition, &video, ubv.TrackVideo, nil, 0, DemuxOptions{AVCC: true})
+	if err != nil {
+		t.Fatal("Demux failed: ", err)
+	}
+
+	want := []byte{
+		0, 0, 0, 3, 0x67, 0x01, 0x02, 0, 0, 0, 2, 0x68, 0x03, 0, 0, 0, 3, 0x65, 0x04, 0x05,
+		0, 0, 0, 2, 0x41, 0x06,
+	}
+	if !bytes.Equal(video.Bytes(), want) {
+		t.Errorf("AVCC video is incorrect, got: %x, want: %x.", video.Bytes(), want)
+	}
+
+	// NALs are still counted, even though they are not rewritten
+	if report.SPSCount != 1 || report.PPSCount != 1 || report.IDRCount != 1 || report.NonIDRCount != 1 {
+		t.Errorf("AVCC report is incorrect, got: %s", report)
+	}
+}
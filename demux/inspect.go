@@ -0,0 +1,139 @@
+package demux
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"ubvremux/ubv"
+)
+
+// How many runs StructureReport.String lists before summarising the rest
+const structureRunsShown = 40
+
+// A run of consecutive NALs of the same type in a demuxed video bitstream
+type NALRun struct {
+	Type  string
+	Count int
+}
+
+// The structure of a partition's demuxed video bitstream, for diagnosing decode errors
+type StructureReport struct {
+	// The sequence of NAL types, as runs of the same type
+	Runs []NALRun
+
+	// Why the stream cannot be decoded from its start, or empty if it opens with its parameter sets (VPS for H.265,
+	// SPS and PPS) followed by an IDR
+	Problem string
+}
+
+func (r StructureReport) String() string {
+	var runs []string
+	for i, run := range r.Runs {
+		if i == structureRunsShown {
+			runs = append(runs, fmt.Sprintf("... (%d more runs)", len(r.Runs)-i))
+			break
+		} else if run.Count == 1 {
+			runs = append(runs, run.Type)
+		} else {
+			runs = append(runs, fmt.Sprintf("%s x%d", run.Type, run.Count))
+		}
+	}
+
+	return strings.Join(runs, ", ")
+}
+
+// Demuxes a partition's video track (exactly as for extraction, with opts) and reports the sequence of NAL types in
+// the resulting bitstream, flagging a stream that does not open with its parameter sets and an IDR
+func InspectPartition(ctx context.Context, ubvFilename string, partition *ubv.UbvPartition, videoTrackNum int, opts DemuxOptions) (StructureReport, error) {
+	codec := ubv.CodecH264
+	if track, ok := partition.Tracks[videoTrackNum]; ok && track.Codec == ubv.CodecHEVC {
+		codec = ubv.CodecHEVC
+	}
+
+	scanner := &nalScanner{codec: codec}
+
+	// The scanner finds NALs by their Annex-B start codes
+	opts.Progress = nil
+	opts.AVCC = false
+	if _, err := DemuxSinglePartitionToWriters(ctx, ubvFilename, partition, scanner, videoTrackNum, nil, 0, opts); err != nil {
+		return StructureReport{}, err
+	}
+
+	return StructureReport{Runs: scanner.runs, Problem: startProblem(codec, scanner.runs)}, nil
+}
+
+// Why a stream with these runs of NALs cannot be decoded from its start, or empty if it can
+func startProblem(codec string, runs []NALRun) string {
+	seen := make(map[string]bool)
+	for _, run := range runs {
+		if run.Type == nalClassNames[nalIDR] || run.Type == nalClassNames[nalNonIDR] {
+			var missing []string
+			if codec == ubv.CodecHEVC && !seen[nalClassNames[nalVPS]] {
+				missing = append(missing, nalClassNames[nalVPS])
+			}
+			for _, class := range []nalClass{nalSPS, nalPPS} {
+				if !seen[nalClassNames[class]] {
+					missing = append(missing, nalClassNames[class])
+				}
+			}
+
+			if len(missing) > 0 {
+				return "no " + strings.Join(missing, "/") + " before the first slice"
+			} else if run.Type != nalClassNames[nalIDR] {
+				return "the first slice is not an IDR"
+			}
+
+			return ""
+		}
+
+		seen[run.Type] = true
+	}
+
+	return "no slices"
+}
+
+var nalClassNames = map[nalClass]string{
+	nalOther:  "other",
+	nalVPS:    "VPS",
+	nalSPS:    "SPS",
+	nalPPS:    "PPS",
+	nalAUD:    "AUD",
+	nalIDR:    "IDR",
+	nalNonIDR: "non-IDR",
+}
+
+// Classifies the NALs of an Annex-B bitstream as it is written, without keeping the bitstream itself
+type nalScanner struct {
+	codec string
+	runs  []NALRun
+
+	// Consecutive zero bytes just seen, and whether the next byte starts a NAL (i.e. follows a start code)
+	zeros     int
+	nalHeader bool
+}
+
+func (s *nalScanner) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if s.nalHeader {
+			s.nalHeader = false
+			s.add(nalClassNames[classifyNAL(s.codec, []byte{b})])
+		}
+
+		if b == 0 {
+			s.zeros++
+		} else {
+			s.nalHeader = b == 1 && s.zeros >= 2
+			s.zeros = 0
+		}
+	}
+
+	return len(p), nil
+}
+
+func (s *nalScanner) add(nalType string) {
+	if last := len(s.runs) - 1; last >= 0 && s.runs[last].Type == nalType {
+		s.runs[last].Count++
+	} else {
+		s.runs = append(s.runs, NALRun{Type: nalType, Count: 1})
+	}
+}
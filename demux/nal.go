@@ -0,0 +1,262 @@
+package demux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// H.264 nal_unit_type values (low 5 bits of the first NAL byte)
+const (
+	nalTypeNonIDR = 1
+	nalTypeIDR    = 5
+	nalTypeSPS    = 7
+	nalTypePPS    = 8
+	nalTypeAUD    = 9
+)
+
+// H.265 nal_unit_type values (bits 1-6 of the first NAL byte)
+const (
+	hevcNalTypeBLAWLP   = 16
+	hevcNalTypeRSVIRAP  = 23
+	hevcNalTypeVPS      = 32
+	hevcNalTypeSPS      = 33
+	hevcNalTypePPS      = 34
+	hevcNalTypeAUD      = 35
+	hevcNalTypeMaxSlice = 9
+)
+
+// Number of leading NALs to hold back while checking the stream opens with its parameter sets
+const leadingNALProbeCount = 8
+
+// Codec-independent classification of a NAL
+type nalClass int
+
+const (
+	nalOther nalClass = iota
+	nalVPS
+	nalSPS
+	nalPPS
+	nalAUD
+	nalIDR
+	nalNonIDR
+)
+
+func nalUnitType(nal []byte) int {
+	if len(nal) == 0 {
+		return -1
+	}
+
+	return int(nal[0] & 0x1F)
+}
+
+func hevcNalUnitType(nal []byte) int {
+	if len(nal) == 0 {
+		return -1
+	}
+
+	return int(nal[0]>>1) & 0x3F
+}
+
+// Splits the video essence of a frame into its NALs, each of which is preceded by a 4-byte big-endian length. Fails if
+// a length is zero or does not fit within the frame
+func splitNALs(frameData []byte) ([][]byte, error) {
+	var nals [][]byte
+
+	for pos := 0; pos < len(frameData); {
+		if pos+4 > len(frameData) {
+			return nil, fmt.Errorf("truncated NAL length at %d of %d bytes", pos, len(frameData))
+		}
+
+		// N.B. compared as uint32, so a huge length cannot overflow int on 32-bit platforms
+		nalSize := binary.BigEndian.Uint32(frameData[pos:])
+		pos += 4
+
+		if nalSize == 0 {
+			return nil, fmt.Errorf("zero NAL length at %d", pos-4)
+		} else if nalSize > uint32(len(frameData)-pos) {
+			return nil, fmt.Errorf("NAL length %d at %d goes beyond the frame's %d bytes", nalSize, pos-4, len(frameData))
+		}
+
+		nals = append(nals, frameData[pos:pos+int(nalSize)])
+		pos += int(nalSize)
+	}
+
+	return nals, nil
+}
+
+func classifyNAL(codec string, nal []byte) nalClass {
+	if codec == ubv.CodecHEVC {
+		nalType := hevcNalUnitType(nal)
+		switch {
+		case nalType == hevcNalTypeVPS:
+			return nalVPS
+		case nalType == hevcNalTypeSPS:
+			return nalSPS
+		case nalType == hevcNalTypePPS:
+			return nalPPS
+		case nalType == hevcNalTypeAUD:
+			return nalAUD
+		case nalType >= hevcNalTypeBLAWLP && nalType <= hevcNalTypeRSVIRAP:
+			// IRAP pictures (BLA, IDR, CRA)
+			return nalIDR
+		case nalType >= 0 && nalType <= hevcNalTypeMaxSlice:
+			return nalNonIDR
+		default:
+			return nalOther
+		}
+	}
+
+	switch nalUnitType(nal) {
+	case nalTypeSPS:
+		return nalSPS
+	case nalTypePPS:
+		return nalPPS
+	case nalTypeAUD:
+		return nalAUD
+	case nalTypeIDR:
+		return nalIDR
+	case nalTypeNonIDR:
+		return nalNonIDR
+	default:
+		return nalOther
+	}
+}
+
+// Writes a NAL preceded by a conventional Annex-B start code: 4 bytes before parameter sets, AUDs and IDR/IRAP NALs
+// (which begin access units), 3 bytes before everything else
+func writeNALWithStartCode(videoFile io.Writer, codec string, nal []byte) error {
+	startCode := []byte{0, 0, 1}
+	switch classifyNAL(codec, nal) {
+	case nalVPS, nalSPS, nalPPS, nalAUD, nalIDR:
+		startCode = []byte{0, 0, 0, 1}
+	}
+
+	if _, err := videoFile.Write(startCode); err != nil {
+		return fmt.Errorf("could not write video: %w", err)
+	}
+	if _, err := videoFile.Write(nal); err != nil {
+		return fmt.Errorf("could not write video: %w", err)
+	}
+
+	return nil
+}
+
+// Writes a NAL followed by a NAL separator
+func writeNAL(videoFile io.Writer, nal []byte) error {
+	if _, err := videoFile.Write(nal); err != nil {
+		return fmt.Errorf("could not write video: %w", err)
+	}
+	if _, err := videoFile.Write([]byte{0, 0, 0, 1}); err != nil {
+		return fmt.Errorf("could not write video: %w", err)
+	}
+
+	return nil
+}
+
+// Holds back the first few NALs of a video stream so that, if the stream does not open with its parameter sets,
+// the first parameter sets can be moved to the front. Some decoders require the stream begin with an SPS.
+type leadingNALReorderer struct {
+	out   io.Writer
+	codec string
+
+	// If true, NALs are written with writeNALWithStartCode rather than writeNAL
+	shortStartCodes bool
+
+	// If non-empty, written at the start of the stream if it does not open with parameter sets of its own
+	fallbackParameterSets [][]byte
+
+	pending [][]byte
+	done    bool
+}
+
+func (r *leadingNALReorderer) writeNAL(nal []byte) error {
+	if r.shortStartCodes {
+		return writeNALWithStartCode(r.out, r.codec, nal)
+	}
+	return writeNAL(r.out, nal)
+}
+
+func (r *leadingNALReorderer) Write(nal []byte) error {
+	if r.done {
+		return r.writeNAL(nal)
+	}
+
+	// Copy, the caller reuses its buffer
+	r.pending = append(r.pending, append([]byte(nil), nal...))
+
+	if len(r.pending) >= leadingNALProbeCount {
+		return r.Flush()
+	}
+
+	return nil
+}
+
+func (r *leadingNALReorderer) Flush() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+
+	nals := reorderLeadingParameterSets(r.codec, r.pending)
+	if len(r.fallbackParameterSets) > 0 && len(nals) > 0 && !opensWithParameterSets(r.codec, nals) {
+		logging.Debug("Stream does not open with parameter sets, prepending parameter sets from earlier in the file")
+		nals = append(append([][]byte(nil), r.fallbackParameterSets...), nals...)
+	}
+
+	r.pending = nil
+
+	for _, nal := range nals {
+		if err := r.writeNAL(nal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// If the first NAL is not a parameter set (or AUD), moves the first VPS (HEVC only), SPS and PPS found to the front
+func reorderLeadingParameterSets(codec string, nals [][]byte) [][]byte {
+	if len(nals) == 0 {
+		return nals
+	}
+
+	switch classifyNAL(codec, nals[0]) {
+	case nalVPS, nalSPS, nalPPS, nalAUD:
+		return nals
+	}
+
+	// Index of the first NAL of each parameter set class, in the order they must appear
+	order := []nalClass{nalVPS, nalSPS, nalPPS}
+	first := map[nalClass]int{}
+	for i, nal := range nals {
+		class := classifyNAL(codec, nal)
+		if _, seen := first[class]; !seen && (class == nalVPS || class == nalSPS || class == nalPPS) {
+			first[class] = i
+		}
+	}
+
+	if len(first) == 0 {
+		return nals
+	}
+
+	logging.Debug("Stream does not open with parameter sets, moving first parameter sets to the start of the stream")
+
+	moved := map[int]bool{}
+	reordered := make([][]byte, 0, len(nals))
+	for _, class := range order {
+		if i, ok := first[class]; ok {
+			reordered = append(reordered, nals[i])
+			moved[i] = true
+		}
+	}
+	for i, nal := range nals {
+		if !moved[i] {
+			reordered = append(reordered, nal)
+		}
+	}
+
+	return reordered
+}
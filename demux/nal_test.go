@@ -0,0 +1,100 @@
+package demux
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"ubvremux/ubv"
+)
+
+func TestClassifyNAL(t *testing.T) {
+	tests := []struct {
+		codec string
+		nal   []byte
+		want  nalClass
+	}{
+		// H.264: nal_unit_type is the low 5 bits, whatever nal_ref_idc is
+		{ubv.CodecH264, []byte{0x67, 0x42}, nalSPS},
+		{ubv.CodecH264, []byte{0x68, 0xCE}, nalPPS},
+		{ubv.CodecH264, []byte{0x09, 0xF0}, nalAUD},
+		{ubv.CodecH264, []byte{0x65, 0x88}, nalIDR},
+		{ubv.CodecH264, []byte{0x41, 0x9A}, nalNonIDR},
+		{ubv.CodecH264, []byte{0x01, 0x9A}, nalNonIDR},
+		{ubv.CodecH264, []byte{0x06, 0x05}, nalOther},
+		{ubv.CodecH264, []byte{}, nalOther},
+
+		// HEVC: nal_unit_type is bits 1-6 of the first byte
+		{ubv.CodecHEVC, []byte{0x40, 0x01}, nalVPS},
+		{ubv.CodecHEVC, []byte{0x42, 0x01}, nalSPS},
+		{ubv.CodecHEVC, []byte{0x44, 0x01}, nalPPS},
+		{ubv.CodecHEVC, []byte{0x46, 0x01}, nalAUD},
+		{ubv.CodecHEVC, []byte{0x20, 0x01}, nalIDR},    // BLA_W_LP (16)
+		{ubv.CodecHEVC, []byte{0x26, 0x01}, nalIDR},    // IDR_W_RADL (19)
+		{ubv.CodecHEVC, []byte{0x2A, 0x01}, nalIDR},    // CRA (21)
+		{ubv.CodecHEVC, []byte{0x2E, 0x01}, nalIDR},    // RSV_IRAP_VCL23
+		{ubv.CodecHEVC, []byte{0x02, 0x01}, nalNonIDR}, // TRAIL_R (1)
+		{ubv.CodecHEVC, []byte{0x12, 0x01}, nalNonIDR}, // RASL_R (9)
+		{ubv.CodecHEVC, []byte{0x4E, 0x01}, nalOther},  // prefix SEI (39)
+		{ubv.CodecHEVC, []byte{}, nalOther},
+	}
+
+	for _, test := range tests {
+		if class := classifyNAL(test.codec, test.nal); class != test.want {
+			t.Errorf("Class of %s NAL %x is incorrect, got: %d, want: %d.", test.codec, test.nal, class, test.want)
+		}
+	}
+}
+
+func TestWriteNALWithStartCode(t *testing.T) {
+	tests := []struct {
+		codec string
+		nal   []byte
+		want  []byte
+	}{
+		// 4-byte start codes before parameter sets, AUDs and IDR/IRAP NALs, 3-byte ones before everything else
+		{ubv.CodecH264, []byte{0x67, 0x42}, []byte{0, 0, 0, 1, 0x67, 0x42}},
+		{ubv.CodecH264, []byte{0x68, 0xCE}, []byte{0, 0, 0, 1, 0x68, 0xCE}},
+		{ubv.CodecH264, []byte{0x09, 0xF0}, []byte{0, 0, 0, 1, 0x09, 0xF0}},
+		{ubv.CodecH264, []byte{0x65, 0x88}, []byte{0, 0, 0, 1, 0x65, 0x88}},
+		{ubv.CodecH264, []byte{0x41, 0x9A}, []byte{0, 0, 1, 0x41, 0x9A}},
+		{ubv.CodecH264, []byte{0x06, 0x05}, []byte{0, 0, 1, 0x06, 0x05}},
+		{ubv.CodecHEVC, []byte{0x40, 0x01}, []byte{0, 0, 0, 1, 0x40, 0x01}},
+		{ubv.CodecHEVC, []byte{0x2A, 0x01}, []byte{0, 0, 0, 1, 0x2A, 0x01}},
+		{ubv.CodecHEVC, []byte{0x02, 0x01}, []byte{0, 0, 1, 0x02, 0x01}},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := writeNALWithStartCode(&out, test.codec, test.nal); err != nil {
+			t.Errorf("Writing %s NAL %x failed: %v", test.codec, test.nal, err)
+		} else if !bytes.Equal(out.Bytes(), test.want) {
+			t.Errorf("Written %s NAL %x is incorrect, got: %x, want: %x.", test.codec, test.nal, out.Bytes(), test.want)
+		}
+	}
+}
+
+func TestWriteNAL(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeNAL(&out, []byte{0x41, 0x9A}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0x41, 0x9A, 0, 0, 0, 1}; !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Written NAL is incorrect, got: %x, want: %x.", out.Bytes(), want)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteNALFailures(t *testing.T) {
+	if err := writeNAL(failingWriter{}, []byte{0x41}); err == nil {
+		t.Error("Expected writeNAL to fail when its writer does")
+	}
+	if err := writeNALWithStartCode(failingWriter{}, ubv.CodecH264, []byte{0x41}); err == nil {
+		t.Error("Expected writeNALWithStartCode to fail when its writer does")
+	}
+}
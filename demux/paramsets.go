@@ -0,0 +1,92 @@
+package demux
+
+import (
+	"os"
+	"ubvremux/ubv"
+)
+
+// Finds the most recent complete set of parameter sets (VPS for H.265, SPS and PPS) on a video track within the given
+// partitions, searching their keyframes backwards from the end of the last partition. Returns nil if none are found.
+// The NALs are returned in the order they must appear in the stream.
+func FindParameterSets(ubvFilename string, partitions []*ubv.UbvPartition, videoTrackNum int) ([][]byte, error) {
+	ubvFile, err := os.OpenFile(ubvFilename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ubvFile.Close()
+
+	for p := len(partitions) - 1; p >= 0; p-- {
+		partition := partitions[p]
+
+		track, ok := partition.Tracks[videoTrackNum]
+		if !ok || !track.IsVideo {
+			continue
+		}
+
+		for i := len(partition.Frames) - 1; i >= 0; i-- {
+			frame := partition.Frames[i]
+			if frame.TrackNumber != videoTrackNum || !frame.Keyframe {
+				continue
+			}
+
+			data := make([]byte, frame.Size)
+			if _, err := ubvFile.ReadAt(data, int64(frame.Offset)); err != nil {
+				return nil, err
+			}
+
+			nals, err := splitNALs(data)
+			if err != nil {
+				// Corrupt, try the keyframe before
+				continue
+			}
+
+			if parameterSets := frameParameterSets(track.Codec, nals); parameterSets != nil {
+				return parameterSets, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// The last VPS (H.265 only), SPS and PPS among a frame's NALs, or nil unless all are present
+func frameParameterSets(codec string, nals [][]byte) [][]byte {
+	order := []nalClass{nalSPS, nalPPS}
+	if codec == ubv.CodecHEVC {
+		order = []nalClass{nalVPS, nalSPS, nalPPS}
+	}
+
+	found := map[nalClass][]byte{}
+	for _, nal := range nals {
+		class := classifyNAL(codec, nal)
+		if class == nalVPS || class == nalSPS || class == nalPPS {
+			found[class] = nal
+		}
+	}
+
+	var parameterSets [][]byte
+	for _, class := range order {
+		nal, ok := found[class]
+		if !ok {
+			return nil
+		}
+		parameterSets = append(parameterSets, nal)
+	}
+
+	return parameterSets
+}
+
+// Whether a video stream (given its leading NALs) has an SPS before its first slice
+func opensWithParameterSets(codec string, nals [][]byte) bool {
+	for _, nal := range nals {
+		switch classifyNAL(codec, nal) {
+		case nalSPS:
+			return true
+		case nalIDR, nalNonIDR:
+			return false
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+package demux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Pull-model demuxer for a single track of a single partition
+type trackReader struct {
+	ubvFile   *os.File
+	partition *ubv.UbvPartition
+	trackNum  int
+	isVideo   bool
+
+	// Index of the next frame to examine
+	frameIndex int
+	reader     *sequentialReader
+
+	// Demuxed bytes not yet returned to the caller
+	pending bytes.Buffer
+	leading *leadingNALReorderer
+	buffer  []byte
+
+	// Corrupt video frames dropped but not yet reported
+	skippedFrames int
+}
+
+// Opens a reader yielding the demuxed bitstream of a single track within a partition: Annex-B for video tracks
+// (in the same form DemuxSinglePartition writes), or the raw AAC bitstream for audio tracks.
+// Data is read from the .ubv on demand, so no intermediate files are required.
+func OpenTrackReader(ubvFilename string, partition *ubv.UbvPartition, trackNum int) (io.ReadCloser, error) {
+	track, ok := partition.Tracks[trackNum]
+	if !ok {
+		return nil, fmt.Errorf("partition %d has no track %d", partition.Index, trackNum)
+	}
+
+	ubvFile, err := os.OpenFile(ubvFilename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &trackReader{
+		ubvFile:   ubvFile,
+		partition: partition,
+		trackNum:  trackNum,
+		isVideo:   track.IsVideo,
+		reader:    newSequentialReader(ubvFile, partition),
+	}
+
+	if r.isVideo {
+		// Opening NAL separator
+		r.pending.Write([]byte{0, 0, 0, 1})
+		r.leading = &leadingNALReorderer{out: &r.pending, codec: track.Codec}
+	}
+
+	return r, nil
+}
+
+func (r *trackReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		if r.frameIndex >= len(r.partition.Frames) {
+			if r.leading != nil && !r.leading.done {
+				// Release any NALs still held back
+				if err := r.leading.Flush(); err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			if r.skippedFrames > 0 {
+				logging.Warnf("Warning: skipped %d corrupt video frames in partition %d (use -log-level debug for details)", r.skippedFrames, r.partition.Index)
+				r.skippedFrames = 0
+			}
+
+			return 0, io.EOF
+		}
+
+		frame := r.partition.Frames[r.frameIndex]
+		r.frameIndex++
+
+		if frame.TrackNumber != r.trackNum {
+			continue
+		}
+
+		if err := r.readFrame(frame); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.pending.Read(p)
+}
+
+// Reads a frame and appends its demuxed form to the pending data
+func (r *trackReader) readFrame(frame ubv.UbvFrame) error {
+	if cap(r.buffer) < frame.Size {
+		r.buffer = make([]byte, frame.Size)
+	}
+	data := r.buffer[0:frame.Size]
+
+	if err := r.reader.readFrame(data, int64(frame.Offset)); err != nil {
+		return err
+	}
+
+	if !r.isVideo {
+		r.pending.Write(data)
+		return nil
+	}
+
+	// Video packet - contains one or more length-prefixed NALs. As in DemuxSinglePartition, a corrupt frame (e.g.
+	// after an unclean shutdown) is dropped whole
+	nals, err := splitNALs(data)
+	if err != nil {
+		logging.Debugf("Skipping corrupt video frame at offset %d in partition %d: %v", frame.Offset, r.partition.Index, err)
+		r.skippedFrames++
+		return nil
+	}
+
+	for _, nal := range nals {
+		if err := r.leading.Write(nal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *trackReader) Close() error {
+	return r.ubvFile.Close()
+}
@@ -0,0 +1,435 @@
+package demux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"ubvremux/ubv"
+)
+
+// How many frames of the track to search for an SPS before giving up
+const resolutionProbeFrames = 300
+
+var errShortSPS = errors.New("SPS truncated")
+
+// Reads an RBSP a bit at a time (including Exp-Golomb codes)
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) readBit() (uint, error) {
+	if r.pos >= uint(len(r.data))*8 {
+		return 0, errShortSPS
+	}
+
+	bit := uint(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(count uint) (uint, error) {
+	value := uint(0)
+	for i := uint(0); i < count; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+	return value, nil
+}
+
+func (r *bitReader) skipBits(count uint) error {
+	_, err := r.readBits(count)
+	return err
+}
+
+// Unsigned Exp-Golomb
+func (r *bitReader) readUE() (uint, error) {
+	leadingZeros := uint(0)
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		} else if bit == 1 {
+			break
+		} else if leadingZeros++; leadingZeros > 31 {
+			return 0, fmt.Errorf("invalid Exp-Golomb code in SPS")
+		}
+	}
+
+	suffix, err := r.readBits(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << leadingZeros) - 1 + suffix, nil
+}
+
+// Signed Exp-Golomb
+func (r *bitReader) readSE() (int, error) {
+	value, err := r.readUE()
+	if err != nil {
+		return 0, err
+	} else if value%2 == 1 {
+		return int(value+1) / 2, nil
+	}
+	return -int(value / 2), nil
+}
+
+// Removes emulation prevention bytes (the inverse of addEmulationPrevention)
+func removeEmulationPrevention(ebsp []byte) []byte {
+	out := make([]byte, 0, len(ebsp))
+	zeros := 0
+	for _, b := range ebsp {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// Reads the picture dimensions from an SPS NAL (including its NAL header) of the given codec
+func ParseSPSResolution(codec string, nal []byte) (Resolution, error) {
+	if codec == ubv.CodecHEVC {
+		if len(nal) < 2 {
+			return Resolution{}, errShortSPS
+		}
+		return parseHEVCSPSResolution(&bitReader{data: removeEmulationPrevention(nal[2:])})
+	}
+
+	if len(nal) < 1 {
+		return Resolution{}, errShortSPS
+	}
+	return parseH264SPSResolution(&bitReader{data: removeEmulationPrevention(nal[1:])})
+}
+
+func parseH264SPSResolution(r *bitReader) (Resolution, error) {
+	profileIdc, err := r.readBits(8)
+	if err != nil {
+		return Resolution{}, err
+	}
+
+	// constraint flags and level_idc
+	if err := r.skipBits(16); err != nil {
+		return Resolution{}, err
+	}
+	if _, err := r.readUE(); err != nil { // seq_parameter_set_id
+		return Resolution{}, err
+	}
+
+	chromaFormatIdc := uint(1)
+	separateColourPlane := uint(0)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIdc, err = r.readUE(); err != nil {
+			return Resolution{}, err
+		}
+		if chromaFormatIdc == 3 {
+			if separateColourPlane, err = r.readBit(); err != nil {
+				return Resolution{}, err
+			}
+		}
+		if _, err := r.readUE(); err != nil { // bit_depth_luma_minus8
+			return Resolution{}, err
+		}
+		if _, err := r.readUE(); err != nil { // bit_depth_chroma_minus8
+			return Resolution{}, err
+		}
+		if err := r.skipBits(1); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return Resolution{}, err
+		}
+
+		scalingMatrixPresent, err := r.readBit()
+		if err != nil {
+			return Resolution{}, err
+		}
+		if scalingMatrixPresent == 1 {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.readBit()
+				if err != nil {
+					return Resolution{}, err
+				}
+				if present == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					if err := skipScalingList(r, size); err != nil {
+						return Resolution{}, err
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := r.readUE(); err != nil { // log2_max_frame_num_minus4
+		return Resolution{}, err
+	}
+	picOrderCntType, err := r.readUE()
+	if err != nil {
+		return Resolution{}, err
+	}
+	if picOrderCntType == 0 {
+		if _, err := r.readUE(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return Resolution{}, err
+		}
+	} else if picOrderCntType == 1 {
+		if err := r.skipBits(1); err != nil { // delta_pic_order_always_zero_flag
+			return Resolution{}, err
+		}
+		if _, err := r.readSE(); err != nil { // offset_for_non_ref_pic
+			return Resolution{}, err
+		}
+		if _, err := r.readSE(); err != nil { // offset_for_top_to_bottom_field
+			return Resolution{}, err
+		}
+		cycle, err := r.readUE()
+		if err != nil {
+			return Resolution{}, err
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err := r.readSE(); err != nil {
+				return Resolution{}, err
+			}
+		}
+	}
+
+	if _, err := r.readUE(); err != nil { // max_num_ref_frames
+		return Resolution{}, err
+	}
+	if err := r.skipBits(1); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return Resolution{}, err
+	}
+	widthInMbsMinus1, err := r.readUE()
+	if err != nil {
+		return Resolution{}, err
+	}
+	heightInMapUnitsMinus1, err := r.readUE()
+	if err != nil {
+		return Resolution{}, err
+	}
+	frameMbsOnly, err := r.readBit()
+	if err != nil {
+		return Resolution{}, err
+	}
+	if frameMbsOnly == 0 {
+		if err := r.skipBits(1); err != nil { // mb_adaptive_frame_field_flag
+			return Resolution{}, err
+		}
+	}
+	if err := r.skipBits(1); err != nil { // direct_8x8_inference_flag
+		return Resolution{}, err
+	}
+
+	width := int(widthInMbsMinus1+1) * 16
+	height := int(2-frameMbsOnly) * int(heightInMapUnitsMinus1+1) * 16
+
+	cropping, err := r.readBit()
+	if err != nil {
+		return Resolution{}, err
+	}
+	if cropping == 1 {
+		var offsets [4]uint
+		for i := range offsets {
+			if offsets[i], err = r.readUE(); err != nil {
+				return Resolution{}, err
+			}
+		}
+
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if chromaFormatIdc != 0 && separateColourPlane == 0 {
+			subWidth, subHeight := chromaSubsampling(chromaFormatIdc)
+			cropUnitX = subWidth
+			cropUnitY *= subHeight
+		}
+
+		width -= cropUnitX * int(offsets[0]+offsets[1])
+		height -= cropUnitY * int(offsets[2]+offsets[3])
+	}
+
+	if width <= 0 || height <= 0 {
+		return Resolution{}, fmt.Errorf("SPS has invalid dimensions %dx%d", width, height)
+	}
+
+	return Resolution{Width: width, Height: height}, nil
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	lastScale, nextScale := 8, 8
+	for j := 0; j < size; j++ {
+		if nextScale != 0 {
+			delta, err := r.readSE()
+			if err != nil {
+				return err
+			}
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+	return nil
+}
+
+// SubWidthC and SubHeightC for a chroma_format_idc
+func chromaSubsampling(chromaFormatIdc uint) (int, int) {
+	switch chromaFormatIdc {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	default:
+		return 1, 1
+	}
+}
+
+func parseHEVCSPSResolution(r *bitReader) (Resolution, error) {
+	// sps_video_parameter_set_id
+	if err := r.skipBits(4); err != nil {
+		return Resolution{}, err
+	}
+	maxSubLayersMinus1, err := r.readBits(3)
+	if err != nil {
+		return Resolution{}, err
+	}
+	// sps_temporal_id_nesting_flag
+	if err := r.skipBits(1); err != nil {
+		return Resolution{}, err
+	}
+
+	// profile_tier_level: general profile (88 bits) and level (8 bits), then sub-layer presence flags
+	if err := r.skipBits(96); err != nil {
+		return Resolution{}, err
+	}
+	var profilePresent, levelPresent [8]uint
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i], err = r.readBit(); err != nil {
+			return Resolution{}, err
+		}
+		if levelPresent[i], err = r.readBit(); err != nil {
+			return Resolution{}, err
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		if err := r.skipBits(2 * (8 - maxSubLayersMinus1)); err != nil {
+			return Resolution{}, err
+		}
+	}
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] == 1 {
+			if err := r.skipBits(88); err != nil {
+				return Resolution{}, err
+			}
+		}
+		if levelPresent[i] == 1 {
+			if err := r.skipBits(8); err != nil {
+				return Resolution{}, err
+			}
+		}
+	}
+
+	if _, err := r.readUE(); err != nil { // sps_seq_parameter_set_id
+		return Resolution{}, err
+	}
+	chromaFormatIdc, err := r.readUE()
+	if err != nil {
+		return Resolution{}, err
+	}
+	separateColourPlane := uint(0)
+	if chromaFormatIdc == 3 {
+		if separateColourPlane, err = r.readBit(); err != nil {
+			return Resolution{}, err
+		}
+	}
+	width, err := r.readUE()
+	if err != nil {
+		return Resolution{}, err
+	}
+	height, err := r.readUE()
+	if err != nil {
+		return Resolution{}, err
+	}
+
+	res := Resolution{Width: int(width), Height: int(height)}
+
+	conformanceWindow, err := r.readBit()
+	if err != nil {
+		return Resolution{}, err
+	}
+	if conformanceWindow == 1 {
+		var offsets [4]uint
+		for i := range offsets {
+			if offsets[i], err = r.readUE(); err != nil {
+				return Resolution{}, err
+			}
+		}
+
+		subWidth, subHeight := 1, 1
+		if separateColourPlane == 0 {
+			subWidth, subHeight = chromaSubsampling(chromaFormatIdc)
+		}
+		res.Width -= subWidth * int(offsets[0]+offsets[1])
+		res.Height -= subHeight * int(offsets[2]+offsets[3])
+	}
+
+	if res.Width <= 0 || res.Height <= 0 {
+		return Resolution{}, fmt.Errorf("SPS has invalid dimensions %s", res)
+	}
+
+	return res, nil
+}
+
+// Determines the resolution of a video track by parsing the first SPS found in the partition
+func ProbeResolution(ubvFilename string, partition *ubv.UbvPartition, videoTrackNum int) (Resolution, error) {
+	track, ok := partition.Tracks[videoTrackNum]
+	if !ok || !track.IsVideo {
+		return Resolution{}, fmt.Errorf("partition %d has no video track %d", partition.Index, videoTrackNum)
+	}
+
+	ubvFile, err := os.Open(ubvFilename)
+	if err != nil {
+		return Resolution{}, err
+	}
+	defer ubvFile.Close()
+
+	framesSearched := 0
+	for _, frame := range partition.Frames {
+		if frame.TrackNumber != videoTrackNum {
+			continue
+		} else if framesSearched++; framesSearched > resolutionProbeFrames {
+			break
+		}
+
+		data := make([]byte, frame.Size)
+		if _, err := ubvFile.ReadAt(data, int64(frame.Offset)); err != nil && err != io.EOF {
+			return Resolution{}, fmt.Errorf("could not read frame at %d: %w", frame.Offset, err)
+		}
+
+		nals, err := splitNALs(data)
+		if err != nil {
+			// Corrupt, try the next frame
+			continue
+		}
+
+		for _, nal := range nals {
+			if classifyNAL(track.Codec, nal) == nalSPS {
+				return ParseSPSResolution(track.Codec, nal)
+			}
+		}
+	}
+
+	return Resolution{}, fmt.Errorf("no SPS found in the first %d frames of track %d", resolutionProbeFrames, videoTrackNum)
+}
@@ -0,0 +1,75 @@
+package demux
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// How often a resumable demux records its progress
+const checkpointInterval = 10 * time.Second
+
+// The progress of a resumable demux, saved alongside its (temporary) outputs so an interrupted demux can carry on from
+// NextFrame rather than starting again. The outputs are truncated back to Sizes on resuming, discarding anything
+// written after the checkpoint
+type demuxCheckpoint struct {
+	// The final names of the outputs, and the number of frames in the partition, to check the checkpoint still applies
+	Outputs    []string `json:"outputs"`
+	FrameCount int      `json:"frameCount"`
+
+	NextFrame int         `json:"nextFrame"`
+	Sizes     []int64     `json:"sizes"`
+	Report    DemuxReport `json:"report"`
+}
+
+// The checkpoint file of a demux, named after its first output
+func checkpointFilename(outputs []string) string {
+	return temporaryFilename(outputs[0]) + ".resume"
+}
+
+// Loads the checkpoint of an interrupted demux to outputs, returning nil if there is none (or it no longer applies, in
+// which case the demux starts again)
+func loadCheckpoint(outputs []string, partition *ubv.UbvPartition) *demuxCheckpoint {
+	data, err := ioutil.ReadFile(checkpointFilename(outputs))
+	if err != nil {
+		return nil
+	}
+
+	var checkpoint demuxCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		logging.Warn("Warning: ignoring unreadable resume checkpoint ", checkpointFilename(outputs), ": ", err)
+		return nil
+	}
+
+	valid := checkpoint.FrameCount == len(partition.Frames) && checkpoint.NextFrame <= len(partition.Frames) &&
+		len(checkpoint.Outputs) == len(outputs) && len(checkpoint.Sizes) == len(outputs)
+	for i := 0; valid && i < len(outputs); i++ {
+		info, err := os.Stat(temporaryFilename(outputs[i]))
+		valid = checkpoint.Outputs[i] == outputs[i] && err == nil && info.Size() >= checkpoint.Sizes[i]
+	}
+
+	if !valid {
+		logging.Warn("Warning: resume checkpoint ", checkpointFilename(outputs), " does not match the partition or its partial outputs, starting again")
+		return nil
+	}
+
+	return &checkpoint
+}
+
+// Writes the checkpoint, replacing any previous one in a single step
+func (checkpoint *demuxCheckpoint) save() error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	filename := checkpointFilename(checkpoint.Outputs)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
@@ -0,0 +1,135 @@
+package demux
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+	"ubvremux/ubv"
+)
+
+// The dimensions of the generated sample: a single macroblock
+const sampleSize = 16
+
+// Generates a tiny H.264 stream (16x16, Baseline profile) of frameCount IDR frames, with the SPS and PPS ahead of the
+// first. Each frame is one I_PCM macroblock, so no encoder is needed; the pixel values change from frame to frame.
+func SampleFrames(frameCount int) [][][]byte {
+	sps := &bitWriter{}
+	sps.writeBits(66, 8)   // profile_idc: Baseline
+	sps.writeBits(0xC0, 8) // constraint_set0_flag + constraint_set1_flag
+	sps.writeBits(10, 8)   // level_idc: 1.0
+	sps.writeUE(0)         // seq_parameter_set_id
+	sps.writeUE(0)         // log2_max_frame_num_minus4
+	sps.writeUE(2)         // pic_order_cnt_type: derived from frame_num
+	sps.writeUE(1)         // max_num_ref_frames
+	sps.writeBit(0)        // gaps_in_frame_num_value_allowed_flag
+	sps.writeUE(0)         // pic_width_in_mbs_minus1
+	sps.writeUE(0)         // pic_height_in_map_units_minus1
+	sps.writeBit(1)        // frame_mbs_only_flag
+	sps.writeBit(1)        // direct_8x8_inference_flag
+	sps.writeBit(0)        // frame_cropping_flag
+	sps.writeBit(0)        // vui_parameters_present_flag
+	sps.writeTrailingBits()
+
+	pps := &bitWriter{}
+	pps.writeUE(0)  // pic_parameter_set_id
+	pps.writeUE(0)  // seq_parameter_set_id
+	pps.writeBit(0) // entropy_coding_mode_flag: CAVLC
+	pps.writeBit(0) // bottom_field_pic_order_in_frame_present_flag
+	pps.writeUE(0)  // num_slice_groups_minus1
+	pps.writeUE(0)  // num_ref_idx_l0_default_active_minus1
+	pps.writeUE(0)  // num_ref_idx_l1_default_active_minus1
+	pps.writeBit(0) // weighted_pred_flag
+	pps.writeBits(0, 2)
+	pps.writeSE(0)  // pic_init_qp_minus26
+	pps.writeSE(0)  // pic_init_qs_minus26
+	pps.writeSE(0)  // chroma_qp_index_offset
+	pps.writeBit(1) // deblocking_filter_control_present_flag
+	pps.writeBit(0) // constrained_intra_pred_flag
+	pps.writeBit(0) // redundant_pic_cnt_present_flag
+	pps.writeTrailingBits()
+
+	frames := make([][][]byte, frameCount)
+	for i := range frames {
+		slice := &bitWriter{}
+		slice.writeUE(0)           // first_mb_in_slice
+		slice.writeUE(7)           // slice_type: I (all slices)
+		slice.writeUE(0)           // pic_parameter_set_id
+		slice.writeBits(0, 4)      // frame_num (always 0, as every frame is IDR)
+		slice.writeUE(uint(i % 2)) // idr_pic_id, which must differ between consecutive IDR frames
+		slice.writeBit(0)          // no_output_of_prior_pics_flag
+		slice.writeBit(0)          // long_term_reference_flag
+		slice.writeSE(0)           // slice_qp_delta
+		slice.writeUE(1)           // disable_deblocking_filter_idc
+
+		slice.writeUE(25) // mb_type: I_PCM
+		for slice.nbits%8 != 0 {
+			slice.writeBit(0) // pcm_alignment_zero_bit
+		}
+
+		// Luma then both chroma planes (4:2:0); zero samples are avoided so that the values stay clear of start codes
+		for sample := 0; sample < sampleSize*sampleSize*3/2; sample++ {
+			slice.writeBits(uint(16+(i*8+sample)%224), 8)
+		}
+		slice.writeTrailingBits()
+
+		frames[i] = [][]byte{append([]byte{0x65}, addEmulationPrevention(slice.data)...)}
+	}
+
+	frames[0] = append([][]byte{
+		append([]byte{0x67}, addEmulationPrevention(sps.data)...),
+		append([]byte{0x68}, addEmulationPrevention(pps.data)...),
+	}, frames[0]...)
+
+	return frames
+}
+
+// Writes frames (as from SampleFrames) to w in the .ubv frame layout, each NAL preceded by its 4-byte big-endian
+// length, returning a single-partition index of them on the main video track at rate frames per second
+func WriteSample(w io.Writer, frames [][][]byte, rate int, start time.Time) (*ubv.UbvPartition, error) {
+	partition := &ubv.UbvPartition{
+		Tracks:          make(map[int]*ubv.UbvTrack),
+		VideoTrackCount: 1,
+	}
+
+	track := &ubv.UbvTrack{
+		IsVideo:       true,
+		TrackNumber:   ubv.TrackVideo,
+		Codec:         ubv.CodecH264,
+		StartTimecode: start,
+		Rate:          rate,
+	}
+	partition.Tracks[ubv.TrackVideo] = track
+
+	offset := 0
+	for i, nals := range frames {
+		size := 0
+		for _, nal := range nals {
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(len(nal)))
+			if _, err := w.Write(length[:]); err != nil {
+				return nil, err
+			} else if _, err := w.Write(nal); err != nil {
+				return nil, err
+			}
+			size += 4 + len(nal)
+		}
+
+		timecode := start.Add(time.Duration(i) * time.Second / time.Duration(rate))
+		partition.Frames = append(partition.Frames, ubv.UbvFrame{
+			TrackNumber: ubv.TrackVideo,
+			Offset:      offset,
+			Size:        size,
+			Timecode:    timecode,
+			Keyframe:    true,
+		})
+		offset += size
+
+		track.FrameCount++
+		track.LastTimecode = timecode
+	}
+
+	partition.FrameCount = len(partition.Frames)
+	partition.EndOffset = int64(offset)
+
+	return partition, nil
+}
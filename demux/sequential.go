@@ -0,0 +1,54 @@
+package demux
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"ubvremux/ubv"
+)
+
+// The read-ahead used when streaming a partition's byte range
+const sequentialBufferSize = 4 * 1024 * 1024
+
+// Reads frames from a partition's byte range of the .ubv. Frames are normally stored in ascending offset order, so
+// rather than seeking (and making a small read) for every frame, the range is streamed through a large buffer and the
+// bytes of frames that are not wanted are skipped over. Reads that go backwards, or skip a long way ahead, seek instead.
+type sequentialReader struct {
+	file *os.File
+	end  int64
+
+	// The offset in file that r will read from next; r is nil until the first read
+	pos int64
+	r   *bufio.Reader
+}
+
+func newSequentialReader(file *os.File, partition *ubv.UbvPartition) *sequentialReader {
+	end := partition.EndOffset
+	for _, frame := range partition.Frames {
+		// Partitions built without an analysed byte range (or edited since) still read correctly
+		if frameEnd := int64(frame.Offset + frame.Size); frameEnd > end {
+			end = frameEnd
+		}
+	}
+
+	return &sequentialReader{file: file, end: end}
+}
+
+// Reads the len(buf) bytes at offset into buf
+func (s *sequentialReader) readFrame(buf []byte, offset int64) error {
+	if s.r == nil || offset < s.pos || offset-s.pos > sequentialBufferSize {
+		s.r = bufio.NewReaderSize(io.NewSectionReader(s.file, offset, s.end-offset), sequentialBufferSize)
+		s.pos = offset
+	} else if skip := int(offset - s.pos); skip > 0 {
+		discarded, err := s.r.Discard(skip)
+		s.pos += int64(discarded)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := io.ReadFull(s.r, buf)
+	s.pos += int64(n)
+
+	return err
+}
@@ -0,0 +1,172 @@
+package demux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Video dimensions in pixels
+type Resolution struct {
+	Width  int
+	Height int
+}
+
+func (r Resolution) String() string {
+	return strconv.Itoa(r.Width) + "x" + strconv.Itoa(r.Height)
+}
+
+// Parses a resolution expressed as WxH (e.g. 1920x1080)
+func ParseResolution(value string) (Resolution, error) {
+	parts := strings.Split(strings.ToLower(value), "x")
+	if len(parts) != 2 {
+		return Resolution{}, fmt.Errorf("invalid resolution %q, expected WxH (e.g. 1920x1080)", value)
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 {
+		return Resolution{}, fmt.Errorf("invalid resolution width in %q", value)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height <= 0 {
+		return Resolution{}, fmt.Errorf("invalid resolution height in %q", value)
+	}
+
+	return Resolution{Width: width, Height: height}, nil
+}
+
+// Writes an H.264 RBSP a bit at a time (including Exp-Golomb codes)
+type bitWriter struct {
+	data  []byte
+	nbits uint
+}
+
+func (w *bitWriter) writeBit(bit uint) {
+	if w.nbits%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if bit != 0 {
+		w.data[len(w.data)-1] |= 0x80 >> (w.nbits % 8)
+	}
+	w.nbits++
+}
+
+func (w *bitWriter) writeBits(value uint, count uint) {
+	for i := count; i > 0; i-- {
+		w.writeBit((value >> (i - 1)) & 1)
+	}
+}
+
+// Unsigned Exp-Golomb
+func (w *bitWriter) writeUE(value uint) {
+	value++
+	length := uint(0)
+	for v := value; v > 1; v >>= 1 {
+		length++
+	}
+	w.writeBits(0, length)
+	w.writeBits(value, length+1)
+}
+
+// Signed Exp-Golomb
+func (w *bitWriter) writeSE(value int) {
+	if value > 0 {
+		w.writeUE(uint(2*value - 1))
+	} else {
+		w.writeUE(uint(-2 * value))
+	}
+}
+
+func (w *bitWriter) writeTrailingBits() {
+	w.writeBit(1)
+	for w.nbits%8 != 0 {
+		w.writeBit(0)
+	}
+}
+
+// Inserts emulation prevention bytes so the RBSP cannot contain a start code
+func addEmulationPrevention(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+4)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// Synthesises a minimal High profile SPS and PPS (in that order) for the given resolution.
+// This is a best-effort reconstruction: encoder-specific fields are set to common defaults, so it will only rescue
+// streams whose slices are compatible with those defaults.
+func SynthesiseParameterSets(res Resolution) [][]byte {
+	mbWidth := (res.Width + 15) / 16
+	mbHeight := (res.Height + 15) / 16
+
+	sps := &bitWriter{}
+	sps.writeBits(100, 8) // profile_idc: High
+	sps.writeBits(0, 8)   // constraint flags + reserved
+	sps.writeBits(51, 8)  // level_idc: 5.1
+	sps.writeUE(0)        // seq_parameter_set_id
+	sps.writeUE(1)        // chroma_format_idc: 4:2:0
+	sps.writeUE(0)        // bit_depth_luma_minus8
+	sps.writeUE(0)        // bit_depth_chroma_minus8
+	sps.writeBit(0)       // qpprime_y_zero_transform_bypass_flag
+	sps.writeBit(0)       // seq_scaling_matrix_present_flag
+	sps.writeUE(0)        // log2_max_frame_num_minus4
+	sps.writeUE(0)        // pic_order_cnt_type
+	sps.writeUE(2)        // log2_max_pic_order_cnt_lsb_minus4
+	sps.writeUE(1)        // max_num_ref_frames
+	sps.writeBit(0)       // gaps_in_frame_num_value_allowed_flag
+	sps.writeUE(uint(mbWidth - 1))
+	sps.writeUE(uint(mbHeight - 1))
+	sps.writeBit(1) // frame_mbs_only_flag
+	sps.writeBit(1) // direct_8x8_inference_flag
+
+	cropRight := (mbWidth*16 - res.Width) / 2
+	cropBottom := (mbHeight*16 - res.Height) / 2
+	if cropRight > 0 || cropBottom > 0 {
+		sps.writeBit(1) // frame_cropping_flag
+		sps.writeUE(0)
+		sps.writeUE(uint(cropRight))
+		sps.writeUE(0)
+		sps.writeUE(uint(cropBottom))
+	} else {
+		sps.writeBit(0)
+	}
+	sps.writeBit(0) // vui_parameters_present_flag
+	sps.writeTrailingBits()
+
+	pps := &bitWriter{}
+	pps.writeUE(0)  // pic_parameter_set_id
+	pps.writeUE(0)  // seq_parameter_set_id
+	pps.writeBit(1) // entropy_coding_mode_flag: CABAC
+	pps.writeBit(0) // bottom_field_pic_order_in_frame_present_flag
+	pps.writeUE(0)  // num_slice_groups_minus1
+	pps.writeUE(0)  // num_ref_idx_l0_default_active_minus1
+	pps.writeUE(0)  // num_ref_idx_l1_default_active_minus1
+	pps.writeBit(0) // weighted_pred_flag
+	pps.writeBits(0, 2)
+	pps.writeSE(0)  // pic_init_qp_minus26
+	pps.writeSE(0)  // pic_init_qs_minus26
+	pps.writeSE(0)  // chroma_qp_index_offset
+	pps.writeBit(1) // deblocking_filter_control_present_flag
+	pps.writeBit(0) // constrained_intra_pred_flag
+	pps.writeBit(0) // redundant_pic_cnt_present_flag
+	pps.writeBit(1) // transform_8x8_mode_flag
+	pps.writeBit(0) // pic_scaling_matrix_present_flag
+	pps.writeSE(0)  // second_chroma_qp_index_offset
+	pps.writeTrailingBits()
+
+	return [][]byte{
+		append([]byte{0x67}, addEmulationPrevention(sps.data)...),
+		append([]byte{0x68}, addEmulationPrevention(pps.data)...),
+	}
+}
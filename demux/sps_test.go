@@ -0,0 +1,72 @@
+package demux
+
+import (
+	"bytes"
+	"testing"
+	"ubvremux/ubv"
+)
+
+// Parameter sets synthesised for a resolution must parse back to that resolution
+func TestSynthesiseParameterSetsRoundTrip(t *testing.T) {
+	tests := []Resolution{
+		{Width: 640, Height: 360},
+		{Width: 1280, Height: 720},
+		{Width: 1920, Height: 1080},
+		{Width: 2592, Height: 1944},
+		{Width: 2688, Height: 1512},
+		{Width: 3840, Height: 2160},
+	}
+
+	for _, want := range tests {
+		parameterSets := SynthesiseParameterSets(want)
+		if len(parameterSets) != 2 {
+			t.Fatalf("Expected an SPS and a PPS for %s, got %d NALs", want, len(parameterSets))
+		}
+
+		if class := classifyNAL(ubv.CodecH264, parameterSets[0]); class != nalSPS {
+			t.Errorf("First parameter set for %s is not an SPS, got class: %d", want, class)
+		}
+		if class := classifyNAL(ubv.CodecH264, parameterSets[1]); class != nalPPS {
+			t.Errorf("Second parameter set for %s is not a PPS, got class: %d", want, class)
+		}
+
+		resolution, err := ParseSPSResolution(ubv.CodecH264, parameterSets[0])
+		if err != nil {
+			t.Errorf("Synthesised SPS for %s could not be parsed: %v", want, err)
+		} else if resolution != want {
+			t.Errorf("Synthesised SPS resolution is incorrect, got: %s, want: %s.", resolution, want)
+		}
+	}
+}
+
+func TestEmulationPreventionRoundTrip(t *testing.T) {
+	tests := []struct {
+		rbsp []byte
+		want []byte
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0, 0, 1}, []byte{0, 0, 3, 1}},
+		{[]byte{0, 0, 0, 0}, []byte{0, 0, 3, 0, 0}},
+		{[]byte{0, 0, 3}, []byte{0, 0, 3, 3}},
+		{[]byte{0, 0, 4}, []byte{0, 0, 4}},
+	}
+
+	for _, test := range tests {
+		escaped := addEmulationPrevention(test.rbsp)
+		if !bytes.Equal(escaped, test.want) {
+			t.Errorf("Escaped RBSP %x is incorrect, got: %x, want: %x.", test.rbsp, escaped, test.want)
+		}
+
+		if unescaped := removeEmulationPrevention(escaped); !bytes.Equal(unescaped, test.rbsp) {
+			t.Errorf("Unescaped RBSP %x is incorrect, got: %x, want: %x.", escaped, unescaped, test.rbsp)
+		}
+	}
+}
+
+func TestParseSPSResolutionRejectsTruncatedSPS(t *testing.T) {
+	sps := SynthesiseParameterSets(Resolution{Width: 1920, Height: 1080})[0]
+
+	if _, err := ParseSPSResolution(ubv.CodecH264, sps[0:4]); err == nil {
+		t.Error("Expected a truncated SPS to fail to parse")
+	}
+}
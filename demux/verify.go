@@ -0,0 +1,74 @@
+package demux
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Result of auditing the NAL length prefixes of a partition's video frames
+type NALVerificationReport struct {
+	FramesChecked int
+	NALCount      int
+
+	// Frames whose NAL lengths (plus length prefixes) do not sum exactly to the frame size, or which contain a NAL of
+	// length zero
+	BadFrames int
+}
+
+func (r NALVerificationReport) String() string {
+	return fmt.Sprintf("%d frames checked, %d NALs, %d bad frames", r.FramesChecked, r.NALCount, r.BadFrames)
+}
+
+// Checks that every video frame of the partition consists of non-empty length-prefixed NALs that exactly fill
+// frame.Size. Problem frames are logged; this is non-fatal so the whole partition can be audited before any output is
+// written. Fails only if the .ubv cannot be opened.
+func VerifyPartitionNALs(ubvFilename string, partition *ubv.UbvPartition, videoTrackNum int) (NALVerificationReport, error) {
+	var report NALVerificationReport
+
+	ubvFile, err := os.OpenFile(ubvFilename, os.O_RDONLY, 0)
+	if err != nil {
+		return report, fmt.Errorf("could not open %s: %w", ubvFilename, err)
+	}
+
+	defer ubvFile.Close()
+
+	var buffer []byte
+
+	for i, frame := range partition.Frames {
+		if frame.TrackNumber != videoTrackNum {
+			continue
+		}
+
+		report.FramesChecked++
+
+		if cap(buffer) < frame.Size {
+			buffer = make([]byte, frame.Size)
+		}
+		data := buffer[0:frame.Size]
+
+		if _, err := ubvFile.Seek(int64(frame.Offset), io.SeekStart); err != nil {
+			logging.Warn("Verify: partition ", partition.Index, " frame ", i, ": could not seek to ", frame.Offset, ": ", err)
+			report.BadFrames++
+			continue
+		}
+		if _, err := io.ReadFull(ubvFile, data); err != nil {
+			logging.Warn("Verify: partition ", partition.Index, " frame ", i, ": could not read ", frame.Size, " bytes at ", frame.Offset, ": ", err)
+			report.BadFrames++
+			continue
+		}
+
+		nals, err := splitNALs(data)
+		if err != nil {
+			logging.Warn("Verify: partition ", partition.Index, " frame ", i, " at offset ", frame.Offset, ": ", err)
+			report.BadFrames++
+			continue
+		}
+
+		report.NALCount += len(nals)
+	}
+
+	return report, nil
+}
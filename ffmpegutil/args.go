@@ -0,0 +1,64 @@
+package ffmpegutil
+
+import (
+	"errors"
+	"strings"
+)
+
+// Splits a command line fragment into arguments as a shell would: arguments are separated by whitespace, single quotes
+// preserve everything up to the closing quote, and within double quotes (or outside quotes) a backslash escapes the
+// next character. Nothing else (variables, globs) is expanded.
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("trailing backslash in arguments")
+	} else if quote != 0 {
+		return nil, errors.New("unterminated quote in arguments")
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
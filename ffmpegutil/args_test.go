@@ -0,0 +1,44 @@
+package ffmpegutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"-tag:v hvc1", []string{"-tag:v", "hvc1"}},
+		{"  -an\t-sn\n", []string{"-an", "-sn"}},
+		{`-metadata 'title=My Camera'`, []string{"-metadata", "title=My Camera"}},
+		{`-metadata "title=My Camera"`, []string{"-metadata", "title=My Camera"}},
+		{`-vf "drawtext=text='hello'"`, []string{"-vf", "drawtext=text='hello'"}},
+		{`'a "b" c'`, []string{`a "b" c`}},
+		{`a\ b`, []string{"a b"}},
+		{`"a \"b\""`, []string{`a "b"`}},
+		{`'a\b'`, []string{`a\b`}},
+		{`''`, []string{""}},
+		{`x""y`, []string{"xy"}},
+	}
+
+	for _, test := range tests {
+		args, err := SplitArgs(test.s)
+		if err != nil {
+			t.Errorf("Splitting %q failed: %v", test.s, err)
+		} else if !reflect.DeepEqual(args, test.want) {
+			t.Errorf("Split of %q is incorrect, got: %q, want: %q.", test.s, args, test.want)
+		}
+	}
+}
+
+func TestSplitArgsRejectsMalformedInput(t *testing.T) {
+	for _, s := range []string{`'unterminated`, `"unterminated`, `trailing\`} {
+		if args, err := SplitArgs(s); err == nil {
+			t.Errorf("Expected splitting %q to fail, got: %q", s, args)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ffmpegutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A chapter marker in a concatenated output
+type Chapter struct {
+	// Offset of the chapter from the start of the output
+	Start time.Duration
+	End   time.Duration
+
+	Title string
+}
+
+// Concatenates already-muxed segments (which must share codecs) into outputFile using the FFmpeg concat demuxer,
+// without re-encoding. If chapters is non-empty, they are written to the output as chapter markers. start is the start
+// time of the first segment, for the output metadata.
+func Concatenate(ctx context.Context, segments []string, chapters []Chapter, start time.Time, outputFile string, opts MuxOptions) error {
+	listFile, err := writeConcatList(segments)
+	if err != nil {
+		return fmt.Errorf("could not write FFmpeg concat list: %w", err)
+	}
+	defer os.Remove(listFile)
+
+	args := []string{"-f", "concat", "-safe", "0", "-i", listFile}
+
+	if len(chapters) > 0 {
+		metadataFile, err := writeChapterMetadata(chapters)
+		if err != nil {
+			return fmt.Errorf("could not write FFmpeg chapter metadata: %w", err)
+		}
+		defer os.Remove(metadataFile)
+
+		args = append(args, "-i", metadataFile, "-map", "0", "-map_metadata", "1", "-map_chapters", "1")
+	}
+
+	args = append(args, "-c", "copy", "-y", "-loglevel", opts.logLevel())
+	args = append(args, opts.metadataArgs(start)...)
+	args = append(args, opts.outputArgs()...)
+
+	return runFFmpeg(ctx, opts, args, outputFile)
+}
+
+// Writes a concat demuxer script listing segments, returning its filename
+func writeConcatList(segments []string) (string, error) {
+	f, err := ioutil.TempFile("", "ubvremux-concat-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, segment := range segments {
+		absolute, err := filepath.Abs(segment)
+		if err == nil {
+			// Paths are single-quoted; a literal ' is written as '\''
+			_, err = fmt.Fprintf(f, "file '%s'\n", strings.ReplaceAll(absolute, "'", `'\''`))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// Writes an FFMETADATA file describing chapters, returning its filename
+func writeChapterMetadata(chapters []Chapter) (string, error) {
+	f, err := ioutil.TempFile("", "ubvremux-chapters-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	escaper := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+
+	fmt.Fprintln(f, ";FFMETADATA1")
+	for _, chapter := range chapters {
+		fmt.Fprintln(f, "[CHAPTER]")
+		fmt.Fprintln(f, "TIMEBASE=1/1000")
+		fmt.Fprintf(f, "START=%d\n", chapter.Start.Milliseconds())
+		fmt.Fprintf(f, "END=%d\n", chapter.End.Milliseconds())
+		fmt.Fprintln(f, "title="+escaper.Replace(chapter.Title))
+	}
+
+	return f.Name(), nil
+}
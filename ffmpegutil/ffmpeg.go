@@ -1,95 +1,579 @@
 package ffmpegutil
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+	"ubvremux/logging"
+	"ubvremux/metrics"
 	"ubvremux/ubv"
 )
 
-func MuxVideoOnly(partition *ubv.UbvPartition, h264File string, videoTrackNum int, mp4File string) {
+const (
+	ContainerMP4 = "mp4"
+	ContainerMKV = "mkv"
+)
+
+// Containers for audio-only output
+const (
+	AudioContainerM4A = "m4a"
+	AudioContainerAAC = "aac"
+	AudioContainerMP4 = "mp4"
+)
+
+// Optional behaviour for the FFmpeg mux operations
+type MuxOptions struct {
+	// If non-empty, the video dimensions (WxH) to tell FFmpeg, for streams where it cannot determine them itself
+	VideoSize string
+
+	// The output container (see the Container constants); empty means MP4
+	Container string
+
+	// The output container when there is no video (see the AudioContainer constants); empty means M4A
+	AudioContainer string
+
+	// MP4 layout: FastStart moves the index to the start of the file, Fragmented writes a fragmented MP4 (fMP4).
+	// Both let playback begin before the whole file has been downloaded; ignored for other containers
+	FastStart  bool
+	Fragmented bool
+
+	// If non-nil, the wall-clock time is drawn onto the video, which means re-encoding it rather than copying it
+	BurnTimestamp *TimestampOverlay
+
+	// If true, the audio is re-timed to the Rate of its track (e.g. after -force-audio-rate) rather than the sample rate
+	// declared in the stream, which means re-encoding it
+	ResampleAudio bool
+
+	// If non-zero, the audio is re-encoded with this many channels (e.g. 1 to downmix stereo to mono), unless its track
+	// is already known to have that many
+	AudioChannels int
+
+	// Unless NoMetadata, the output records its start time as creation_time metadata, plus Title if non-empty
+	NoMetadata bool
+	Title      string
+
+	// The format of the timecode written to outputs with video (see the ubv.TimecodeFormat constants); empty means the
+	// default
+	TimecodeFormat string
+
+	// If non-empty, a subtitle file (e.g. .srt or .vtt) to embed as a subtitle track alongside the video
+	Subtitles string
+
+	// The FFmpeg -loglevel of every mux (e.g. quiet, error, info or debug); empty means DefaultLogLevel
+	LogLevel string
+
+	// Extra FFmpeg arguments placed just before the output filename of every mux. N.B. these are not validated, and can
+	// easily break the mux
+	ExtraArgs []string
+
+	// If non-empty, the FFmpeg input format of the video/audio input (needed when reading from a pipe)
+	VideoInputFormat string
+	AudioInputFormat string
+
+	// If non-nil, called with the full command line (binary first) of each FFmpeg invocation before it is run
+	OnCommand func(args []string)
+
+	// If non-nil, called to configure the FFmpeg command before it is run (e.g. to attach pipes)
+	configureCmd func(cmd *exec.Cmd)
+}
+
+// Positions for a TimestampOverlay
+const (
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+)
+
+// How to draw the wall-clock time onto the video
+type TimestampOverlay struct {
+	// Font size in pixels; 0 means 24
+	FontSize int
+
+	// Which corner to draw in (see the Position constants); empty means top-left
+	Position string
+
+	// If non-empty, the font file to use; otherwise FFmpeg must be able to find a default font (via fontconfig)
+	FontFile string
+}
+
+// The drawtext filter rendering the local time of each frame, for a video starting at start
+func (overlay TimestampOverlay) filter(start time.Time) string {
+	fontSize := overlay.FontSize
+	if fontSize <= 0 {
+		fontSize = 24
+	}
+
+	var position string
+	switch overlay.Position {
+	case PositionTopRight:
+		position = "x=w-tw-10:y=10"
+	case PositionBottomLeft:
+		position = "x=10:y=h-th-10"
+	case PositionBottomRight:
+		position = "x=w-tw-10:y=h-th-10"
+	default:
+		position = "x=10:y=10"
+	}
+
+	filter := fmt.Sprintf("drawtext=text='%%{pts\\:localtime\\:%d.%03d}':fontsize=%d:fontcolor=white:box=1:boxcolor=black@0.5:%s",
+		start.Unix(), start.Nanosecond()/1000000, fontSize, position)
+	if len(overlay.FontFile) > 0 {
+		filter += ":fontfile='" + strings.ReplaceAll(overlay.FontFile, "'", `'\''`) + "'"
+	}
+
+	return filter
+}
+
+// Input options to place before the video input when re-encoding it: the raw bitstream has no timestamps, so the
+// frames must be timed at the real rate for the overlay to advance correctly
+func (opts MuxOptions) burnInputArgs(rate int) []string {
+	if opts.BurnTimestamp == nil {
+		return nil
+	}
+
+	return []string{"-framerate", strconv.Itoa(rate)}
+}
+
+// Output options (after -c copy) to re-encode the video with the timestamp overlay, if requested
+func (opts MuxOptions) burnOutputArgs(start time.Time) []string {
+	if opts.BurnTimestamp == nil {
+		return nil
+	}
+
+	return []string{"-vf", opts.BurnTimestamp.filter(start), "-c:v", "libx264"}
+}
+
+// Output options (after the audio -c copy) to re-encode the audio, if it is to be re-timed to its track rate or given
+// a different number of channels
+func (opts MuxOptions) audioEncodeArgs(audioTrack *ubv.UbvTrack) []string {
+	if audioTrack == nil {
+		return nil
+	}
+
+	var args []string
+	if opts.ResampleAudio && audioTrack.Rate > 0 {
+		args = append(args, "-af", "asetrate="+strconv.Itoa(audioTrack.Rate))
+	}
+	if opts.AudioChannels > 0 && opts.AudioChannels != audioTrack.Channels {
+		args = append(args, "-ac", strconv.Itoa(opts.AudioChannels))
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return append(args, "-c:a", "aac")
+}
+
+// Writes frame number frameIndex (counting from 0, which must be a keyframe) of a raw H.264 or H.265 bitstream to
+// jpgFile as a JPEG
+func ExtractFrame(ctx context.Context, videoFile string, frameIndex int, jpgFile string, opts MuxOptions) error {
+	var args []string
+	args = append(args, opts.videoInputArgs()...)
+	args = append(args, "-i", videoFile)
+	if frameIndex > 0 {
+		args = append(args, "-vf", "select=eq(n\\,"+strconv.Itoa(frameIndex)+")")
+	}
+	args = append(args, "-frames:v", "1", "-q:v", "2", "-update", "1", "-y", "-loglevel", opts.logLevel())
+
+	// The extra arguments are meant for the video/audio mux, so may not suit an image
+	opts.ExtraArgs = nil
+
+	return runFFmpeg(ctx, opts, args, jpgFile)
+}
+
+// The -timecode value for a video track in TimecodeFormat (drop-frame timecode counts the rate as its NTSC
+// equivalent, e.g. 30 as 29.97), falling back to the default format if the track's rate does not support it
+func (opts MuxOptions) timecode(videoTrack *ubv.UbvTrack) string {
+	rate := float64(videoTrack.Rate)
+	if opts.TimecodeFormat == ubv.TimecodeFormatDropFrame {
+		rate = ubv.NTSCRate(videoTrack.Rate)
+	}
+
+	timecode, err := ubv.FormatTimecode(videoTrack.StartTimecode, rate, opts.TimecodeFormat)
+	if err != nil {
+		logging.Warn("Warning: ", err, ", using the default timecode format")
+		return ubv.GenerateTimecode(videoTrack.StartTimecode, float64(videoTrack.Rate))
+	}
+
+	return timecode
+}
+
+// Output options recording the start of the output (and its title) as metadata, unless NoMetadata
+func (opts MuxOptions) metadataArgs(start time.Time) []string {
+	if opts.NoMetadata {
+		return nil
+	}
+
+	// ISO 8601 in UTC, as FFmpeg itself writes creation_time
+	args := []string{"-metadata", "creation_time=" + start.UTC().Format("2006-01-02T15:04:05.000000Z")}
+	if len(opts.Title) > 0 {
+		args = append(args, "-metadata", "title="+opts.Title)
+	}
+
+	return args
+}
+
+// Output options to place before the output filename
+func (opts MuxOptions) outputArgs() []string {
+	if opts.Container == ContainerMKV {
+		return []string{"-f", "matroska"}
+	}
+
+	return opts.movflagsArgs()
+}
+
+// The -movflags for the requested MP4 layout, if any
+func (opts MuxOptions) movflagsArgs() []string {
+	if opts.Fragmented {
+		return []string{"-movflags", "+frag_keyframe+empty_moov+default_base_moof"}
+	} else if opts.FastStart {
+		return []string{"-movflags", "+faststart"}
+	}
+
+	return nil
+}
+
+// Output options to place before the output filename of an audio-only mux
+func (opts MuxOptions) audioOutputArgs() []string {
+	switch opts.AudioContainer {
+	case AudioContainerAAC:
+		return []string{"-f", "adts"}
+	case AudioContainerMP4:
+		return append([]string{"-f", "mp4"}, opts.movflagsArgs()...)
+	default:
+		return append([]string{"-f", "ipod"}, opts.movflagsArgs()...)
+	}
+}
+
+// The extension (without leading .) of the muxed output, which depends on whether it will contain video
+func (opts MuxOptions) Extension(hasVideo bool) string {
+	if !hasVideo {
+		if len(opts.AudioContainer) > 0 {
+			return opts.AudioContainer
+		}
+		return AudioContainerM4A
+	} else if len(opts.Container) > 0 {
+		return opts.Container
+	}
+
+	return ContainerMP4
+}
+
+// Input options to place before the video input
+func (opts MuxOptions) videoInputArgs() []string {
+	var args []string
+	if len(opts.VideoInputFormat) > 0 {
+		args = append(args, "-f", opts.VideoInputFormat)
+	}
+	if len(opts.VideoSize) > 0 {
+		args = append(args, "-video_size", opts.VideoSize)
+	}
+
+	return args
+}
+
+// Input options to place before the audio input
+func (opts MuxOptions) audioInputArgs() []string {
+	if len(opts.AudioInputFormat) > 0 {
+		return []string{"-f", opts.AudioInputFormat}
+	}
+
+	return nil
+}
+
+// The FFmpeg input format for a raw audio bitstream demuxed from the track
+func audioInputFormat(audioTrack *ubv.UbvTrack) string {
+	if audioTrack != nil && audioTrack.Codec == ubv.CodecOpus {
+		return "ogg"
+	}
+
+	return "aac"
+}
+
+// Input options to add the subtitle file (if any) as an extra input
+func (opts MuxOptions) subtitleInputArgs() []string {
+	if len(opts.Subtitles) > 0 {
+		return []string{"-i", opts.Subtitles}
+	}
+
+	return nil
+}
+
+// Output options to map the subtitle input (if any), which is input number inputIndex. MP4 cannot hold text subtitles
+// as-is, so they are converted to mov_text
+func (opts MuxOptions) subtitleOutputArgs(inputIndex int) []string {
+	if len(opts.Subtitles) == 0 {
+		return nil
+	}
+
+	codec := "mov_text"
+	if opts.Container == ContainerMKV {
+		codec = "copy"
+	}
+
+	return []string{"-map", strconv.Itoa(inputIndex) + ":s", "-c:s", codec}
+}
+
+// The -loglevel FFmpeg is run with unless MuxOptions.LogLevel says otherwise
+const DefaultLogLevel = "warning"
+
+// The FFmpeg log levels accepted for MuxOptions.LogLevel
+var LogLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+func (opts MuxOptions) logLevel() string {
+	if len(opts.LogLevel) == 0 {
+		return DefaultLogLevel
+	}
+
+	return opts.LogLevel
+}
+
+// Builds an invocation of the FFmpeg binary at path, which is killed if ctx is cancelled
+func (opts MuxOptions) command(ctx context.Context, path string, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path, args...)
+
+	if opts.configureCmd != nil {
+		opts.configureCmd(cmd)
+	}
+
+	return cmd
+}
+
+// Muxes a raw H.264 or H.265 bitstream into mp4File. FFmpeg picks the bitstream format from the .h264/.h265 extension
+func MuxVideoOnly(ctx context.Context, partition *ubv.UbvPartition, videoFile string, videoTrackNum int, mp4File string, opts MuxOptions) error {
 	videoTrack := partition.Tracks[videoTrackNum]
 
 	if videoTrack.FrameCount <= 0 {
-		log.Println("Video stream contained zero frames! Skipping this output file: ", mp4File)
-		return
+		logging.Warn("Video stream contained zero frames! Skipping this output file: ", mp4File)
+		return nil
 	}
 
 	if videoTrack.Rate <= 0 {
-		log.Println("Invalid guessed Video framerate of ", videoTrack.Rate, " for ", mp4File, ". Setting to 1")
+		logging.Warn("Invalid guessed Video framerate of ", videoTrack.Rate, " for ", mp4File, ". Setting to 1")
 		videoTrack.Rate = 1
 	}
 
-	cmd := exec.Command(getFfmpegCommand(),
-		"-i", h264File,
+	var args []string
+	args = append(args, opts.videoInputArgs()...)
+	args = append(args, opts.burnInputArgs(videoTrack.Rate)...)
+	args = append(args, "-i", videoFile)
+	args = append(args, opts.subtitleInputArgs()...)
+	if len(opts.Subtitles) > 0 {
+		args = append(args, "-map", "0:v")
+	}
+	args = append(args,
 		"-c", "copy",
 		"-r", strconv.Itoa(videoTrack.Rate),
-		"-timecode", ubv.GenerateTimecode(videoTrack.StartTimecode, videoTrack.Rate),
+		"-timecode", opts.timecode(videoTrack),
 		"-y",
-		"-loglevel", "warning",
-		mp4File)
-
-	runFFmpeg(cmd)
+		"-loglevel", opts.logLevel())
+	args = append(args, opts.burnOutputArgs(videoTrack.StartTimecode)...)
+	args = append(args, opts.metadataArgs(videoTrack.StartTimecode)...)
+	args = append(args, opts.subtitleOutputArgs(1)...)
+	args = append(args, opts.outputArgs()...)
+	return runFFmpeg(ctx, opts, args, mp4File)
 }
 
-func MuxAudioOnly(partition *ubv.UbvPartition, aacFile string, mp4File string) {
-	cmd := exec.Command(getFfmpegCommand(), "-i", aacFile, "-c", "copy", "-y", "-loglevel", "warning", mp4File)
-
-	runFFmpeg(cmd)
+func MuxAudioOnly(ctx context.Context, partition *ubv.UbvPartition, aacFile string, audioTrackNum int, mp4File string, opts MuxOptions) error {
+	var args []string
+	args = append(args, opts.audioInputArgs()...)
+	args = append(args, "-i", aacFile, "-vn", "-c:a", "copy", "-y", "-loglevel", opts.logLevel())
+	if audioTrack, ok := partition.Tracks[audioTrackNum]; ok {
+		// There is no video to carry a timecode, so the creation time is the only record of when the audio starts
+		args = append(args, opts.metadataArgs(audioTrack.StartTimecode)...)
+	}
+	args = append(args, opts.audioEncodeArgs(partition.Tracks[audioTrackNum])...)
+	args = append(args, opts.audioOutputArgs()...)
+	return runFFmpeg(ctx, opts, args, mp4File)
 }
 
-func MuxAudioAndVideo(partition *ubv.UbvPartition, h264File string, videoTrackNum int, aacFile string, mp4File string) {
+func MuxAudioAndVideo(ctx context.Context, partition *ubv.UbvPartition, videoFile string, videoTrackNum int, aacFile string, audioTrackNum int, mp4File string, opts MuxOptions) error {
 	// If there is no audio file, fall back to the video-only mux operation
 	if len(aacFile) <= 0 {
-		MuxVideoOnly(partition, h264File, videoTrackNum, mp4File)
-		return
-	} else if len(h264File) <= 0 {
-		MuxAudioOnly(partition, aacFile, mp4File)
+		return MuxVideoOnly(ctx, partition, videoFile, videoTrackNum, mp4File, opts)
+	} else if len(videoFile) <= 0 {
+		// Likewise if there is no video (e.g. an audio-only recording), which must not go on to look up the video track
+		return MuxAudioOnly(ctx, partition, aacFile, audioTrackNum, mp4File, opts)
 	}
 
 	videoTrack := partition.Tracks[videoTrackNum]
-	audioTrack := partition.Tracks[ubv.TrackAudio]
+	audioTrack := partition.Tracks[audioTrackNum]
 
 	if videoTrack.FrameCount <= 0 || audioTrack.FrameCount <= 0 {
-		log.Println("Audio/Video stream contained zero frames! Skipping this output file: ", mp4File)
-		return
+		logging.Warn("Audio/Video stream contained zero frames! Skipping this output file: ", mp4File)
+		return nil
 	}
 
-	audioDelaySec := float64(videoTrack.StartTimecode.UnixNano()-audioTrack.StartTimecode.UnixNano()) / 1000000000.0
+	videoOffsetArgs, audioOffsetArgs := syncOffsetArgs(videoTrack, audioTrack)
 
 	if videoTrack.Rate <= 0 {
-		log.Println("Invalid guessed Video framerate of ", videoTrack.Rate, " for ", mp4File, ". Setting to 1")
+		logging.Warn("Invalid guessed Video framerate of ", videoTrack.Rate, " for ", mp4File, ". Setting to 1")
 		videoTrack.Rate = 1
 	}
 
-	cmd := exec.Command(getFfmpegCommand(),
-		"-i", h264File,
-		"-itsoffset", strconv.FormatFloat(audioDelaySec, 'f', -1, 32),
-		"-i", aacFile,
+	var args []string
+	args = append(args, opts.videoInputArgs()...)
+	args = append(args, opts.burnInputArgs(videoTrack.Rate)...)
+	args = append(args, videoOffsetArgs...)
+	args = append(args, "-i", videoFile)
+	args = append(args, audioOffsetArgs...)
+	args = append(args, opts.audioInputArgs()...)
+	args = append(args, "-i", aacFile)
+	args = append(args, opts.subtitleInputArgs()...)
+	args = append(args,
 		"-map", "0:v",
 		"-map", "1:a",
 		"-c", "copy",
 		"-r", strconv.Itoa(videoTrack.Rate),
-		"-timecode", ubv.GenerateTimecode(videoTrack.StartTimecode, videoTrack.Rate),
+		"-timecode", opts.timecode(videoTrack),
 		"-y",
-		"-loglevel", "warning",
-		mp4File)
+		"-loglevel", opts.logLevel())
+	args = append(args, opts.burnOutputArgs(videoTrack.StartTimecode)...)
+	args = append(args, opts.audioEncodeArgs(audioTrack)...)
+	args = append(args, opts.metadataArgs(videoTrack.StartTimecode)...)
+	args = append(args, opts.subtitleOutputArgs(2)...)
+	args = append(args, opts.outputArgs()...)
+	return runFFmpeg(ctx, opts, args, mp4File)
+}
 
-	runFFmpeg(cmd)
+// The -itsoffset input options (for the video input and the audio input respectively) that line the audio up with the
+// video. Whichever stream starts later is delayed by the difference between the start timecodes (computed as a
+// time.Duration, as float seconds since the epoch cannot represent the difference precisely)
+func syncOffsetArgs(videoTrack *ubv.UbvTrack, audioTrack *ubv.UbvTrack) ([]string, []string) {
+	offset := audioTrack.StartTimecode.Sub(videoTrack.StartTimecode)
+
+	if offset < 0 {
+		// Audio starts first
+		return []string{"-itsoffset", formatSeconds(-offset)}, nil
+	}
+
+	return nil, []string{"-itsoffset", formatSeconds(offset)}
 }
 
-func runFFmpeg(cmd *exec.Cmd) {
-	log.Println("Running: ", cmd.Args)
+// Formats a duration as decimal seconds, without losing precision
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// Runs FFmpeg with args plus an output file. FFmpeg writes to a temporary name alongside outputFile, which is only
+// renamed into place once FFmpeg succeeds, so an interrupted mux never leaves a complete-looking output behind. If
+// FFmpeg fails, the error includes the tail of its stderr.
+func runFFmpeg(ctx context.Context, opts MuxOptions, args []string, outputFile string) error {
+	path, err := FindFfmpeg()
+	if err != nil {
+		return err
+	}
+
+	tempFile := temporaryFilename(outputFile)
+	args = append(args, opts.ExtraArgs...)
+
+	stderr, err := execFFmpeg(ctx, opts, path, args, tempFile)
+
+	// N.B. piped inputs (see MuxFromPipes) have already been consumed, so cannot be retried
+	if err != nil && ctx.Err() == nil && opts.configureCmd == nil && needsLargerProbe(stderr) {
+		logging.Warn("FFmpeg could not determine the stream parameters; retrying with a larger probe (-probesize 100M -analyzeduration 100M)")
+
+		stderr, err = execFFmpeg(ctx, opts, path, append([]string{"-probesize", "100M", "-analyzeduration", "100M"}, args...), tempFile)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		// Killed because we were cancelled; the caller cleans up
+		logging.Info("FFmpeg cancelled: ", ctx.Err())
+		return ctx.Err()
+	} else if err != nil {
+		return ffmpegFailed(err, stderr)
+	} else if err := os.Rename(tempFile, outputFile); err != nil {
+		return fmt.Errorf("could not move FFmpeg output into place as %s: %w", outputFile, err)
+	}
+
+	return nil
+}
+
+// Runs the FFmpeg binary at path once, writing to tempFile (which is removed if FFmpeg fails), returning what it wrote to stderr. FFmpeg
+// only logs warnings and errors by default (see MuxOptions.LogLevel), so its stderr is also passed through unless the
+// log level is below warn.
+func execFFmpeg(ctx context.Context, opts MuxOptions, path string, args []string, tempFile string) (string, error) {
+	cmd := opts.command(ctx, path, append(args, tempFile))
+
+	logging.Debug("Running: ", cmd.Args)
+	if opts.OnCommand != nil {
+		opts.OnCommand(cmd.Args)
+	}
 
-	// Pass through stdout and stderr
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	stderr := captureStderr(cmd)
 
 	err := cmd.Run()
 	if err != nil {
-		log.Fatal("FFmpeg command failed! Error: ", err)
+		os.Remove(tempFile)
+	}
+
+	return stderr.String(), err
+}
+
+// Captures what cmd writes to stderr, also passing it through unless the log level is below warn
+func captureStderr(cmd *exec.Cmd) *bytes.Buffer {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if logging.Enabled(logging.LevelWarn) {
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 	}
+
+	return &stderr
+}
+
+// The error for an FFmpeg run that failed, including the tail of its stderr
+func ffmpegFailed(err error, stderr string) error {
+	ffmpegFailures.Inc()
+
+	if tail := lastLines(stderr, ffmpegErrorLines); len(tail) > 0 {
+		return fmt.Errorf("FFmpeg command failed! Error: %w. FFmpeg output:\n%s", err, tail)
+	}
+	return fmt.Errorf("FFmpeg command failed! Error: %w", err)
+}
+
+var ffmpegFailures = metrics.NewCounter("ubvremux_ffmpeg_failures_total", "FFmpeg invocations that failed (other than by being cancelled)")
+
+// How many lines of FFmpeg's stderr are included in the error when it fails
+const ffmpegErrorLines = 20
+
+// The last n lines of s (without trailing blank lines)
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// FFmpeg's complaints when it could not work out the codec parameters from the start of an input
+var probeFailures = []string{"Could not find codec parameters", "unspecified size", "dimensions not set"}
+
+// Whether FFmpeg failed in a way that a larger -probesize/-analyzeduration usually fixes
+func needsLargerProbe(stderr string) bool {
+	for _, failure := range probeFailures {
+		if strings.Contains(stderr, failure) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The name to write an output to before it is complete: N.B. the extension is kept so FFmpeg can infer the format
+func temporaryFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".tmp" + ext
 }
 
 const (
@@ -98,18 +582,47 @@ const (
 	FFMPEG_LOC_3 = "/root/ffmpeg-4.3.1-arm64-static/ffmpeg"
 )
 
-// Looks for ubnt_ubvinfo on the path and in the default Protect install location
-func getFfmpegCommand() string {
+// If set (see SetFfmpegCommand), the FFmpeg binary to use instead of searching for one
+var ffmpegOverride string
+
+// Use a specific FFmpeg binary rather than searching the default locations. Checks the binary actually runs.
+func SetFfmpegCommand(path string) error {
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("FFmpeg path %s is not an executable file: %w", path, err)
+	}
+
+	if err := exec.Command(path, "-version").Run(); err != nil {
+		return fmt.Errorf("FFmpeg path %s could not be run: %w", path, err)
+	}
+
+	ffmpegOverride = path
+
+	return nil
+}
+
+// Looks for FFmpeg on the path and in other default locations (unless SetFfmpegCommand has been used)
+func FindFfmpeg() (string, error) {
+	if len(ffmpegOverride) > 0 {
+		return ffmpegOverride, nil
+	}
+
 	paths := [...]string{FFMPEG_LOC_1, FFMPEG_LOC_2, FFMPEG_LOC_3}
 
 	for _, path := range paths {
 		if _, err := exec.LookPath(path); err == nil {
-			return path
+			return path, nil
 		}
 	}
 
-	log.Fatal("FFmpeg not on PATH, nor in any default search locations!")
+	return "", errors.New("FFmpeg not on PATH, nor in any default search locations")
+}
+
+// The version line reported by an FFmpeg binary (e.g. "ffmpeg version 4.3.1 Copyright ...")
+func Version(path string) (string, error) {
+	output, err := exec.Command(path, "-version").Output()
+	if err != nil {
+		return "", err
+	}
 
-	// Keep compiler happy (log.Fatal above exits)
-	return paths[0]
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]), nil
 }
@@ -0,0 +1,106 @@
+package ffmpegutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"ubvremux/ubv"
+)
+
+// Muxes a partition without intermediate files: writeVideo and writeAudio (either may be nil) are called concurrently
+// to write the raw bitstreams, which are piped into FFmpeg (video on stdin, audio on fd 3).
+func MuxFromPipes(ctx context.Context, partition *ubv.UbvPartition, videoTrackNum int, audioTrackNum int, writeVideo func(io.Writer), writeAudio func(io.Writer), mp4File string, opts MuxOptions) error {
+	var wg sync.WaitGroup
+	var readers []*os.File
+	var videoInput string
+	var audioInput string
+	var stdin *os.File
+	var extraFiles []*os.File
+
+	// Feeds one bitstream into a new pipe, returning the end FFmpeg should read from
+	startPipe := func(write func(io.Writer)) (*os.File, error) {
+		pipeReader, pipeWriter, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("could not create pipe to FFmpeg: %w", err)
+		}
+		readers = append(readers, pipeReader)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer pipeWriter.Close()
+
+			write(&discardOnError{w: pipeWriter})
+		}()
+
+		return pipeReader, nil
+	}
+
+	// Closes our read ends so that any writer still blocked finishes, and waits for the writers
+	stopPipes := func() {
+		for _, pipeReader := range readers {
+			pipeReader.Close()
+		}
+
+		wg.Wait()
+	}
+
+	if writeVideo != nil {
+		var err error
+		if stdin, err = startPipe(writeVideo); err != nil {
+			return err
+		}
+		videoInput = "pipe:0"
+
+		opts.VideoInputFormat = "h264"
+		if track, ok := partition.Tracks[videoTrackNum]; ok && track.Codec == ubv.CodecHEVC {
+			opts.VideoInputFormat = "hevc"
+		}
+	}
+
+	if writeAudio != nil {
+		// The first of ExtraFiles is fd 3 in the child
+		audioPipe, err := startPipe(writeAudio)
+		if err != nil {
+			stopPipes()
+			return err
+		}
+		extraFiles = append(extraFiles, audioPipe)
+		audioInput = "pipe:3"
+
+		opts.AudioInputFormat = audioInputFormat(partition.Tracks[audioTrackNum])
+	}
+
+	opts.configureCmd = func(cmd *exec.Cmd) {
+		if stdin != nil {
+			cmd.Stdin = stdin
+		}
+		cmd.ExtraFiles = extraFiles
+	}
+
+	err := MuxAudioAndVideo(ctx, partition, videoInput, videoTrackNum, audioInput, audioTrackNum, mp4File, opts)
+
+	// FFmpeg has exited (or was never started)
+	stopPipes()
+
+	return err
+}
+
+// Swallows write errors (e.g. FFmpeg exiting before reading all of its input) so the demuxer can run to completion
+type discardOnError struct {
+	w      io.Writer
+	failed bool
+}
+
+func (d *discardOnError) Write(p []byte) (int, error) {
+	if !d.failed {
+		if _, err := d.w.Write(p); err != nil {
+			d.failed = true
+		}
+	}
+
+	return len(p), nil
+}
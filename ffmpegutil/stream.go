@@ -0,0 +1,105 @@
+package ffmpegutil
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Remuxes a partition's demuxed video (and optionally audio) bitstreams into a fragmented MP4 written to out.
+// The bitstreams are fed to FFmpeg over pipes, so nothing touches disk. FFmpeg is killed if ctx is cancelled.
+// audio may be nil for a video-only stream. Of opts, only the FFmpeg log level and extra arguments apply.
+func StreamFragmentedMP4(ctx context.Context, opts MuxOptions, partition *ubv.UbvPartition, video io.Reader, videoTrackNum int, audio io.Reader, audioTrackNum int, out io.Writer) error {
+	path, err := FindFfmpeg()
+	if err != nil {
+		return err
+	}
+
+	videoTrack := partition.Tracks[videoTrackNum]
+
+	rate := videoTrack.Rate
+	if rate <= 0 {
+		rate = 1
+	}
+
+	inputFormat := "h264"
+	if videoTrack.Codec == ubv.CodecHEVC {
+		inputFormat = "hevc"
+	}
+
+	var videoOffsetArgs, audioOffsetArgs []string
+	if audio != nil {
+		videoOffsetArgs, audioOffsetArgs = syncOffsetArgs(videoTrack, partition.Tracks[audioTrackNum])
+	}
+
+	args := append(videoOffsetArgs,
+		"-f", inputFormat,
+		"-r", strconv.Itoa(rate),
+		"-i", "pipe:0",
+	)
+
+	var audioPipe *os.File
+	if audio != nil {
+		pipeReader, pipeWriter, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		audioPipe = pipeReader
+
+		// Closing the read end unblocks the copy if FFmpeg stopped reading early; the copy must have finished before
+		// returning, as the caller closes audio
+		done := make(chan struct{})
+		defer func() {
+			pipeReader.Close()
+			<-done
+		}()
+
+		go func() {
+			defer close(done)
+			defer pipeWriter.Close()
+			if _, err := io.Copy(pipeWriter, audio); err != nil {
+				logging.Error("Error streaming audio to FFmpeg: ", err)
+			}
+		}()
+
+		// The audio pipe is the first of ExtraFiles, so it is fd 3 in the child
+		args = append(args, audioOffsetArgs...)
+		args = append(args,
+			"-f", audioInputFormat(partition.Tracks[audioTrackNum]),
+			"-i", "pipe:3",
+			"-map", "0:v",
+			"-map", "1:a")
+	}
+
+	args = append(args,
+		"-c", "copy",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-loglevel", opts.logLevel(),
+		"-f", "mp4")
+	args = append(args, opts.ExtraArgs...)
+
+	cmd := opts.command(ctx, path, append(args, "pipe:1"))
+	cmd.Stdin = video
+	cmd.Stdout = out
+	stderr := captureStderr(cmd)
+	if audioPipe != nil {
+		cmd.ExtraFiles = []*os.File{audioPipe}
+	}
+
+	logging.Debug("Running: ", cmd.Args)
+	if opts.OnCommand != nil {
+		opts.OnCommand(cmd.Args)
+	}
+
+	if err := cmd.Run(); err != nil && ctx.Err() != nil {
+		// Killed because the client went away
+		return ctx.Err()
+	} else if err != nil {
+		return ffmpegFailed(err, stderr.String())
+	}
+
+	return nil
+}
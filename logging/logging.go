@@ -0,0 +1,68 @@
+// Package logging adds levels to the standard logger, so the chatty progress messages can be silenced
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+func (l Level) String() string {
+	if l >= LevelError && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Parses a level name: error, warn, info or debug
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q (expected error, warn, info or debug)", name)
+}
+
+// Messages above this level are discarded
+var level = LevelInfo
+
+func SetLevel(l Level) {
+	level = l
+}
+
+// Whether messages at l are currently logged
+func Enabled(l Level) bool {
+	return l <= level
+}
+
+// Each of the following logs its arguments in the manner of log.Println (or log.Printf for the f variants)
+
+func Error(v ...interface{})                 { output(LevelError, fmt.Sprintln(v...)) }
+func Errorf(format string, v ...interface{}) { output(LevelError, fmt.Sprintf(format, v...)) }
+func Warn(v ...interface{})                  { output(LevelWarn, fmt.Sprintln(v...)) }
+func Warnf(format string, v ...interface{})  { output(LevelWarn, fmt.Sprintf(format, v...)) }
+func Info(v ...interface{})                  { output(LevelInfo, fmt.Sprintln(v...)) }
+func Infof(format string, v ...interface{})  { output(LevelInfo, fmt.Sprintf(format, v...)) }
+func Debug(v ...interface{})                 { output(LevelDebug, fmt.Sprintln(v...)) }
+func Debugf(format string, v ...interface{}) { output(LevelDebug, fmt.Sprintf(format, v...)) }
+
+func output(l Level, message string) {
+	if Enabled(l) {
+		// Skip output and the exported function, so Lshortfile (if set) reports the caller
+		log.Output(3, message)
+	}
+}
@@ -0,0 +1,129 @@
+// Package metrics keeps process-wide counters and histograms, and serves them in the Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// A metric that can write itself in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// Every metric created, in creation order (which is the order they are served in)
+var (
+	registryLock sync.Mutex
+	registry     []metric
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	registry = append(registry, m)
+}
+
+// A count that only goes up
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// Creates a counter, which is served under name
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+}
+
+// Counts observations into cumulative buckets, as well as recording their sum
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Creates a histogram with the given bucket upper bounds (in increasing order), which is served under name
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64), h.name, h.count)
+}
+
+// Writes every metric in the Prometheus text format
+func Write(w io.Writer) {
+	registryLock.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Serves the metrics at /metrics on addr (e.g. ":9090"); does not return unless the server fails
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+
+	return http.ListenAndServe(addr, mux)
+}
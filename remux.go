@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"log"
 	"os"
-	"path"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"ubvremux/demux"
 	"ubvremux/ffmpegutil"
+	"ubvremux/logging"
+	"ubvremux/metrics"
+	"ubvremux/remux"
+	"ubvremux/server"
 	"ubvremux/ubv"
 )
 
@@ -18,15 +27,91 @@ var ReleaseVersion string
 // Set at build time (see Makefile) with git rev
 var GitCommit string
 
-// Parses and validates commandline options and passes them to RemuxCLI
+// Parses and validates commandline options and passes them to remux.Remux
 func main() {
 	includeAudioPtr := flag.Bool("with-audio", false, "If true, extract audio")
 	includeVideoPtr := flag.Bool("with-video", true, "If true, extract video")
 	forceRatePtr := flag.Int("force-rate", 0, "If non-zero, adds a -r argument to FFmpeg invocations")
+	probeFramesPtr := flag.Int("probe-frames", ubv.PROBE_FRAMES, "Number of frames at the start of each partition sampled to detect the video framerate")
+	maxFrameSizePtr := flag.Int("max-frame-size", ubv.MAX_FRAME_SIZE, "Partitions with a frame larger than this many bytes are skipped as corrupt, rather than risk exhausting memory (0 for no limit)")
+	maxPartitionFramesPtr := flag.Int("max-partition-frames", ubv.MAX_PARTITION_FRAMES, "Partitions with more than this many frames are skipped as corrupt, rather than risk exhausting memory (0 for no limit)")
+	forceAudioRatePtr := flag.Int("force-audio-rate", 0, "If non-zero, overrides the audio sample rate (e.g. 16000) and re-encodes the audio at that rate")
+	audioChannelsPtr := flag.Int("audio-channels", 0, "If set, the number of audio channels in the output (e.g. 1 to downmix stereo to mono); the audio is re-encoded if its channel count differs")
 	outputFolder := flag.String("output-folder", "./", "The path to output remuxed files to. \"SRC-FOLDER\" to put alongside .ubv files")
-	remuxPtr := flag.Bool("mp4", true, "If true, will create an MP4 as output")
-	versionPtr := flag.Bool("version", false, "Display version and quit")
-	videoTrackNumPtr := flag.Int("video-track", ubv.TrackVideo, "Video track number to extract (supported: 7, 1003)")
+	remuxPtr := flag.Bool("mp4", true, "If true, will create an MP4 (or other -container) as output")
+	keepIntermediatePtr := flag.Bool("keep-intermediate", false, "If true, keep the raw .h264/.h265/.aac bitstreams (in -output-folder) after muxing")
+	containerPtr := flag.String("container", ffmpegutil.ContainerMP4, "The output container to create: mp4 or mkv")
+	audioContainerPtr := flag.String("audio-container", ffmpegutil.AudioContainerM4A, "The output container to create when there is no video: m4a, aac or mp4")
+	fastStartPtr := flag.Bool("faststart", false, "If true, write MP4 output with the index at the start (-movflags +faststart) so playback can begin before it is fully downloaded")
+	fmp4Ptr := flag.Bool("fmp4", false, "If true, write fragmented MP4 output (frag_keyframe+empty_moov), for streaming")
+	versionPtr := flag.Bool("version", false, "Display version (and the FFmpeg and ubnt_ubvinfo in use) and quit")
+	videoTrackPtr := flag.String("video-track", strconv.Itoa(ubv.TrackVideo), "Video track number to extract (supported: 7, 1003 (HEVC), 1007), or one of: main, secondary, auto (highest resolution)")
+	allVideoTracksPtr := flag.Bool("all-video-tracks", false, "If true, extract every video track present (ignoring -video-track) into separate outputs named with the track, e.g. _main and _sub")
+	audioTrackPtr := flag.String("audio-track", strconv.Itoa(ubv.TrackAudio), "Audio track number to extract, or auto (or empty) for the first audio track")
+	bitstreamFormatPtr := flag.String("bitstream-format", demux.BitstreamAnnexB, "The format of the video bitstream written: annexb (with start codes, as FFmpeg expects) or avcc (the frames copied with their 4-byte length prefixes, which requires -mp4=false)")
+	shortStartCodesPtr := flag.Bool("short-start-codes", false, "If true, write 3-byte Annex-B start codes except before parameter sets and IDR NALs (4-byte), rather than 4-byte start codes throughout")
+	adtsPtr := flag.Bool("adts", false, "If true, wrap each frame of the raw .aac audio in an ADTS header, so it is playable standalone")
+	repairSPSPtr := flag.Bool("repair-sps", false, "If true, replaces the stream's SPS/PPS with ones synthesised from -resolution (for files with a damaged SPS)")
+	reuseParameterSetsPtr := flag.Bool("reuse-parameter-sets", false, "If true, partitions whose video does not start with an SPS/PPS have the most recent ones from an earlier partition of the file prepended")
+	metricsAddrPtr := flag.String("metrics-addr", "", "If set, the address (e.g. :9090) to serve Prometheus metrics on at /metrics while processing (files processed, partitions extracted, bytes written, FFmpeg failures and analysis duration)")
+	servePtr := flag.String("serve", "", "If set, the address (e.g. :8080) to serve the recordings under -dir on over HTTP, instead of remuxing files")
+	serveDirPtr := flag.String("dir", "./", "The folder of recordings to serve in -serve mode")
+	verifyNALPtr := flag.Bool("verify-nal", false, "If true, audits every video NAL length prefix of each partition and reports corrupt frames before extracting")
+	patternPtr := flag.String("pattern", "", "If set, only process .ubv files whose filename matches this glob (e.g. \"*_timelapse_*\"); useful with directory inputs")
+	watchPtr := flag.String("watch", "", "If set, a folder to watch: .ubv files that appear beneath it are remuxed once they stop changing, until interrupted (instead of processing the inputs given)")
+	watchSettlePtr := flag.Duration("watch-settle", 30*time.Second, "With -watch, how long a .ubv file must go unchanged before it is taken to be completely written")
+	sincePtr := flag.String("since", "", "If set, skip .ubv files whose filename says they were recorded before this: a duration before now (e.g. 36h or 7d) or an RFC3339 timestamp")
+	mirrorTreePtr := flag.String("mirror-tree", "", "If set, the input root directory: recreates the input directory structure (relative to this root) under -output-folder")
+	groupByCameraPtr := flag.Bool("group-by-camera", false, "If true, write each file's outputs to a subfolder of -output-folder named after the camera MAC (from the Protect filename)")
+	strictPtr := flag.Bool("strict", false, "If true, stop at the first file that fails analysis rather than skipping it")
+	jobsPtr := flag.Int("jobs", 1, "Number of partitions to extract (and files to analyse) concurrently (capped at the number of CPUs)")
+	analyseOnlyPtr := flag.Bool("analyse-only", false, "If true, analyse the input files and report on them without extracting anything")
+	probeRatePtr := flag.Bool("probe-rate", false, "If true, print the probed framerate of each video track of the input files (as tab-separated file, track and fps lines) and quit")
+	listTracksPtr := flag.Bool("list-tracks", false, "If true, list every track (number, type, frames, rate and start timecode) of each partition of the input files and quit")
+	inspectPtr := flag.Bool("inspect", false, "If true, report the sequence of NAL types in the demuxed video of each partition, flagging partitions that do not start with SPS+PPS+IDR, and quit")
+	stdoutPtr := flag.Bool("stdout", false, "If true, write the demuxed video of every partition of every input to stdout as one continuous Annex B bitstream (with parameter sets repeated where a partition lacks them), without muxing or writing any files")
+	selfTestPtr := flag.Bool("self-test", false, "If true, check that FFmpeg can mux a tiny generated H.264 sample through the full demux and mux path (with the given mux options), report the FFmpeg command used, and quit")
+	jsonPtr := flag.Bool("json", false, "With -analyse-only, print the analysis to stdout as JSON")
+	partitionPtr := flag.Int("partition", -1, "If set, only extract the partition with this index")
+	partitionRangePtr := flag.String("partition-range", "", "If set, only extract partitions with indexes in this inclusive range a:b")
+	startPtr := flag.String("start", "", "If set, only extract partitions ending after this RFC3339 timestamp")
+	endPtr := flag.String("end", "", "If set, only extract partitions starting before this RFC3339 timestamp")
+	trimPtr := flag.String("trim", "", "If set, only extract start:end (in seconds from the start of each partition, e.g. 30:90) of each partition, starting from the preceding keyframe")
+	pipePtr := flag.Bool("pipe", false, "If true, pipe the demuxed bitstreams straight into FFmpeg rather than writing intermediate .h264/.aac files")
+	resumePtr := flag.Bool("resume", false, "If true, checkpoint demux progress so that, if interrupted, running again with -resume carries on from the last checkpoint rather than starting each partition again")
+	nameTemplatePtr := flag.String("name-template", remux.DefaultNameTemplate, "Output filename template (without extension). Placeholders: {base} {mac} {channel} {type} {date} {time} {start} {partition}")
+	mergePtr := flag.Bool("merge", false, "If true, concatenate the partitions of each file into a single output (named after the first partition). Requires -mp4")
+	chaptersPtr := flag.Bool("chapters", false, "If true, -merge with a chapter marker at the start of each partition. Requires -mp4")
+	splitTracksPtr := flag.Bool("split-tracks", false, "If true, mux video and audio into separate files (.video.mp4 and .audio.m4a) rather than together")
+	thumbnailPtr := flag.Bool("thumbnail", false, "If true, also write a JPEG still of each partition's video (named like its output)")
+	thumbnailOffsetPtr := flag.Duration("thumbnail-offset", 0, "How far into each partition to take the -thumbnail from (e.g. 5s); by default the first keyframe")
+	subtitlesPtr := flag.String("subtitles", "", "If set to srt or vtt, write a sidecar subtitle file per partition showing the wall-clock time of each second")
+	embedSubtitlesPtr := flag.Bool("embed-subtitles", false, "If true, also embed the -subtitles timestamps as a subtitle track in the muxed output")
+	burnTimestampPtr := flag.Bool("burn-timestamp", false, "If true, draw the wall-clock time onto the video. N.B. this re-encodes the video (with libx264), which is much slower than the default copy")
+	burnTimestampSizePtr := flag.Int("burn-timestamp-size", 24, "Font size (in pixels) of the -burn-timestamp overlay")
+	burnTimestampPositionPtr := flag.String("burn-timestamp-position", ffmpegutil.PositionTopLeft, "Corner to draw the -burn-timestamp overlay in: top-left, top-right, bottom-left or bottom-right")
+	burnTimestampFontPtr := flag.String("burn-timestamp-font", "", "Font file for the -burn-timestamp overlay (by default FFmpeg looks one up with fontconfig)")
+	dryRunPtr := flag.Bool("dry-run", false, "If true, analyse and print the files that would be created without writing anything")
+	httpUserPtr := flag.String("http-user", "", "If set, the user:password for HTTP basic auth when downloading http(s):// inputs")
+	httpTokenPtr := flag.String("http-token", os.Getenv("UBVREMUX_HTTP_TOKEN"), "If set, the bearer token to send when downloading http(s):// inputs (defaults to $UBVREMUX_HTTP_TOKEN)")
+	ubvInfoPathPtr := flag.String("ubvinfo-path", os.Getenv("UBNT_UBVINFO"), "If set, the ubnt_ubvinfo binary to use (defaults to $UBNT_UBVINFO, otherwise searches PATH and the Protect install location)")
+	timecodeSourcePtr := flag.String("timecode-source", remux.TimecodeSourceFrame, "The source of each file's start timecode: frame (the wall-clock time of the first frame) or filename (the record start time in the Protect filename, for cameras whose clock was wrong; frames keep their timing relative to it)")
+	timecodeFormatPtr := flag.String("timecode-format", ubv.TimecodeFormatDefault, "The timecode format: default (HH:MM:SS.FF), ndf (non-drop-frame HH:MM:SS:FF) or df (drop-frame HH:MM:SS;FF, counting 30/60 fps as 29.97/59.94)")
+	noMetadataPtr := flag.Bool("no-metadata", false, "If true, do not set creation_time (the recording start) and title (the camera MAC and channel) metadata on the output")
+	ffmpegLogLevelPtr := flag.String("ffmpeg-loglevel", ffmpegutil.DefaultLogLevel, "The FFmpeg -loglevel for every mux: quiet, panic, fatal, error, warning, info, verbose, debug or trace")
+	ffmpegExtraPtr := flag.String("ffmpeg-extra", "", "Extra FFmpeg arguments (shell-style quoting) to add before the output filename of every mux, e.g. \"-tag:v hvc1\" for HEVC playback on Apple devices. N.B. an unvalidated escape hatch")
+	ffmpegPathPtr := flag.String("ffmpeg-path", os.Getenv("FFMPEG"), "If set, the FFmpeg binary to use (defaults to $FFMPEG, otherwise searches PATH and other default locations)")
+	analysisFilePtr := flag.String("analysis-file", "", "If set, the pre-generated ubnt_ubvinfo output to use for the (single) input file, instead of looking for <file>.ubv.txt alongside it")
+	saveAnalysisPtr := flag.Bool("save-analysis", false, "If true, saves the ubnt_ubvinfo output alongside each .ubv (as .ubv.txt) so later runs can skip re-analysing it")
+	noClobberPtr := flag.Bool("no-clobber", false, "If true, skip partitions whose output files already exist (and are non-empty)")
+	reportPtr := flag.String("report", "", "If set, writes a batch report of per-partition outcomes to this path (JSON if it ends .json, otherwise CSV)")
+	logLevelPtr := flag.String("log-level", logging.LevelInfo.String(), "Logging verbosity: error, warn, info or debug (which adds per-partition detail)")
+	quietPtr := flag.Bool("quiet", false, "If true, print nothing unless something goes wrong (the same as -log-level error)")
+	preserveMtimePtr := flag.Bool("preserve-mtime", false, "If true, set the modification time of each output to the start of its recording")
+	checksumPtr := flag.String("checksum", "", "If set to sha256, write a SHA-256 checksum of each output alongside it (as <output>.sha256) and include it in the -manifest")
+	manifestPtr := flag.String("manifest", "", "If set, writes a manifest of every file produced (with its source, partition, start, duration, tracks and size) to this path (JSON if it ends .json, otherwise CSV)")
+	progressPtr := flag.Bool("progress", false, "If true, periodically log how far through demuxing each partition is")
+	resolutionPtr := flag.String("resolution", "", "If set, the video resolution as WxH (e.g. 1920x1080) to pass to FFmpeg. Required by -repair-sps")
 
 	flag.Parse()
 
@@ -44,11 +129,84 @@ func main() {
 			println("\tGit commit: ", GitCommit)
 		}
 
+		// Report the external tools too, since they are the first thing to check when something fails
+		println("")
+		printDependency("FFmpeg:      ", *ffmpegPathPtr, ffmpegutil.SetFfmpegCommand, ffmpegutil.FindFfmpeg, ffmpegutil.Version)
+		printDependency("ubnt_ubvinfo:", *ubvInfoPathPtr, ubv.SetUbvInfoCommand, ubv.FindUbvInfo, ubv.UbvInfoVersion)
+
 		os.Exit(0)
-	} else if len(flag.Args()) == 0 {
-		// Terminate immediately if no .ubv files were provided
+	} else if len(flag.Args()) == 0 && !*selfTestPtr && len(*watchPtr) == 0 && len(*servePtr) == 0 {
+		// Terminate immediately if no .ubv files were provided (server mode takes none, it remuxes on request instead)
 		println("Expected at least one .ubv file as input!\n")
 
+		flag.Usage()
+		os.Exit(1)
+	} else if countArgs(flag.Args(), remux.StdinFile) > 1 {
+		println("stdin (" + remux.StdinFile + ") can only be read once!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if countArgs(flag.Args(), remux.StdinFile) > 0 && strings.TrimSuffix(*outputFolder, "/") == "SRC-FOLDER" {
+		// The source folder of stdin is a temporary folder that is deleted afterwards
+		println("Reading from stdin (" + remux.StdinFile + ") cannot be combined with -output-folder SRC-FOLDER!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if hasURLArgs(flag.Args()) && strings.TrimSuffix(*outputFolder, "/") == "SRC-FOLDER" {
+		// As for stdin, a download is written to a temporary folder that is deleted afterwards
+		println("Downloading http(s):// inputs cannot be combined with -output-folder SRC-FOLDER!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if len(*mirrorTreePtr) > 0 && strings.TrimSuffix(*outputFolder, "/") == "SRC-FOLDER" {
+		// Mirroring the tree only makes sense with a separate output root
+		println("-mirror-tree cannot be combined with -output-folder SRC-FOLDER!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *pipePtr && !*remuxPtr {
+		println("-pipe requires -mp4 (there are no intermediate files to keep)!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *pipePtr && *keepIntermediatePtr {
+		println("-keep-intermediate cannot be combined with -pipe (there are no intermediate files to keep)!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *pipePtr && *resumePtr {
+		println("-resume cannot be combined with -pipe (there are no intermediate files to resume)!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *fastStartPtr && *fmp4Ptr {
+		println("-faststart and -fmp4 cannot be combined!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if (*mergePtr || *chaptersPtr) && !*remuxPtr {
+		println("-merge and -chapters require -mp4!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *embedSubtitlesPtr && (len(*subtitlesPtr) == 0 || !*remuxPtr) {
+		println("-embed-subtitles requires -subtitles and -mp4!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *splitTracksPtr && (!*remuxPtr || *pipePtr || *mergePtr || *chaptersPtr) {
+		println("-split-tracks requires -mp4, and cannot be combined with -pipe, -merge or -chapters!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *burnTimestampPtr && !*remuxPtr {
+		println("-burn-timestamp requires -mp4!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	} else if *jsonPtr && !*analyseOnlyPtr {
+		println("-json requires -analyse-only!\n")
+
 		flag.Usage()
 		os.Exit(1)
 	} else if !*includeAudioPtr && !*includeVideoPtr {
@@ -59,110 +217,489 @@ func main() {
 		os.Exit(1)
 	}
 
-	RemuxCLI(flag.Args(), *includeAudioPtr, *includeVideoPtr, *videoTrackNumPtr, *forceRatePtr, *remuxPtr, *outputFolder)
-}
+	if level, err := logging.ParseLevel(*logLevelPtr); err != nil {
+		println(err.Error() + "\n")
 
-// Takes parsed commandline args and performs the remux tasks across the set of input files
-func RemuxCLI(files []string, extractAudio bool, extractVideo bool, videoTrackNum int, forceRate int, createMP4 bool, outputFolder string) {
-	for _, ubvFile := range files {
-		log.Println("Analysing ", ubvFile)
-		info := ubv.Analyse(ubvFile, extractAudio, videoTrackNum)
-
-		log.Printf("\n\nAnalysis complete!\n")
-		if len(info.Partitions) > 0 {
-			log.Printf("First Partition:")
-			log.Printf("\tTracks: %d", len(info.Partitions[0].Tracks))
-			log.Printf("\tFrames: %d", len(info.Partitions[0].Frames))
-
-			for _, track := range info.Partitions[0].Tracks {
-				if track.IsVideo || info.Partitions[0].VideoTrackCount == 0 {
-					log.Printf("\tStart Timecode: %s", track.StartTimecode.Format(time.RFC3339))
-					break
-				}
-			}
+		flag.Usage()
+		os.Exit(1)
+	} else if *quietPtr {
+		logging.SetLevel(logging.LevelError)
+	} else {
+		logging.SetLevel(level)
+	}
+
+	if len(*metricsAddrPtr) > 0 {
+		go func() {
+			log.Fatal("Metrics server failed: ", metrics.Serve(*metricsAddrPtr))
+		}()
+	}
+
+	jobs := *jobsPtr
+	if jobs < 1 {
+		jobs = 1
+	} else if jobs > runtime.NumCPU() {
+		logging.Warn("Limiting -jobs to the number of CPUs: ", runtime.NumCPU())
+		jobs = runtime.NumCPU()
+	}
+
+	if len(*ubvInfoPathPtr) > 0 {
+		if err := ubv.SetUbvInfoCommand(*ubvInfoPathPtr); err != nil {
+			println(err.Error())
+			os.Exit(1)
 		}
+	}
 
-		log.Printf("\n\nExtracting %d partitions", len(info.Partitions))
+	if len(*ffmpegPathPtr) > 0 {
+		if err := ffmpegutil.SetFfmpegCommand(*ffmpegPathPtr); err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+	}
 
-		// Optionally apply the user's forced framerate
-		if forceRate > 0 {
-			log.Println("\nFramerate forced by user instruction: using ", forceRate, " fps")
-			for _, partition := range info.Partitions {
-				for _, track := range partition.Tracks {
-					if track.IsVideo {
-						track.Rate = forceRate
-					}
-				}
-			}
+	ubv.SetSaveAnalysis(*saveAnalysisPtr)
+
+	if err := ubv.SetProbeFrames(*probeFramesPtr); err != nil {
+		println(err.Error() + "\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := ubv.SetPartitionLimits(*maxFrameSizePtr, *maxPartitionFramesPtr); err != nil {
+		println(err.Error() + "\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var since time.Time
+	if len(*sincePtr) > 0 {
+		var err error
+		if since, err = remux.ParseSince(*sincePtr, time.Now()); err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Directories are searched for .ubv files
+	files, err := remux.ExpandInputs(flag.Args(), *patternPtr, since)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	} else if len(files) == 0 && !*selfTestPtr && len(*watchPtr) == 0 && len(*servePtr) == 0 {
+		println("No .ubv files found in the inputs given!")
+		os.Exit(1)
+	}
+
+	if len(*analysisFilePtr) > 0 {
+		// The analysis describes one particular file, which must be on disk under the name it is analysed by
+		if len(files) != 1 || files[0] == remux.StdinFile || remux.IsURL(files[0]) {
+			println("-analysis-file requires exactly one input .ubv file (not stdin or a URL)!\n")
+
+			flag.Usage()
+			os.Exit(1)
+		} else if err := ubv.SetAnalysisFile(files[0], *analysisFilePtr); err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	filter, err := remux.ParsePartitionFilter(*partitionPtr, *partitionRangePtr, *startPtr, *endPtr)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	var trim remux.Trim
+	if len(*trimPtr) > 0 {
+		if trim, err = remux.ParseTrim(*trimPtr); err != nil {
+			println(err.Error())
+			os.Exit(1)
 		}
+	}
 
-		for _, partition := range info.Partitions {
-			var videoFile string
-			var audioFile string
-			var mp4 string
-			{
-				outputFolder := strings.TrimSuffix(outputFolder, "/")
+	videoTrack, err := ubv.ParseTrackSelector(*videoTrackPtr)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	audioTrack, err := ubv.ParseTrackSelector(*audioTrackPtr)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	var demuxOptions demux.DemuxOptions
+	demuxOptions.ShortStartCodes = *shortStartCodesPtr
+
+	switch *bitstreamFormatPtr {
+	case demux.BitstreamAnnexB:
+	case demux.BitstreamAVCC:
+		// FFmpeg cannot read a raw length-prefixed stream, and there are no start codes or parameter sets to rewrite
+		if *remuxPtr || *shortStartCodesPtr || *repairSPSPtr || *reuseParameterSetsPtr {
+			println("-bitstream-format avcc requires -mp4=false, and cannot be combined with -short-start-codes, -repair-sps or -reuse-parameter-sets!\n")
+
+			flag.Usage()
+			os.Exit(1)
+		}
+		demuxOptions.AVCC = true
+	default:
+		println("Unsupported -bitstream-format:", *bitstreamFormatPtr, "(expected annexb or avcc)\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+	demuxOptions.ADTS = *adtsPtr
+	demuxOptions.Resume = *resumePtr
+	var muxOptions ffmpegutil.MuxOptions
+	if *containerPtr != ffmpegutil.ContainerMP4 && *containerPtr != ffmpegutil.ContainerMKV {
+		println("Unsupported -container:", *containerPtr, "(expected mp4 or mkv)\n")
 
-				if outputFolder == "SRC-FOLDER" {
-					outputFolder = path.Dir(info.Filename)
-				}
+		flag.Usage()
+		os.Exit(1)
+	}
+	muxOptions.Container = *containerPtr
+	muxOptions.FastStart = *fastStartPtr
+	muxOptions.Fragmented = *fmp4Ptr
+	muxOptions.NoMetadata = *noMetadataPtr
 
-				// Strip the unixtime from the filename, we'll replace with the start timecode of the partition
-				baseFilename := strings.TrimSuffix(path.Base(ubvFile), path.Ext(ubvFile))
+	if timecodeFormat, err := ubv.ParseTimecodeFormat(*timecodeFormatPtr); err != nil {
+		println(err.Error())
+		os.Exit(1)
+	} else {
+		muxOptions.TimecodeFormat = timecodeFormat
+	}
 
-				// If the filename contains underscores, assume it's a Unifi Protect Filename
-				// and drop the final component.
-				if strings.Contains(baseFilename, "_") {
-					baseFilename = baseFilename[0:strings.LastIndex(baseFilename, "_")]
-				}
+	timecodeSource, err := remux.ParseTimecodeSource(*timecodeSourcePtr)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
 
-				basename := outputFolder + "/" + baseFilename + "_" + strings.ReplaceAll(getStartTimecode(partition, videoTrackNum).Format(time.RFC3339), ":", ".")
+	download := remux.DownloadOptions{BearerToken: *httpTokenPtr}
+	if len(*httpUserPtr) > 0 {
+		credentials := strings.SplitN(*httpUserPtr, ":", 2)
+		if len(credentials) != 2 {
+			println("Unsupported -http-user:", *httpUserPtr, "(expected user:password)\n")
 
-				if extractVideo && partition.VideoTrackCount > 0 {
-					videoFile = basename + ".h264"
-				}
+			flag.Usage()
+			os.Exit(1)
+		}
+		download.Username, download.Password = credentials[0], credentials[1]
+	}
 
-				if extractAudio && partition.AudioTrackCount > 0 {
-					audioFile = basename + ".aac"
-				}
+	switch *audioContainerPtr {
+	case ffmpegutil.AudioContainerM4A, ffmpegutil.AudioContainerAAC, ffmpegutil.AudioContainerMP4:
+		muxOptions.AudioContainer = *audioContainerPtr
+	default:
+		println("Unsupported -audio-container:", *audioContainerPtr, "(expected m4a, aac or mp4)\n")
 
-				if createMP4 {
-					mp4 = basename + ".mp4"
-				}
-			}
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *burnTimestampPtr {
+		switch *burnTimestampPositionPtr {
+		case ffmpegutil.PositionTopLeft, ffmpegutil.PositionTopRight, ffmpegutil.PositionBottomLeft, ffmpegutil.PositionBottomRight:
+		default:
+			println("Unsupported -burn-timestamp-position:", *burnTimestampPositionPtr, "(expected top-left, top-right, bottom-left or bottom-right)\n")
+
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		muxOptions.BurnTimestamp = &ffmpegutil.TimestampOverlay{
+			FontSize: *burnTimestampSizePtr,
+			Position: *burnTimestampPositionPtr,
+			FontFile: *burnTimestampFontPtr,
+		}
+	}
+
+	if len(*ffmpegExtraPtr) > 0 {
+		extraArgs, err := ffmpegutil.SplitArgs(*ffmpegExtraPtr)
+		if err != nil {
+			println("Invalid -ffmpeg-extra:", err.Error()+"\n")
+
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		muxOptions.ExtraArgs = extraArgs
+	}
+
+	if countArgs(ffmpegutil.LogLevels, *ffmpegLogLevelPtr) == 0 {
+		println("Unsupported -ffmpeg-loglevel:", *ffmpegLogLevelPtr, "(expected one of: "+strings.Join(ffmpegutil.LogLevels, ", ")+")\n")
 
-			// Demux .ubv into .h264 (and optionally .aac) atomic streams
-			demux.DemuxSinglePartitionToNewFiles(ubvFile, videoFile, videoTrackNum, audioFile, partition)
-
-			if createMP4 {
-				log.Println("\nWriting MP4 ", mp4, "...")
-
-				// Spawn FFmpeg to remux
-				ffmpegutil.MuxAudioAndVideo(partition, videoFile, videoTrackNum, audioFile, mp4)
-
-				// Delete
-				if len(videoFile) > 0 {
-					if err := os.Remove(videoFile); err != nil {
-						log.Println("Warning: could not delete ", videoFile+": ", err)
-					}
-				}
-				if len(audioFile) > 0 {
-					if err := os.Remove(audioFile); err != nil {
-						log.Println("Warning: could not delete ", audioFile+": ", err)
-					}
-				}
+		flag.Usage()
+		os.Exit(1)
+	}
+	muxOptions.LogLevel = *ffmpegLogLevelPtr
+
+	if len(*servePtr) > 0 {
+		// Streams are muxed with the same FFmpeg log level and extra arguments as files would be
+		log.Fatal(server.Serve(*servePtr, *serveDirPtr, muxOptions))
+	}
+
+	if *audioChannelsPtr < 0 || *audioChannelsPtr > 8 {
+		println("Unsupported -audio-channels:", *audioChannelsPtr, "(expected 1 to 8)\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+	muxOptions.AudioChannels = *audioChannelsPtr
+
+	switch *checksumPtr {
+	case "", remux.ChecksumSHA256:
+	default:
+		println("Unsupported -checksum:", *checksumPtr, "(expected sha256)\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch *subtitlesPtr {
+	case "", remux.SubtitlesSRT, remux.SubtitlesVTT:
+	default:
+		println("Unsupported -subtitles:", *subtitlesPtr, "(expected srt or vtt)\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *progressPtr {
+		demuxOptions.Progress = func(progress demux.DemuxProgress) {
+			logging.Info("Progress: ", progress)
+		}
+	}
+
+	if len(*resolutionPtr) > 0 {
+		resolution, err := demux.ParseResolution(*resolutionPtr)
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+
+		muxOptions.VideoSize = resolution.String()
+
+		if *repairSPSPtr {
+			logging.Info("Repairing SPS: synthesising parameter sets for ", resolution)
+			demuxOptions.ReplacementParameterSets = demux.SynthesiseParameterSets(resolution)
+		}
+	} else if *repairSPSPtr {
+		println("-repair-sps requires -resolution WxH!\n")
+
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Cancel on Ctrl-C (or SIGTERM) so partially written files are cleaned up and FFmpeg is killed
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logging.Info("Received ", sig, ", cancelling...")
+		cancel()
+
+		// A second signal terminates immediately
+		signal.Stop(signals)
+	}()
+
+	opts := remux.Options{
+		Files:            files,
+		ExtractAudio:     *includeAudioPtr,
+		ExtractVideo:     *includeVideoPtr,
+		VideoTrack:       videoTrack,
+		AudioTrack:       audioTrack,
+		ForceRate:        *forceRatePtr,
+		ForceAudioRate:   *forceAudioRatePtr,
+		VerifyNAL:        *verifyNALPtr,
+		CreateMP4:        *remuxPtr,
+		KeepIntermediate: *keepIntermediatePtr,
+		OutputFolder:     *outputFolder,
+		GroupByCamera:    *groupByCameraPtr,
+		MirrorRoot:       *mirrorTreePtr,
+		Demux:            demuxOptions,
+		Mux:              muxOptions,
+		Strict:           *strictPtr,
+		Jobs:             jobs,
+		Filter:           filter,
+		Trim:             trim,
+		Pipe:             *pipePtr,
+		NameTemplate:     *nameTemplatePtr,
+		DryRun:           *dryRunPtr,
+		NoClobber:        *noClobberPtr,
+		Merge:            *mergePtr,
+		Chapters:         *chaptersPtr,
+		SplitTracks:      *splitTracksPtr,
+		Subtitles:        *subtitlesPtr,
+		Thumbnail:        *thumbnailPtr,
+		ThumbnailOffset:  *thumbnailOffsetPtr,
+		EmbedSubtitles:   *embedSubtitlesPtr,
+
+		ReuseParameterSets: *reuseParameterSetsPtr,
+		Checksum:           *checksumPtr,
+		PreserveMtime:      *preserveMtimePtr,
+		AllVideoTracks:     *allVideoTracksPtr,
+		TimecodeSource:     timecodeSource,
+		Download:           download,
+	}
+
+	if *selfTestPtr {
+		if err := remux.SelfTest(ctx, opts, os.Stdout); err != nil {
+			println("Self-test failed:", err.Error())
+			os.Exit(1)
+		}
+		println("Self-test passed")
+		return
+	}
+
+	if *probeRatePtr {
+		if err := remux.ProbeRates(opts.Files, opts.Download, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *listTracksPtr {
+		if err := remux.ListTracks(opts.Files, opts.Download, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *inspectPtr {
+		if err := remux.Inspect(ctx, opts, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *stdoutPtr {
+		if err := remux.StreamVideo(ctx, opts, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *analyseOnlyPtr {
+		summaries, err := remux.Analyse(ctx, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *jsonPtr {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(summaries); err != nil {
+				log.Fatal("Could not write JSON analysis: ", err)
 			}
+		} else {
+			remux.PrintEstimates(summaries, os.Stdout)
+		}
+		return
+	}
+
+	// Create the output folder up front, so a bad path fails before any analysis (SRC-FOLDER and mirrored folders are
+	// created per input as they are written)
+	if !*dryRunPtr && strings.TrimSuffix(*outputFolder, "/") != "SRC-FOLDER" {
+		if err := os.MkdirAll(*outputFolder, 0755); err != nil {
+			println("Could not create -output-folder: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if len(*watchPtr) > 0 {
+		if err := remux.Watch(ctx, opts, *watchPtr, *patternPtr, since, *watchSettlePtr); err != nil && ctx.Err() == nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	results, err := remux.RemuxContext(ctx, opts)
+
+	if len(*reportPtr) > 0 {
+		if err := remux.WriteReport(*reportPtr, results); err != nil {
+			logging.Warn("Warning: could not write batch report ", *reportPtr+": ", err)
+		} else {
+			logging.Info("Wrote batch report ", *reportPtr)
+		}
+	}
+
+	if len(*manifestPtr) > 0 {
+		if err := remux.WriteManifest(*manifestPtr, results); err != nil {
+			logging.Warn("Warning: could not write manifest ", *manifestPtr+": ", err)
+		} else {
+			logging.Info("Wrote manifest ", *manifestPtr)
+		}
+	}
+
+	if ctx.Err() != nil {
+		logging.Info("Cancelled")
+		os.Exit(130)
+	} else if err != nil {
+		log.Fatal(err)
+	} else if failed := countFailed(results); failed > 0 {
+		log.Fatalf("%d of %d outputs failed", failed, len(results))
+	}
+}
+
+// The number of results that failed
+func countFailed(results []remux.Result) int {
+	count := 0
+	for _, result := range results {
+		if result.Status == remux.StatusFailed {
+			count++
+		}
+	}
+
+	return count
+}
+
+// The number of args equal to value
+func countArgs(args []string, value string) int {
+	count := 0
+	for _, arg := range args {
+		if arg == value {
+			count++
 		}
 	}
+
+	return count
 }
 
-func getStartTimecode(partition *ubv.UbvPartition, videoTrackNum int) time.Time {
-	for _, track := range partition.Tracks {
-		if partition.VideoTrackCount == 0 || (track.IsVideo && track.TrackNumber == videoTrackNum) {
-			return track.StartTimecode
+// Whether any of args is an http(s):// URL to download
+func hasURLArgs(args []string) bool {
+	for _, arg := range args {
+		if remux.IsURL(arg) {
+			return true
 		}
 	}
 
-	// No start timecode available at all! Return the time of demux as a failsafe
-	return time.Now()
+	return false
+}
+
+// Prints where an external tool was found (using override if set) and its version, or why it could not be found
+func printDependency(label string, override string, set func(string) error, find func() (string, error), version func(string) (string, error)) {
+	if len(override) > 0 {
+		if err := set(override); err != nil {
+			println("\t"+label, "unusable:", err.Error())
+			return
+		}
+	}
+
+	path, err := find()
+	if err != nil {
+		println("\t"+label, "not found:", err.Error())
+		return
+	}
+
+	if v, err := version(path); err != nil {
+		println("\t"+label, path, "(could not determine version:", err.Error()+")")
+	} else if len(v) == 0 {
+		println("\t"+label, path, "(version unknown)")
+	} else {
+		println("\t"+label, path, "("+v+")")
+	}
 }
@@ -0,0 +1,66 @@
+package remux
+
+import (
+	"context"
+	"ubvremux/ubv"
+)
+
+// The outcome of analysing one input file
+type fileAnalysis struct {
+	ubvFile       string
+	info          ubv.UbvFile
+	videoTrackNum int
+	audioTrackNum int
+	err           error
+}
+
+// Analyses ubvFiles with up to opts.Jobs ubnt_ubvinfo runs at once (since analysis is mostly waiting on ubnt_ubvinfo),
+// calling process with each analysis in input order. At most opts.Jobs analyses are held at a time, so a large batch
+// does not have to fit in memory at once. Stops at the first error from process, or when ctx is cancelled.
+func analyseFiles(ctx context.Context, opts Options, ubvFiles []string, process func(int, fileAnalysis) error) error {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	analyses := make([]chan fileAnalysis, len(ubvFiles))
+	for i := range analyses {
+		analyses[i] = make(chan fileAnalysis, 1)
+	}
+
+	// A slot is taken before starting each analysis, and freed once process is done with it
+	slots := make(chan struct{}, jobs)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for i, ubvFile := range ubvFiles {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			go func(i int, ubvFile string) {
+				info, videoTrackNum, audioTrackNum, err := analyseFile(ctx, ubvFile, opts)
+				analyses[i] <- fileAnalysis{ubvFile, info, videoTrackNum, audioTrackNum, err}
+			}(i, ubvFile)
+		}
+	}()
+
+	for i := range ubvFiles {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		analysis := <-analyses[i]
+		err := process(i, analysis)
+		<-slots
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
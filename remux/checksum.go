@@ -0,0 +1,57 @@
+package remux
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"ubvremux/logging"
+)
+
+// Checksum algorithms for outputs
+const ChecksumSHA256 = "sha256"
+
+// Hashes every file a successful result produced, recording the digests on the result and writing each alongside its
+// file as a <file>.sha256 sidecar (in the format sha256sum -c reads). The files are hashed once complete, as most are
+// written by FFmpeg
+func writeChecksums(result *Result) {
+	if result.Status != StatusOK {
+		return
+	}
+
+	for _, file := range result.Files {
+		sum, err := sha256File(file)
+		if err != nil {
+			logging.Warn("Warning: could not checksum ", file, ": ", err)
+			continue
+		}
+
+		if result.Checksums == nil {
+			result.Checksums = make(map[string]string)
+		}
+		result.Checksums[file] = sum
+
+		sidecar := file + "." + ChecksumSHA256
+		if err := ioutil.WriteFile(sidecar, []byte(sum+"  "+filepath.Base(file)+"\n"), 0644); err != nil {
+			logging.Warn("Warning: could not write checksum ", sidecar, ": ", err)
+		}
+	}
+}
+
+// The hex SHA-256 digest of a file
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
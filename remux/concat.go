@@ -0,0 +1,128 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"ubvremux/ffmpegutil"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Whether the partitions of each file are concatenated into one output
+func (opts Options) concatenates() bool {
+	return opts.CreateMP4 && (opts.Merge || opts.Chapters)
+}
+
+// The concatenated output for a file, which takes the name of its first extracted partition
+func concatenatedOutput(opts Options, info ubv.UbvFile, partitions []*ubv.UbvPartition, videoTrackNum int) string {
+	hasVideo := opts.ExtractVideo && partitions[0].VideoTrackCount > 0
+
+	return outputBasename(opts, info, partitions[0], videoTrackNum) + "." + opts.Mux.Extension(hasVideo)
+}
+
+// Concatenates the successfully muxed partition segments of a file into a single output (with a chapter per partition
+// if requested), replacing their results with a single result for the concatenated output (results for partitions that
+// were not muxed are kept)
+func concatenatePartitions(ctx context.Context, opts Options, info ubv.UbvFile, videoTrackNum int, partitions []*ubv.UbvPartition, results []Result) []Result {
+	output := concatenatedOutput(opts, info, partitions, videoTrackNum)
+
+	var remaining []Result
+	var firstSegment *Result
+	var segments []string
+	var chapters []ffmpegutil.Chapter
+	var offset time.Duration
+	rates := make(map[int]bool)
+
+	for i, result := range results {
+		if result.Status != StatusOK {
+			remaining = append(remaining, result)
+			continue
+		}
+
+		if firstSegment == nil {
+			firstSegment = &results[i]
+		}
+
+		duration := segmentDuration(partitions[i], videoTrackNum)
+		if track, ok := partitions[i].Tracks[videoTrackNum]; ok {
+			rates[track.Rate] = true
+		}
+
+		segments = append(segments, result.Output)
+		chapters = append(chapters, ffmpegutil.Chapter{
+			Start: offset,
+			End:   offset + duration,
+			Title: getStartTimecode(partitions[i], videoTrackNum).Format(time.RFC3339),
+		})
+		offset += duration
+	}
+
+	if !opts.Chapters {
+		chapters = nil
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Concatenated output: %s (%d partitions)\n", output, len(partitions))
+		return results
+	} else if len(segments) == 0 {
+		return results
+	}
+
+	// Each segment was muxed with its own framerate and audio offset, so its timestamps are already right; FFmpeg
+	// copes with the rate changing between segments, but some players do not
+	if len(rates) > 1 {
+		logging.Warn("Warning: the framerate of ", info.Filename, " changes between partitions; some players may not handle the concatenated output")
+	}
+
+	logging.Info("\nConcatenating ", len(segments), " partitions into ", output, "...")
+
+	start := getStartTimecode(partitions[0], videoTrackNum)
+	if err := ffmpegutil.Concatenate(ctx, segments, chapters, start, output, muxOptionsFor(opts, info)); ctx.Err() != nil {
+		row := cancelledResult(info.Filename, partitions[0], videoTrackNum, append(segments, output)...)
+		row.Partition = -1
+		return append(remaining, row)
+	} else if err != nil {
+		// The segments are kept, as they are complete outputs in their own right
+		row := muxFailedResult(info.Filename, partitions[0], videoTrackNum, err, output)
+		row.Partition = -1
+		return append(remaining, row)
+	}
+
+	if opts.KeepIntermediate {
+		logging.Info("Keeping per-partition segments (-keep-intermediate)")
+	} else {
+		for _, segment := range segments {
+			if err := os.Remove(segment); err != nil {
+				logging.Warn("Warning: could not delete ", segment+": ", err)
+			}
+		}
+	}
+
+	row := newResult(info.Filename, partitions[0], videoTrackNum, output)
+	row.Partition = -1
+	row.DurationSeconds = offset.Seconds()
+	if row.Status == StatusOK {
+		row.VideoTrack = firstSegment.VideoTrack
+		row.AudioTrack = firstSegment.AudioTrack
+		row.Files = []string{output}
+	}
+
+	return append(remaining, row)
+}
+
+// The playback duration of a partition: its timecode span plus the final frame
+func segmentDuration(partition *ubv.UbvPartition, videoTrackNum int) time.Duration {
+	for _, track := range partition.Tracks {
+		if partition.VideoTrackCount == 0 || (track.IsVideo && track.TrackNumber == videoTrackNum) {
+			duration := track.LastTimecode.Sub(track.StartTimecode)
+			if track.Rate > 0 {
+				duration += time.Second / time.Duration(track.Rate)
+			}
+			return duration
+		}
+	}
+
+	return 0
+}
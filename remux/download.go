@@ -0,0 +1,126 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"ubvremux/logging"
+)
+
+// Credentials for downloading http(s):// inputs from an authenticated endpoint (e.g. the NVR)
+type DownloadOptions struct {
+	// If set, sent as HTTP basic auth
+	Username string
+	Password string
+
+	// If set, sent as an "Authorization: Bearer" header (instead of basic auth)
+	BearerToken string
+}
+
+// Minimum time between download progress messages
+const downloadProgressInterval = 5 * time.Second
+
+// Whether input is an http:// or https:// URL (to be downloaded) rather than a filename
+func IsURL(input string) bool {
+	lower := strings.ToLower(input)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// Downloads rawURL into a new temporary folder, returning the downloaded file along with a function that deletes it.
+// The file keeps the name from the URL path so that outputs (and the Protect filename parsing) are as for a local copy
+func downloadInput(ctx context.Context, rawURL string, opts DownloadOptions) (string, func(), error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := path.Base(parsed.Path)
+	if name == "/" || name == "." || !strings.EqualFold(filepath.Ext(name), ".ubv") {
+		name = "download.ubv"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(opts.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+opts.BearerToken)
+	} else if len(opts.Username) > 0 {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	dir, err := ioutil.TempDir("", "ubvremux-download-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logging.Warn("Warning: could not delete download ", dir+": ", err)
+		}
+	}
+
+	filename := filepath.Join(dir, name)
+	f, err := os.Create(filename)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	logging.Info("Downloading ", parsed.Redacted(), " into ", filename)
+	progress := &downloadProgress{total: resp.ContentLength, last: time.Now()}
+	written, err := io.Copy(io.MultiWriter(f, progress), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	} else if resp.ContentLength >= 0 && written != resp.ContentLength {
+		cleanup()
+		return "", nil, fmt.Errorf("download incomplete: got %d of %d bytes", written, resp.ContentLength)
+	}
+	logging.Info("Downloaded ", written, " bytes")
+
+	return filename, cleanup, nil
+}
+
+// Periodically logs how much of a download has been written through it
+type downloadProgress struct {
+	written int64
+	total   int64 // -1 if unknown
+	last    time.Time
+}
+
+func (p *downloadProgress) Write(data []byte) (int, error) {
+	p.written += int64(len(data))
+
+	if time.Since(p.last) >= downloadProgressInterval {
+		p.last = time.Now()
+
+		if p.total > 0 {
+			logging.Infof("Download progress: %.1f%% (%d/%d bytes)", float64(p.written)*100/float64(p.total), p.written, p.total)
+		} else {
+			logging.Infof("Download progress: %d bytes", p.written)
+		}
+	}
+
+	return len(data), nil
+}
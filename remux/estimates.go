@@ -0,0 +1,50 @@
+package remux
+
+import (
+	"fmt"
+	"io"
+	"time"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Prints the estimated playback duration and size of every partition of each file, with totals per file. The
+// wall-clock duration is shown alongside: if the two differ greatly, the framerate is probably wrong
+func PrintEstimates(summaries []ubv.FileSummary, out io.Writer) {
+	for _, summary := range summaries {
+		fmt.Fprintf(out, "%s\n", summary.Filename)
+
+		for _, line := range estimateLines(summary) {
+			fmt.Fprintf(out, "\t%s\n", line)
+		}
+	}
+}
+
+// Logs the estimates PrintEstimates would print for a single analysed file
+func logEstimates(info ubv.UbvFile) {
+	logging.Info("Estimates:")
+	for _, line := range estimateLines(ubv.Summarise(info)) {
+		logging.Infof("\t%s", line)
+	}
+}
+
+// One line per partition, then the file's totals
+func estimateLines(summary ubv.FileSummary) []string {
+	var lines []string
+
+	for _, partition := range summary.Partitions {
+		if len(partition.Abandoned) > 0 {
+			lines = append(lines, fmt.Sprintf("Partition %d: abandoned (%s)", partition.Index, partition.Abandoned))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("Partition %d: %d frames, plays for %s (recorded over %s), %d bytes", partition.Index, partition.FrameCount, seconds(partition.EstimatedDurationSeconds), seconds(partition.DurationSeconds), partition.EstimatedSizeBytes))
+	}
+
+	return append(lines, fmt.Sprintf("Total: %d partitions, plays for %s, %d bytes", len(summary.Partitions), seconds(summary.EstimatedDurationSeconds), summary.EstimatedSizeBytes))
+}
+
+// Formats a number of seconds as a duration (to the millisecond)
+func seconds(value float64) string {
+	return (time.Duration(value * float64(time.Second))).Round(time.Millisecond).String()
+}
@@ -0,0 +1,97 @@
+package remux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Restricts extraction to partitions by index and/or time window
+type PartitionFilter struct {
+	// Inclusive partition index range; FirstIndex < 0 means no index restriction
+	FirstIndex int
+	LastIndex  int
+
+	// Only partitions overlapping [Start, End] are selected; zero values leave that end unbounded
+	Start time.Time
+	End   time.Time
+}
+
+// Builds a filter from the -partition, -partition-range, -start and -end flag values
+func ParsePartitionFilter(partition int, partitionRange string, start string, end string) (PartitionFilter, error) {
+	filter := PartitionFilter{FirstIndex: -1, LastIndex: -1}
+
+	if partition >= 0 && len(partitionRange) > 0 {
+		return filter, fmt.Errorf("-partition and -partition-range cannot be combined")
+	} else if partition >= 0 {
+		filter.FirstIndex = partition
+		filter.LastIndex = partition
+	} else if len(partitionRange) > 0 {
+		parts := strings.Split(partitionRange, ":")
+		if len(parts) != 2 {
+			return filter, fmt.Errorf("invalid -partition-range %q, expected a:b", partitionRange)
+		}
+
+		var err error
+		if filter.FirstIndex, err = strconv.Atoi(parts[0]); err != nil || filter.FirstIndex < 0 {
+			return filter, fmt.Errorf("invalid -partition-range start in %q", partitionRange)
+		}
+		if filter.LastIndex, err = strconv.Atoi(parts[1]); err != nil || filter.LastIndex < filter.FirstIndex {
+			return filter, fmt.Errorf("invalid -partition-range end in %q", partitionRange)
+		}
+	}
+
+	var err error
+	if len(start) > 0 {
+		if filter.Start, err = time.Parse(time.RFC3339, start); err != nil {
+			return filter, fmt.Errorf("invalid -start: %w", err)
+		}
+	}
+	if len(end) > 0 {
+		if filter.End, err = time.Parse(time.RFC3339, end); err != nil {
+			return filter, fmt.Errorf("invalid -end: %w", err)
+		}
+	}
+
+	return filter, nil
+}
+
+func (f PartitionFilter) matches(partition *ubv.UbvPartition, videoTrackNum int) bool {
+	if f.FirstIndex >= 0 && (partition.Index < f.FirstIndex || partition.Index > f.LastIndex) {
+		return false
+	}
+
+	if f.Start.IsZero() && f.End.IsZero() {
+		return true
+	}
+
+	for _, track := range partition.Tracks {
+		if partition.VideoTrackCount == 0 || (track.IsVideo && track.TrackNumber == videoTrackNum) {
+			if !f.Start.IsZero() && track.LastTimecode.Before(f.Start) {
+				return false
+			}
+			if !f.End.IsZero() && track.StartTimecode.After(f.End) {
+				return false
+			}
+
+			return true
+		}
+	}
+
+	// No timecodes available to compare against
+	return false
+}
+
+// Returns the partitions selected by the filter
+func (f PartitionFilter) apply(partitions []*ubv.UbvPartition, videoTrackNum int) []*ubv.UbvPartition {
+	var selected []*ubv.UbvPartition
+	for _, partition := range partitions {
+		if f.matches(partition, videoTrackNum) {
+			selected = append(selected, partition)
+		}
+	}
+
+	return selected
+}
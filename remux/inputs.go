@@ -0,0 +1,77 @@
+package remux
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Expands the inputs given on the command line: directories are searched recursively for .ubv files (skipping anything
+// else, such as cached .txt analyses), while other inputs are kept as they are. If pattern is non-empty, only inputs
+// whose filename matches it (see filepath.Match) are kept, and if since is non-zero, inputs whose filename says the
+// recording started before since are dropped (those without a recording time in their name are kept); stdin is always
+// kept.
+func ExpandInputs(inputs []string, pattern string, since time.Time) ([]string, error) {
+	if len(pattern) > 0 {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid -pattern %q: %w", pattern, err)
+		}
+	}
+
+	matches := func(filename string) bool {
+		if start := ubv.ParseProtectFilename(filename).RecordStart; !since.IsZero() && !start.IsZero() && start.Before(since) {
+			return false
+		}
+
+		matched, _ := filepath.Match(pattern, filepath.Base(filename))
+		return len(pattern) == 0 || matched
+	}
+
+	var files []string
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		if input == StdinFile || err != nil || !info.IsDir() {
+			// Inputs that cannot be read are reported when they are analysed
+			if input == StdinFile || matches(input) {
+				files = append(files, input)
+			}
+			continue
+		}
+
+		err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".ubv") && matches(path) {
+				files = append(files, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error searching %s for .ubv files: %w", input, err)
+		}
+	}
+
+	return files, nil
+}
+
+// Parses a -since value: either an RFC3339 timestamp, or how long before now (e.g. 36h, or 7d for days)
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	} else if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid -since %q, expected a duration (e.g. 36h or 7d) or an RFC3339 timestamp", value)
+}
@@ -0,0 +1,151 @@
+package remux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Creates the named (empty) files beneath a temporary directory, returning the directory
+func createInputTree(t *testing.T, names ...string) string {
+	dir, err := ioutil.TempDir("", "ubvremux-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for _, name := range names {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(filename, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestExpandInputs(t *testing.T) {
+	dir := createInputTree(t,
+		"a/FCECDA1F0A63_0_rotating_1597425468956.ubv",
+		"a/FCECDA1F0A63_0_rotating_1597425468956.ubv.txt",
+		"a/b/FCECDA1F0A63_2_timelapse_1597425468956.ubv",
+		"a/b/UPPER.UBV",
+		"a/notes.txt",
+	)
+
+	tests := []struct {
+		name    string
+		inputs  []string
+		pattern string
+		want    []string
+	}{
+		{"directory", []string{"a"}, "", []string{
+			"a/FCECDA1F0A63_0_rotating_1597425468956.ubv",
+			"a/b/FCECDA1F0A63_2_timelapse_1597425468956.ubv",
+			"a/b/UPPER.UBV",
+		}},
+		{"pattern", []string{"a"}, "*_rotating_*", []string{"a/FCECDA1F0A63_0_rotating_1597425468956.ubv"}},
+		{"files are kept whatever their extension", []string{"a/notes.txt"}, "", []string{"a/notes.txt"}},
+		{"pattern applies to files too", []string{"a/notes.txt"}, "*.ubv", nil},
+		{"missing inputs are kept", []string{"missing.ubv"}, "", []string{"missing.ubv"}},
+		{"stdin is always kept", []string{StdinFile}, "*_rotating_*", []string{StdinFile}},
+	}
+
+	for _, test := range tests {
+		var inputs []string
+		for _, input := range test.inputs {
+			if input == StdinFile {
+				inputs = append(inputs, input)
+			} else {
+				inputs = append(inputs, filepath.Join(dir, filepath.FromSlash(input)))
+			}
+		}
+
+		files, err := ExpandInputs(inputs, test.pattern, time.Time{})
+		if err != nil {
+			t.Errorf("%s: expansion failed: %v", test.name, err)
+			continue
+		}
+
+		var relative []string
+		for _, file := range files {
+			if rel, err := filepath.Rel(dir, file); err == nil && file != StdinFile {
+				file = filepath.ToSlash(rel)
+			}
+			relative = append(relative, file)
+		}
+		sort.Strings(relative)
+
+		if !reflect.DeepEqual(relative, test.want) {
+			t.Errorf("%s: files are incorrect, got: %q, want: %q.", test.name, relative, test.want)
+		}
+	}
+}
+
+func TestExpandInputsRejectsInvalidPattern(t *testing.T) {
+	if _, err := ExpandInputs([]string{"a.ubv"}, "[", time.Time{}); err == nil {
+		t.Error("Expected an invalid -pattern to fail")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2023, time.Month(5), 16, 11, 58, 26, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"36h", now.Add(-36 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"0s", now},
+		{"7d", time.Date(2023, time.Month(5), 9, 11, 58, 26, 0, time.UTC)},
+		{"0d", now},
+		{"2023-05-01T00:00:00Z", time.Date(2023, time.Month(5), 1, 0, 0, 0, 0, time.UTC)},
+		{"2023-05-01T02:00:00+02:00", time.Date(2023, time.Month(5), 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		since, err := ParseSince(test.value, now)
+		if err != nil {
+			t.Errorf("Parsing -since %q failed: %v", test.value, err)
+		} else if !since.Equal(test.want) {
+			t.Errorf("-since %q is incorrect, got: %s, want: %s.", test.value, since, test.want)
+		}
+	}
+
+	for _, value := range []string{"", "7", "d", "-7d", "-1h", "1.5d", "yesterday", "2023-05-01"} {
+		if since, err := ParseSince(value, now); err == nil {
+			t.Errorf("Expected -since %q to fail, got: %s", value, since)
+		}
+	}
+}
+
+func TestExpandInputsSince(t *testing.T) {
+	// Recordings starting at 2020-08-14T17:17:48Z and 2020-09-13T12:26:40Z, and one with no time in its name
+	dir := createInputTree(t,
+		"FCECDA1F0A63_0_rotating_1597425468956.ubv",
+		"FCECDA1F0A63_0_rotating_1600000000000.ubv",
+		"recording.ubv",
+	)
+
+	files, err := ExpandInputs([]string{dir}, "", time.Date(2020, time.Month(9), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	sort.Strings(names)
+
+	if want := []string{"FCECDA1F0A63_0_rotating_1600000000000.ubv", "recording.ubv"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Files since 2020-09-01 are incorrect, got: %q, want: %q.", names, want)
+	}
+}
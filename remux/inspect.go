@@ -0,0 +1,56 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"ubvremux/demux"
+	"ubvremux/logging"
+)
+
+// Analyses each file and prints the structure (the sequence of NAL types) of the demuxed video bitstream of each of
+// its selected partitions, flagging those that cannot be decoded from their start. Nothing is written to disk.
+func Inspect(ctx context.Context, opts Options, out io.Writer) error {
+	inputs, cleanup, err := resolveInputs(ctx, opts.Files, opts.Download)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return analyseFiles(ctx, opts, inputs, func(i int, analysis fileAnalysis) error {
+		input := opts.Files[i]
+		if analysis.err != nil {
+			if opts.Strict {
+				return fmt.Errorf("analysis of %s failed: %w", input, analysis.err)
+			}
+
+			logging.Warn("Analysis of ", input, " failed, skipping: ", analysis.err)
+			return nil
+		}
+
+		fmt.Fprintf(out, "%s\n", input)
+		for _, partition := range opts.Filter.apply(analysis.info.Partitions, analysis.videoTrackNum) {
+			if !opts.Trim.isZero() {
+				partition = opts.Trim.apply(partition, analysis.videoTrackNum)
+			}
+
+			if track, ok := partition.Tracks[analysis.videoTrackNum]; !ok || !track.IsVideo || track.FrameCount == 0 {
+				fmt.Fprintf(out, "Partition %d: no frames on video track %d\n", partition.Index, analysis.videoTrackNum)
+				continue
+			}
+
+			report, err := demux.InspectPartition(ctx, analysis.ubvFile, partition, analysis.videoTrackNum, opts.Demux)
+			if err != nil {
+				return err
+			}
+
+			status := "OK"
+			if len(report.Problem) > 0 {
+				status = "PROBLEM: " + report.Problem
+			}
+			fmt.Fprintf(out, "Partition %d (track %d): %s\n\t%s\n", partition.Index, analysis.videoTrackNum, status, report)
+		}
+
+		return nil
+	})
+}
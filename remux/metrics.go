@@ -0,0 +1,29 @@
+package remux
+
+import "ubvremux/metrics"
+
+var (
+	filesProcessed      = metrics.NewCounter("ubvremux_files_processed_total", "Input files processed, whether or not they could be analysed")
+	partitionsExtracted = metrics.NewCounter("ubvremux_partitions_extracted_total", "Outputs successfully extracted (one per partition, or per file when partitions are concatenated)")
+	partitionsFailed    = metrics.NewCounter("ubvremux_partitions_failed_total", "Partitions (or files) that failed to extract")
+	bytesWritten        = metrics.NewCounter("ubvremux_bytes_written_total", "Total size of the outputs written")
+
+	analysisDuration = metrics.NewHistogram("ubvremux_analysis_duration_seconds", "Time taken to analyse each input file", []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300})
+)
+
+// Counts the outcome of processing a file
+func recordMetrics(results []Result) {
+	filesProcessed.Inc()
+
+	for _, result := range results {
+		switch result.Status {
+		case StatusOK:
+			partitionsExtracted.Inc()
+			if result.Size > 0 {
+				bytesWritten.Add(uint64(result.Size))
+			}
+		case StatusFailed:
+			partitionsFailed.Inc()
+		}
+	}
+}
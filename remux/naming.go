@@ -0,0 +1,36 @@
+package remux
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Reproduces the historic <filename minus unixtime>_<start timecode> naming
+const DefaultNameTemplate = "{base}_{start}"
+
+// Expands an output name template for a partition. Supported placeholders:
+//
+//	{base}      the source filename without extension and trailing unixtime
+//	{mac}       camera MAC address (from the Protect filename)
+//	{channel}   recording channel (from the Protect filename)
+//	{type}      record type, e.g. rotating or timelapse (from the Protect filename)
+//	{date}      partition start date (YYYY-MM-DD)
+//	{time}      partition start time (HH.MM.SS)
+//	{start}     partition start timestamp (RFC3339 with : replaced by .)
+//	{partition} partition index
+func expandNameTemplate(template string, filename ubv.ProtectFilename, partition *ubv.UbvPartition, start time.Time) string {
+	replacer := strings.NewReplacer(
+		"{base}", filename.Base,
+		"{mac}", filename.Mac,
+		"{channel}", filename.Channel,
+		"{type}", filename.RecordType,
+		"{date}", start.Format("2006-01-02"),
+		"{time}", start.Format("15.04.05"),
+		"{start}", strings.ReplaceAll(start.Format(time.RFC3339), ":", "."),
+		"{partition}", strconv.Itoa(partition.Index),
+	)
+
+	return replacer.Replace(template)
+}
@@ -0,0 +1,32 @@
+package remux
+
+import (
+	"testing"
+	"time"
+	"ubvremux/ubv"
+)
+
+func TestExpandNameTemplate(t *testing.T) {
+	filename := ubv.ParseProtectFilename("/recordings/FCECDA1F0A63_0_rotating_1597425468956.ubv")
+	partition := &ubv.UbvPartition{Index: 3}
+	start := time.Date(2020, time.Month(8), 14, 17, 17, 48, 956000000, time.UTC)
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{DefaultNameTemplate, "FCECDA1F0A63_0_rotating_2020-08-14T17.17.48Z"},
+		{"{mac}/{date}/{time}", "FCECDA1F0A63/2020-08-14/17.17.48"},
+		{"{type}-{channel}-{partition}", "rotating-0-3"},
+		{"{mac}_{mac}", "FCECDA1F0A63_FCECDA1F0A63"},
+		{"no placeholders", "no placeholders"},
+		// Unknown placeholders are left alone
+		{"{base}_{unknown}", "FCECDA1F0A63_0_rotating_{unknown}"},
+	}
+
+	for _, test := range tests {
+		if name := expandNameTemplate(test.template, filename, partition, start); name != test.want {
+			t.Errorf("Expansion of %q is incorrect, got: %s, want: %s.", test.template, name, test.want)
+		}
+	}
+}
@@ -0,0 +1,1104 @@
+package remux
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ubvremux/demux"
+	"ubvremux/ffmpegutil"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// What to remux and how (the library equivalent of the remux commandline flags)
+type Options struct {
+	// The .ubv files to process
+	Files []string
+
+	ExtractAudio bool
+	ExtractVideo bool
+
+	// The video and audio tracks to extract
+	VideoTrack ubv.TrackSelector
+	AudioTrack ubv.TrackSelector
+
+	// If non-zero, overrides the detected video framerate
+	ForceRate int
+
+	// If non-zero, overrides the audio sample rate (taken from the TBC); the audio is re-encoded at this rate
+	ForceAudioRate int
+
+	// If true, audits every video NAL length prefix of each partition before extracting
+	VerifyNAL bool
+
+	// If true, muxes the bitstreams into Mux.Container, or Mux.AudioContainer without video (and removes the intermediate bitstream files)
+	CreateMP4 bool
+
+	// If true, the intermediate bitstream files are kept after muxing
+	KeepIntermediate bool
+
+	// The folder to write outputs to; "SRC-FOLDER" to put them alongside the .ubv files
+	OutputFolder string
+
+	// If set, the input root directory whose structure is recreated under OutputFolder
+	MirrorRoot string
+
+	// If true, outputs are written to a subfolder (of the resolved output folder) named after the camera MAC
+	GroupByCamera bool
+
+	Demux demux.DemuxOptions
+	Mux   ffmpegutil.MuxOptions
+
+	// If true, stop at the first file that fails analysis rather than skipping it
+	Strict bool
+
+	// Number of partitions to extract concurrently (and number of files to analyse concurrently)
+	Jobs int
+
+	// Restricts which partitions are extracted
+	Filter PartitionFilter
+
+	// If true, pipe the demuxed bitstreams straight into FFmpeg rather than writing intermediate files
+	Pipe bool
+
+	// Output filename template (see expandNameTemplate); DefaultNameTemplate if empty
+	NameTemplate string
+
+	// If true, print the files that would be created without writing anything
+	DryRun bool
+
+	// If true, skip partitions whose outputs already exist
+	NoClobber bool
+
+	// If true (and CreateMP4), the partitions of each file are concatenated into a single output named after the first
+	// partition
+	Merge bool
+
+	// As Merge, but also adds a chapter marker at the start of each partition
+	Chapters bool
+
+	// If non-empty, write a sidecar subtitle file in this format (see the Subtitles constants) showing the wall-clock
+	// time of each second of each partition
+	Subtitles string
+
+	// If true (and CreateMP4), video and audio are muxed into separate files (.video.mp4 and .audio.m4a by default)
+	// rather than together
+	SplitTracks bool
+
+	// If non-zero, only this part of each partition is extracted (starting at a keyframe, so without re-encoding)
+	Trim Trim
+
+	// If true, a JPEG still of each partition's video is written alongside its outputs, taken ThumbnailOffset into the
+	// partition
+	Thumbnail       bool
+	ThumbnailOffset time.Duration
+
+	// If true (and CreateMP4), the subtitles are also embedded into the muxed output as a subtitle track
+	EmbedSubtitles bool
+
+	// If true, a partition whose video does not open with parameter sets has the most recent ones from an earlier
+	// partition of the file written at its start
+	ReuseParameterSets bool
+
+	// If non-empty, the checksum (see the Checksum constants) to compute of every output, recorded in the results and
+	// in a sidecar file alongside each output
+	Checksum string
+
+	// If true, the modification time of every output is set to the start of its partition
+	PreserveMtime bool
+
+	// If true, every video track is extracted (ignoring VideoTrack) into its own outputs, named with a suffix for the
+	// track (e.g. _main or _sub)
+	AllVideoTracks bool
+
+	// Where the start timecode of each file comes from (see the TimecodeSource constants); empty means the first frame
+	TimecodeSource string
+
+	// Credentials for downloading inputs that are http(s):// URLs
+	Download DownloadOptions
+
+	// The suffix for the track being extracted (with AllVideoTracks)
+	videoTrackLabel string
+
+	// If true, files are only analysed (so the .ubv itself is not needed if there is a pre-prepared analysis)
+	analysisOnly bool
+
+	// The folder the outputs of the file being extracted go to (see outputFolderFor)
+	outputFolder string
+}
+
+// The error for a file that has a pre-prepared analysis but is itself missing
+var errSourceMissing = errors.New("analysis cache present but source .ubv missing")
+
+// Video tracks shorter than this are presumed to be a low resolution substream
+const substreamMaxHeight = 720
+
+// Remuxes opts.Files, returning the outcome of every partition (and of every file that could not be analysed)
+func Remux(opts Options) ([]Result, error) {
+	return RemuxContext(context.Background(), opts)
+}
+
+// Remux, stopping early (removing any partially written output files) if ctx is cancelled
+func RemuxContext(ctx context.Context, opts Options) ([]Result, error) {
+	var results []Result
+
+	// The forced rate only takes effect if FFmpeg re-times the audio to it
+	if opts.ForceAudioRate > 0 {
+		opts.Mux.ResampleAudio = true
+	}
+
+	inputs, cleanup, err := resolveInputs(ctx, opts.Files, opts.Download)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	err = analyseFiles(ctx, opts, inputs, func(i int, analysis fileAnalysis) error {
+		fileResults, err := remuxAnalysedFile(ctx, opts, analysis)
+		recordMetrics(fileResults)
+
+		// Report the input as given rather than where it was spooled to
+		for j := range fileResults {
+			fileResults[j].Source = opts.Files[i]
+		}
+
+		results = append(results, fileResults...)
+		return err
+	})
+
+	return results, err
+}
+
+// Extracts the partitions of an analysed file. Only returns an error if opts.Strict and analysis failed
+func remuxAnalysedFile(ctx context.Context, opts Options, analysis fileAnalysis) ([]Result, error) {
+	ubvFile := analysis.ubvFile
+	info, videoTrackNum, audioTrackNum := analysis.info, analysis.videoTrackNum, analysis.audioTrackNum
+
+	if err := analysis.err; err != nil {
+		if opts.Strict {
+			return nil, fmt.Errorf("analysis of %s failed: %w", ubvFile, err)
+		}
+
+		logging.Warn("Analysis of ", ubvFile, " failed, skipping: ", err)
+		return []Result{fileFailedResult(ubvFile, err.Error())}, nil
+	}
+
+	// Every output of the file goes to the same folder, so a folder that cannot be resolved fails the whole file
+	outputFolder, err := opts.outputFolderFor(info)
+	if err != nil {
+		logging.Error("Could not resolve the output folder for ", ubvFile, ", skipping: ", err)
+		return []Result{fileFailedResult(ubvFile, err.Error())}, nil
+	}
+	opts.outputFolder = outputFolder
+
+	// Optionally apply the user's forced framerate
+	if opts.ForceRate > 0 {
+		logging.Info("\nFramerate forced by user instruction: using ", opts.ForceRate, " fps")
+		for _, partition := range info.Partitions {
+			for _, track := range partition.Tracks {
+				if track.IsVideo {
+					track.Rate = opts.ForceRate
+				}
+			}
+		}
+	}
+
+	if opts.ForceAudioRate > 0 {
+		logging.Info("\nAudio rate forced by user instruction: using ", opts.ForceAudioRate, " Hz")
+		for _, partition := range info.Partitions {
+			for _, track := range partition.Tracks {
+				if !track.IsVideo && !track.Unsupported {
+					track.Rate = opts.ForceAudioRate
+				}
+			}
+		}
+	}
+
+	var results []Result
+	if opts.AllVideoTracks {
+		trackNums, labels := videoTrackLabels(info)
+		for _, trackNum := range trackNums {
+			logging.Infof("\nExtracting video track %d (%s)", trackNum, labels[trackNum])
+
+			trackOpts := opts
+			trackOpts.videoTrackLabel = labels[trackNum]
+			results = append(results, extractVideoTrack(ctx, trackOpts, info, trackNum, audioTrackNum)...)
+
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	} else {
+		results = extractVideoTrack(ctx, opts, info, videoTrackNum, audioTrackNum)
+	}
+
+	if opts.PreserveMtime && !opts.DryRun {
+		for _, result := range results {
+			setOutputTimes(result)
+		}
+	}
+
+	if len(opts.Checksum) > 0 && !opts.DryRun {
+		for i := range results {
+			writeChecksums(&results[i])
+		}
+	}
+
+	return results, nil
+}
+
+// Extracts the selected partitions of an analysed file with the given video track (concatenating them if requested)
+func extractVideoTrack(ctx context.Context, opts Options, info ubv.UbvFile, videoTrackNum int, audioTrackNum int) []Result {
+	ubvFile := info.Filename
+
+	// Partitions abandoned during parsing cannot be extracted, so are reported as failed
+	var abandoned []Result
+	var partitions []*ubv.UbvPartition
+	for _, partition := range opts.Filter.apply(info.Partitions, videoTrackNum) {
+		if len(partition.Abandoned) > 0 {
+			abandoned = append(abandoned, failedResult(ubvFile, partition, videoTrackNum, "abandoned during analysis: "+partition.Abandoned))
+		} else {
+			partitions = append(partitions, partition)
+		}
+	}
+
+	logging.Infof("\n\nExtracting %d of %d partitions", len(partitions), len(info.Partitions))
+
+	if !opts.Trim.isZero() {
+		for i, partition := range partitions {
+			partitions[i] = opts.Trim.apply(partition, videoTrackNum)
+		}
+	}
+
+	if opts.concatenates() && len(partitions) > 0 {
+		if output := concatenatedOutput(opts, info, partitions, videoTrackNum); opts.NoClobber && outputsExist(true, output, "", "") {
+			logging.Info("Skipping ", ubvFile, ": concatenated output already exists (-no-clobber)")
+
+			row := newResult(ubvFile, partitions[0], videoTrackNum, output)
+			row.Partition = -1
+			row.Status = StatusSkipped
+			row.Reason = "output already exists"
+			return append(abandoned, row)
+		}
+	}
+
+	results := runPartitionJobs(partitions, opts.Jobs, func(partition *ubv.UbvPartition) Result {
+		return extractPartition(ctx, opts, info, videoTrackNum, audioTrackNum, partition)
+	})
+
+	if opts.concatenates() && len(partitions) > 0 && ctx.Err() == nil {
+		results = concatenatePartitions(ctx, opts, info, videoTrackNum, partitions, results)
+	}
+
+	return append(abandoned, results...)
+}
+
+// Analyses opts.Files without extracting anything, returning a summary of each file that could be analysed. Stops
+// early, returning ctx.Err(), if ctx is cancelled
+func Analyse(ctx context.Context, opts Options) ([]ubv.FileSummary, error) {
+	var summaries []ubv.FileSummary
+
+	opts.analysisOnly = true
+
+	inputs, cleanup, err := resolveInputs(ctx, opts.Files, opts.Download)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	err = analyseFiles(ctx, opts, inputs, func(i int, analysis fileAnalysis) error {
+		input := opts.Files[i]
+		if analysis.err != nil {
+			if opts.Strict {
+				return fmt.Errorf("analysis of %s failed: %w", input, analysis.err)
+			}
+
+			logging.Warn("Analysis of ", input, " failed, skipping: ", analysis.err)
+			return nil
+		}
+
+		summary := ubv.Summarise(analysis.info)
+		summary.Filename = input
+		summaries = append(summaries, summary)
+		return nil
+	})
+
+	return summaries, err
+}
+
+// Analyses a single file and resolves the video and audio tracks to extract from it
+func analyseFile(ctx context.Context, ubvFile string, opts Options) (ubv.UbvFile, int, int, error) {
+	logging.Info("Analysing ", ubvFile)
+
+	// The pre-prepared analysis would be read happily, only for demuxing to fail much later on
+	_, err := os.Stat(ubvFile)
+	sourceMissing := os.IsNotExist(err)
+	if sourceMissing && !opts.analysisOnly && ubv.HasCachedAnalysis(ubvFile) {
+		return ubv.UbvFile{}, 0, 0, fmt.Errorf("%w: %s", errSourceMissing, ubvFile)
+	}
+
+	// ubnt_ubvinfo is limited to the selected video track if it is known up front (which would hide the others)
+	videoTrackFilter := opts.VideoTrack.KnownNumber()
+	if opts.AllVideoTracks {
+		videoTrackFilter = 0
+	}
+
+	analysisStart := time.Now()
+	info, err := ubv.Analyse(ctx, ubvFile, opts.ExtractAudio, videoTrackFilter)
+	analysisDuration.Observe(time.Since(analysisStart).Seconds())
+	if err != nil {
+		return info, 0, 0, err
+	}
+
+	if opts.TimecodeSource == TimecodeSourceFilename {
+		useFilenameTimecodes(info)
+	} else {
+		correctImplausibleTimecodes(info)
+	}
+
+	videoTrackNum := opts.VideoTrack.Resolve(info, true, probeResolution)
+	if opts.VideoTrack.KnownNumber() == 0 {
+		logging.Info("Video track ", opts.VideoTrack, " resolved to track ", videoTrackNum)
+	}
+
+	audioTrackNum := opts.AudioTrack.Resolve(info, false, nil)
+	if opts.ExtractAudio && opts.AudioTrack.KnownNumber() == 0 {
+		logging.Info("Audio track ", opts.AudioTrack, " resolved to track ", audioTrackNum)
+	}
+
+	logging.Debugf("\n\nAnalysis complete!\n")
+	if len(info.Partitions) > 0 {
+		logging.Debugf("First Partition:")
+		logging.Debugf("\tTracks: %d", len(info.Partitions[0].Tracks))
+		logging.Debugf("\tFrames: %d", len(info.Partitions[0].Frames))
+
+		for _, track := range info.Partitions[0].Tracks {
+			if track.IsVideo || info.Partitions[0].VideoTrackCount == 0 {
+				logging.Debugf("\tStart Timecode: %s", track.StartTimecode.Format(time.RFC3339))
+				break
+			}
+		}
+	}
+
+	logTimeline(info)
+	if !opts.analysisOnly {
+		// -analyse-only prints these itself
+		logEstimates(info)
+	}
+	logDurationMismatches(info, opts.ForceRate)
+
+	// Both of these read frames from the .ubv, so can only be done if it is present
+	if opts.ExtractVideo && !sourceMissing && len(info.Partitions) > 0 && info.Partitions[0].VideoTrackCount > 0 {
+		logVideoResolution(info, videoTrackNum)
+	}
+
+	if opts.ExtractAudio && !sourceMissing && audioTrackNum > 0 {
+		detectAudioCodec(info, audioTrackNum)
+		detectAudioChannels(info, audioTrackNum)
+	}
+
+	return info, videoTrackNum, audioTrackNum, nil
+}
+
+// Logs the wall-clock span of each partition and the gaps between them
+func logTimeline(info ubv.UbvFile) {
+	gaps := ubv.PartitionGaps(info)
+
+	logging.Info("Timeline:")
+	for i, partition := range info.Partitions {
+		start, end, ok := ubv.PartitionSpan(partition)
+		if !ok {
+			logging.Infof("\tPartition %d: no timecodes", partition.Index)
+			continue
+		}
+
+		line := fmt.Sprintf("\tPartition %d: %s for %s", partition.Index, start.Format(time.RFC3339), end.Sub(start))
+		if i < len(gaps) {
+			line += fmt.Sprintf(", then a gap of %s", gaps[i])
+		}
+		logging.Info(line)
+	}
+}
+
+// Warns about video tracks whose frame count and rate do not add up to their wall-clock duration, which usually means
+// the probed rate is wrong. Skipped if the rate is being forced anyway, or for timelapses (which are meant to play faster)
+func logDurationMismatches(info ubv.UbvFile, forceRate int) {
+	if forceRate > 0 || info.IsTimelapse() {
+		return
+	}
+
+	for _, partition := range info.Partitions {
+		for _, track := range sortedTracks(partition) {
+			if track.IsVideo && track.DurationMismatch() {
+				logging.Warnf("WARNING: partition %d video track %d has %d frames at %d fps (%s) but spans %s; the framerate is probably wrong, use -force-rate",
+					partition.Index, track.TrackNumber, track.FrameCount, track.Rate, track.ExpectedDuration(), track.Duration())
+			}
+		}
+	}
+}
+
+// Records the codec of the selected audio track on each partition's copy of it, sniffing the audio itself and otherwise
+// trusting the track registry; tracks still of unknown codec are assumed to be AAC
+func detectAudioCodec(info ubv.UbvFile, audioTrackNum int) {
+	var tracks []*ubv.UbvTrack
+	codec := ubv.CodecUnknown
+	probed := false
+	for _, partition := range info.Partitions {
+		track, ok := partition.Tracks[audioTrackNum]
+		if !ok || track.IsVideo {
+			continue
+		}
+		tracks = append(tracks, track)
+
+		if probed {
+			continue
+		}
+		probed = true
+		codec = track.Codec
+
+		if sniffed, err := demux.ProbeAudioCodec(info.Filename, partition, audioTrackNum); err != nil {
+			logging.Debug("Could not sniff the codec of audio track ", audioTrackNum, ": ", err)
+		} else {
+			if codec != ubv.CodecUnknown && codec != sniffed {
+				logging.Warnf("Warning: audio track %d looks like %s rather than the expected %s, treating it as %s", audioTrackNum, sniffed, codec, sniffed)
+			}
+			codec = sniffed
+		}
+	}
+
+	if len(tracks) == 0 {
+		return
+	}
+
+	if codec == ubv.CodecUnknown {
+		logging.Warnf("WARNING: could not determine the codec of audio track %d, assuming %s. If the audio is broken, please report this", audioTrackNum, ubv.DefaultAudioCodec)
+		codec = ubv.DefaultAudioCodec
+	}
+
+	for _, track := range tracks {
+		track.Codec = codec
+	}
+
+	logging.Infof("Audio Codec: %s (track %d)", codec, audioTrackNum)
+}
+
+// Records the channel count of the selected audio track (probed from its first partition) on each partition's copy of
+// it, so that ADTS headers declare the right layout and -audio-channels only re-encodes when it changes something
+func detectAudioChannels(info ubv.UbvFile, audioTrackNum int) {
+	var tracks []*ubv.UbvTrack
+	channels := 0
+	for _, partition := range info.Partitions {
+		track, ok := partition.Tracks[audioTrackNum]
+		if !ok || track.IsVideo {
+			continue
+		}
+		tracks = append(tracks, track)
+
+		if len(tracks) > 1 {
+			continue
+		}
+
+		var err error
+		if channels, err = demux.ProbeAudioChannels(info.Filename, partition, audioTrackNum, track.Codec); err != nil {
+			logging.Debug("Could not determine the channels of audio track ", audioTrackNum, ": ", err)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return
+	} else if channels == 0 {
+		logging.Infof("Audio Channels: unknown (track %d)", audioTrackNum)
+		return
+	}
+
+	for _, track := range tracks {
+		track.Channels = channels
+	}
+
+	logging.Infof("Audio Channels: %s (track %d)", channelLayout(channels), audioTrackNum)
+}
+
+// The usual name of the layout with this many channels (e.g. stereo), or else the number itself
+func channelLayout(channels int) string {
+	switch channels {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	case 6:
+		return "5.1"
+	case 8:
+		return "7.1"
+	default:
+		return strconv.Itoa(channels)
+	}
+}
+
+// Reads the dimensions of a video track from its SPS, so that -video-track auto can pick the highest resolution
+func probeResolution(filename string, partition *ubv.UbvPartition, trackNumber int) (int, int, bool) {
+	resolution, err := demux.ProbeResolution(filename, partition, trackNumber)
+	if err != nil {
+		logging.Debug("Could not determine the resolution of video track ", trackNumber, ": ", err)
+		return 0, 0, false
+	}
+
+	return resolution.Width, resolution.Height, true
+}
+
+// Reads the resolution of the selected video track from its SPS, warning if it looks like a substream
+func logVideoResolution(info ubv.UbvFile, videoTrackNum int) {
+	resolution, err := demux.ProbeResolution(info.Filename, info.Partitions[0], videoTrackNum)
+	if err != nil {
+		logging.Warn("Could not determine the resolution of video track ", videoTrackNum, ": ", err)
+		return
+	}
+
+	logging.Infof("Video Resolution: %s (track %d)", resolution, videoTrackNum)
+	if resolution.Height < substreamMaxHeight {
+		logging.Warnf("WARNING: video track %d is only %s, which looks like a substream rather than the main stream! Check -video-track", videoTrackNum, resolution)
+	}
+}
+
+// Demuxes (and optionally muxes) a single partition according to opts
+func extractPartition(ctx context.Context, opts Options, info ubv.UbvFile, videoTrackNum int, audioTrackNum int, partition *ubv.UbvPartition) Result {
+	ubvFile := info.Filename
+
+	var videoFile string
+	var audioFile string
+	var subtitleFile string
+	var thumbnail string
+	var mp4 string
+	var audioMP4 string // only with SplitTracks
+	outputFolder := opts.outputFolder
+	{
+		basename := outputBasename(opts, info, partition, videoTrackNum)
+
+		// Tracks without frames are skipped rather than producing separator-only bitstreams
+		if track, ok := partition.Tracks[videoTrackNum]; opts.ExtractVideo && ok && track.IsVideo && track.FrameCount > 0 {
+			videoFile = basename + videoExtension(partition, videoTrackNum)
+		}
+
+		if track, ok := partition.Tracks[audioTrackNum]; opts.ExtractAudio && ok && track.FrameCount > 0 {
+			audioFile = basename + ubv.AudioExtension(track.Codec)
+		}
+
+		if len(opts.Subtitles) > 0 {
+			subtitleFile = basename + "." + opts.Subtitles
+		}
+
+		if opts.Thumbnail && len(videoFile) > 0 {
+			thumbnail = basename + ".jpg"
+		}
+
+		if opts.concatenates() {
+			// Only an intermediate: the concatenated output takes the first partition's name
+			mp4 = basename + ".part" + strconv.Itoa(partition.Index) + "." + opts.Mux.Extension(len(videoFile) > 0)
+		} else if opts.CreateMP4 && opts.SplitTracks && len(videoFile) > 0 && len(audioFile) > 0 {
+			mp4 = basename + ".video." + opts.Mux.Extension(true)
+			audioMP4 = basename + ".audio." + opts.Mux.Extension(false)
+		} else if opts.CreateMP4 {
+			mp4 = basename + "." + opts.Mux.Extension(len(videoFile) > 0)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return cancelledResult(ubvFile, partition, videoTrackNum)
+	}
+
+	if len(videoFile) == 0 && len(audioFile) == 0 {
+		logging.Info("Partition ", partition.Index, " has no frames in the selected tracks, skipping")
+
+		row := newResult(ubvFile, partition, videoTrackNum, "")
+		row.Reason = "no frames in the selected tracks"
+		return row
+	}
+
+	if opts.DryRun {
+		printDryRun(partition, videoTrackNum, audioTrackNum, videoFile, audioFile, mp4)
+		if len(audioMP4) > 0 {
+			fmt.Printf("\tOutput: %s\n", audioMP4)
+		}
+		if len(thumbnail) > 0 {
+			fmt.Printf("\tThumbnail: %s\n", thumbnail)
+		}
+
+		row := newResult(ubvFile, partition, videoTrackNum, "")
+		row.Reason = "dry run"
+		return row
+	}
+
+	if opts.NoClobber && !opts.concatenates() && outputsExist(opts.CreateMP4, mp4, videoFile, audioFile) && (len(audioMP4) == 0 || outputsExist(true, audioMP4, "", "")) {
+		logging.Info("Skipping partition ", partition.Index, ": output already exists (-no-clobber)")
+
+		row := newResult(ubvFile, partition, videoTrackNum, firstNonEmpty(mp4, videoFile, audioFile))
+		row.Status = StatusSkipped
+		row.Reason = "output already exists"
+		return row
+	}
+
+	// The output folder (e.g. a dated subfolder, or a mirrored one) may not exist yet
+	if err := os.MkdirAll(outputFolder, 0755); err != nil {
+		logging.Errorf("Partition %d of %s failed: could not create output folder %s: %v", partition.Index, ubvFile, outputFolder, err)
+		return failedResult(ubvFile, partition, videoTrackNum, fmt.Sprintf("could not create output folder %s: %v", outputFolder, err))
+	}
+
+	if opts.VerifyNAL && len(videoFile) > 0 {
+		verification, err := demux.VerifyPartitionNALs(ubvFile, partition, videoTrackNum)
+
+		if err != nil {
+			logging.Errorf("Partition %d of %s failed NAL verification: %v", partition.Index, ubvFile, err)
+			return failedResult(ubvFile, partition, videoTrackNum, err.Error())
+		} else if verification.BadFrames > 0 {
+			logging.Warnf("WARNING: Partition %d failed NAL verification: %s", partition.Index, verification)
+		} else {
+			logging.Infof("Partition %d passed NAL verification: %s", partition.Index, verification)
+		}
+	}
+
+	demuxOptions := opts.Demux
+	if opts.ReuseParameterSets && len(videoFile) > 0 {
+		demuxOptions.FallbackParameterSets = earlierParameterSets(info, partition, videoTrackNum)
+	}
+
+	muxOptions := muxOptionsFor(opts, info)
+	if len(subtitleFile) > 0 {
+		if err := writeTimecodeSubtitles(subtitleFile, opts.Subtitles, partition, videoTrackNum); err != nil {
+			logging.Warn("Warning: could not write subtitles ", subtitleFile+": ", err)
+			os.Remove(subtitleFile)
+		} else if opts.EmbedSubtitles && len(videoFile) > 0 {
+			muxOptions.Subtitles = subtitleFile
+		}
+	}
+
+	if len(thumbnail) > 0 {
+		if err := writeThumbnail(ctx, opts, ubvFile, partition, videoTrackNum, thumbnail); ctx.Err() != nil {
+			return cancelledResult(ubvFile, partition, videoTrackNum, subtitleFile, thumbnail)
+		} else if err != nil {
+			logging.Warn("Warning: could not write thumbnail ", thumbnail+": ", err)
+		}
+	}
+
+	if opts.Pipe {
+		row := pipePartition(ctx, ubvFile, partition, videoTrackNum, audioTrackNum, videoFile, audioFile, mp4, demuxOptions, muxOptions)
+		return describeOutputs(row, videoTrackNum, audioTrackNum, videoFile, audioFile, mp4, subtitleFile, thumbnail)
+	}
+
+	// Demux .ubv into .h264/.h265 (and optionally .aac/.opus) atomic streams
+	report, err := demux.DemuxSinglePartitionToNewFiles(ctx, ubvFile, videoFile, videoTrackNum, audioFile, audioTrackNum, partition, demuxOptions)
+	if ctx.Err() != nil {
+		return cancelledResult(ubvFile, partition, videoTrackNum, videoFile, audioFile, subtitleFile, thumbnail)
+	} else if err != nil {
+		logging.Errorf("Partition %d of %s failed to demux: %v", partition.Index, ubvFile, err)
+		return failedResult(ubvFile, partition, videoTrackNum, err.Error(), videoFile, audioFile, subtitleFile, thumbnail)
+	}
+
+	if len(videoFile) > 0 {
+		logging.Debugf("Partition %d video NALs: %s", partition.Index, report)
+	}
+
+	if opts.CreateMP4 {
+		logging.Info("\nWriting ", strings.ToUpper(opts.Mux.Extension(len(videoFile) > 0)), " ", mp4, "...")
+
+		// Spawn FFmpeg to remux
+		if len(audioMP4) > 0 {
+			err = ffmpegutil.MuxVideoOnly(ctx, partition, videoFile, videoTrackNum, mp4, muxOptions)
+			if err == nil {
+				logging.Info("\nWriting ", strings.ToUpper(opts.Mux.Extension(false)), " ", audioMP4, "...")
+				err = ffmpegutil.MuxAudioOnly(ctx, partition, audioFile, audioTrackNum, audioMP4, muxOptions)
+			}
+		} else {
+			err = ffmpegutil.MuxAudioAndVideo(ctx, partition, videoFile, videoTrackNum, audioFile, audioTrackNum, mp4, muxOptions)
+		}
+		if ctx.Err() != nil {
+			return cancelledResult(ubvFile, partition, videoTrackNum, videoFile, audioFile, subtitleFile, thumbnail, mp4, audioMP4)
+		} else if err != nil {
+			// The intermediate bitstreams are kept so the mux can be investigated (or retried by hand)
+			return muxFailedResult(ubvFile, partition, videoTrackNum, err, mp4, audioMP4)
+		}
+
+		// Delete
+		if opts.KeepIntermediate {
+			logging.Info("Keeping intermediate bitstream files (-keep-intermediate)")
+		} else {
+			if len(videoFile) > 0 {
+				if err := os.Remove(videoFile); err != nil {
+					logging.Warn("Warning: could not delete ", videoFile+": ", err)
+				}
+			}
+			if len(audioFile) > 0 {
+				if err := os.Remove(audioFile); err != nil {
+					logging.Warn("Warning: could not delete ", audioFile+": ", err)
+				}
+			}
+		}
+	}
+
+	row := newResult(ubvFile, partition, videoTrackNum, firstNonEmpty(mp4, videoFile, audioFile))
+	return describeOutputs(row, videoTrackNum, audioTrackNum, videoFile, audioFile, mp4, audioMP4, subtitleFile, thumbnail)
+}
+
+// The most recent parameter sets on the video track in the partitions of the file before this one (nil if there are none)
+func earlierParameterSets(info ubv.UbvFile, partition *ubv.UbvPartition, videoTrackNum int) [][]byte {
+	var earlier []*ubv.UbvPartition
+	for _, p := range info.Partitions {
+		if p.Index < partition.Index {
+			earlier = append(earlier, p)
+		}
+	}
+
+	parameterSets, err := demux.FindParameterSets(info.Filename, earlier, videoTrackNum)
+	if err != nil {
+		logging.Warn("Warning: could not read parameter sets from earlier partitions of ", info.Filename, ": ", err)
+	} else if parameterSets != nil {
+		logging.Debugf("Partition %d: found %d parameter sets in earlier partitions", partition.Index, len(parameterSets))
+	}
+
+	return parameterSets
+}
+
+// Records which tracks a successfully processed partition was extracted from, and which of its possible outputs
+// (the bitstreams may have been muxed and removed, or never written when piping) exist
+func describeOutputs(row Result, videoTrackNum int, audioTrackNum int, videoFile string, audioFile string, files ...string) Result {
+	if row.Status != StatusOK {
+		return row
+	}
+
+	if len(videoFile) > 0 {
+		row.VideoTrack = videoTrackNum
+	}
+	if len(audioFile) > 0 {
+		row.AudioTrack = audioTrackNum
+	}
+
+	for _, file := range append(files, videoFile, audioFile) {
+		if len(file) == 0 {
+			continue
+		} else if _, err := os.Stat(file); err == nil {
+			row.Files = append(row.Files, file)
+		}
+	}
+
+	return row
+}
+
+// The output path of a partition, minus extension
+func outputBasename(opts Options, info ubv.UbvFile, partition *ubv.UbvPartition, videoTrackNum int) string {
+	nameTemplate := opts.NameTemplate
+	if len(nameTemplate) == 0 {
+		nameTemplate = DefaultNameTemplate
+	}
+
+	// The unixtime in the filename is replaced with the start timecode of the partition (by default)
+	outputFolder := opts.outputFolder
+	basename := expandNameTemplate(nameTemplate, info.ProtectFilename, partition, getStartTimecode(partition, videoTrackNum))
+	if len(opts.videoTrackLabel) > 0 {
+		basename += "_" + opts.videoTrackLabel
+	}
+
+	return outputFolder + "/" + basename
+}
+
+// Whether the outputs of a partition already exist with non-zero length: the muxed file if muxing, otherwise the
+// raw bitstreams
+func outputsExist(createMP4 bool, mp4 string, videoFile string, audioFile string) bool {
+	var targets []string
+	if createMP4 {
+		targets = []string{mp4}
+	} else {
+		for _, file := range []string{videoFile, audioFile} {
+			if len(file) > 0 {
+				targets = append(targets, file)
+			}
+		}
+	}
+
+	for _, target := range targets {
+		if stat, err := os.Stat(target); err != nil || stat.Size() == 0 {
+			return false
+		}
+	}
+
+	return len(targets) > 0
+}
+
+// Removes the (partially written) outputs of a cancelled partition and reports it as failed
+func cancelledResult(ubvFile string, partition *ubv.UbvPartition, videoTrackNum int, files ...string) Result {
+	return failedResult(ubvFile, partition, videoTrackNum, "cancelled", files...)
+}
+
+// Logs why FFmpeg failed for a partition, removes any outputs it did write and reports it as failed
+func muxFailedResult(ubvFile string, partition *ubv.UbvPartition, videoTrackNum int, err error, files ...string) Result {
+	logging.Errorf("Partition %d of %s failed: %v", partition.Index, ubvFile, err)
+
+	return failedResult(ubvFile, partition, videoTrackNum, err.Error(), files...)
+}
+
+// Removes files and reports a partition as failed for reason
+func failedResult(ubvFile string, partition *ubv.UbvPartition, videoTrackNum int, reason string, files ...string) Result {
+	for _, file := range files {
+		if len(file) == 0 {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logging.Warn("Warning: could not delete ", file+": ", err)
+		}
+	}
+
+	row := newResult(ubvFile, partition, videoTrackNum, "")
+	row.Status = StatusFailed
+	row.Reason = reason
+	return row
+}
+
+// Reports a whole file as failed for reason, before any of its partitions were extracted
+func fileFailedResult(ubvFile string, reason string) Result {
+	return Result{
+		Source:    ubvFile,
+		Partition: -1,
+		Status:    StatusFailed,
+		Reason:    reason,
+	}
+}
+
+// Prints what extracting a partition would produce
+func printDryRun(partition *ubv.UbvPartition, videoTrackNum int, audioTrackNum int, videoFile string, audioFile string, mp4 string) {
+	var videoFrames, videoBytes, audioFrames, audioBytes int
+	for _, frame := range partition.Frames {
+		if frame.TrackNumber == videoTrackNum {
+			videoFrames++
+			videoBytes += frame.Size
+		} else if frame.TrackNumber == audioTrackNum {
+			audioFrames++
+			audioBytes += frame.Size
+		}
+	}
+
+	fmt.Printf("Partition %d (start %s)\n", partition.Index, getStartTimecode(partition, videoTrackNum).Format(time.RFC3339))
+	if len(videoFile) > 0 {
+		fmt.Printf("\tVideo: %s (%d frames, %d bytes)\n", videoFile, videoFrames, videoBytes)
+	}
+	if len(audioFile) > 0 {
+		fmt.Printf("\tAudio: %s (%d frames, %d bytes)\n", audioFile, audioFrames, audioBytes)
+	}
+	if len(mp4) > 0 {
+		fmt.Printf("\tOutput: %s\n", mp4)
+	}
+}
+
+// The mux options for the outputs of a file, titled after the camera if the filename identifies it
+func muxOptionsFor(opts Options, info ubv.UbvFile) ffmpegutil.MuxOptions {
+	muxOptions := opts.Mux
+
+	if len(muxOptions.Title) == 0 && len(info.Mac) > 0 {
+		muxOptions.Title = info.Mac + " channel " + info.Channel
+	}
+
+	return muxOptions
+}
+
+// Demuxes a partition straight into FFmpeg, without writing the intermediate video/audio files (whose names are only
+// used to indicate which streams to extract)
+func pipePartition(ctx context.Context, ubvFile string, partition *ubv.UbvPartition, videoTrackNum int, audioTrackNum int, videoFile string, audioFile string, mp4 string, demuxOptions demux.DemuxOptions, muxOptions ffmpegutil.MuxOptions) Result {
+	var report demux.DemuxReport
+	var writeVideo func(io.Writer)
+	var writeAudio func(io.Writer)
+
+	// Each is only set by its own writer, and read once MuxFromPipes has waited for both
+	var videoErr, audioErr error
+	if len(videoFile) > 0 {
+		writeVideo = func(w io.Writer) {
+			report, videoErr = demux.DemuxSinglePartitionToWriters(ctx, ubvFile, partition, bufio.NewWriter(w), videoTrackNum, nil, 0, demuxOptions)
+		}
+	}
+	if len(audioFile) > 0 {
+		writeAudio = func(w io.Writer) {
+			_, audioErr = demux.DemuxSinglePartitionToWriters(ctx, ubvFile, partition, nil, videoTrackNum, bufio.NewWriter(w), audioTrackNum, demuxOptions)
+		}
+	}
+
+	logging.Info("\nPiping to ", strings.ToUpper(muxOptions.Extension(len(videoFile) > 0)), " ", mp4, "...")
+
+	err := ffmpegutil.MuxFromPipes(ctx, partition, videoTrackNum, audioTrackNum, writeVideo, writeAudio, mp4, muxOptions)
+	if ctx.Err() != nil {
+		return cancelledResult(ubvFile, partition, videoTrackNum, mp4)
+	} else if err != nil {
+		return muxFailedResult(ubvFile, partition, videoTrackNum, err, mp4)
+	}
+
+	// FFmpeg happily muxes whatever it was given, so a demux that stopped early must fail the output
+	for _, demuxErr := range []error{videoErr, audioErr} {
+		if demuxErr != nil {
+			logging.Errorf("Partition %d of %s failed to demux: %v", partition.Index, ubvFile, demuxErr)
+			return failedResult(ubvFile, partition, videoTrackNum, demuxErr.Error(), mp4)
+		}
+	}
+
+	if writeVideo != nil {
+		logging.Debugf("Partition %d video NALs: %s", partition.Index, report)
+	}
+
+	return newResult(ubvFile, partition, videoTrackNum, mp4)
+}
+
+// Runs extract for every partition using up to jobs concurrent workers, returning the results in partition order
+func runPartitionJobs(partitions []*ubv.UbvPartition, jobs int, extract func(*ubv.UbvPartition) Result) []Result {
+	results := make([]Result, len(partitions))
+
+	if jobs <= 1 {
+		for i, partition := range partitions {
+			results[i] = extract(partition)
+		}
+
+		return results
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < jobs; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = extract(partitions[i])
+			}
+		}()
+	}
+
+	for i := range partitions {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+
+	return results
+}
+
+// The raw bitstream extension for the selected video track (.h265 for HEVC, otherwise .h264)
+func videoExtension(partition *ubv.UbvPartition, videoTrackNum int) string {
+	if track, ok := partition.Tracks[videoTrackNum]; ok && track.Codec == ubv.CodecHEVC {
+		return ".h265"
+	}
+
+	return ".h264"
+}
+
+// Determines the folder to write outputs for a given .ubv file to
+func resolveOutputFolder(outputFolder string, ubvFile string, mirrorRoot string) (string, error) {
+	outputFolder = strings.TrimSuffix(outputFolder, "/")
+
+	if outputFolder == "SRC-FOLDER" {
+		return path.Dir(ubvFile), nil
+	} else if len(mirrorRoot) == 0 {
+		return outputFolder, nil
+	}
+
+	// Recreate the directory structure below the input root under the output folder
+	root, err := filepath.Abs(mirrorRoot)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve -mirror-tree root %s: %w", mirrorRoot, err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(ubvFile))
+	if err != nil {
+		return "", fmt.Errorf("could not resolve folder of %s: %w", ubvFile, err)
+	}
+
+	relative, err := filepath.Rel(root, dir)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		logging.Warn("Warning: ", ubvFile, " is not under -mirror-tree root ", mirrorRoot, ", writing directly to ", outputFolder)
+		return outputFolder, nil
+	}
+
+	return filepath.Join(outputFolder, relative), nil
+}
+
+// The folder to write the outputs of a file to: the resolved output folder, plus the camera's subfolder if GroupByCamera
+// (files whose names do not carry a MAC are not grouped)
+func (opts Options) outputFolderFor(info ubv.UbvFile) (string, error) {
+	outputFolder, err := resolveOutputFolder(opts.OutputFolder, info.Filename, opts.MirrorRoot)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.GroupByCamera && len(info.Mac) > 0 {
+		return filepath.Join(outputFolder, info.Mac), nil
+	}
+
+	return outputFolder, nil
+}
+
+// Sets the modification (and access) time of every file a successful result produced to the start of its recording,
+// for tools that sort by filesystem timestamps
+func setOutputTimes(result Result) {
+	if result.Status != StatusOK || result.Start.IsZero() {
+		return
+	}
+
+	for _, file := range result.Files {
+		if err := os.Chtimes(file, result.Start, result.Start); err != nil {
+			logging.Warn("Warning: could not set the modification time of ", file, ": ", err)
+		}
+	}
+}
+
+// Builds the report row for a processed partition based on the output it produced
+func newResult(ubvFile string, partition *ubv.UbvPartition, videoTrackNum int, output string) Result {
+	row := Result{
+		Source:    ubvFile,
+		Partition: partition.Index,
+		Output:    output,
+		Start:     getStartTimecode(partition, videoTrackNum),
+	}
+
+	for _, track := range partition.Tracks {
+		if partition.VideoTrackCount == 0 || (track.IsVideo && track.TrackNumber == videoTrackNum) {
+			row.DurationSeconds = track.LastTimecode.Sub(track.StartTimecode).Seconds()
+			break
+		}
+	}
+
+	if len(output) == 0 {
+		row.Status = StatusSkipped
+		row.Reason = "no output selected for this partition"
+	} else if stat, err := os.Stat(output); err != nil {
+		row.Status = StatusSkipped
+		row.Reason = "no output produced (stream empty?)"
+	} else {
+		row.Status = StatusOK
+		row.Size = stat.Size()
+	}
+
+	return row
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if len(value) > 0 {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func getStartTimecode(partition *ubv.UbvPartition, videoTrackNum int) time.Time {
+	for _, track := range partition.Tracks {
+		if partition.VideoTrackCount == 0 || (track.IsVideo && track.TrackNumber == videoTrackNum) {
+			return track.StartTimecode
+		}
+	}
+
+	// No start timecode available at all! Return the time of demux as a failsafe
+	return time.Now()
+}
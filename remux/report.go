@@ -0,0 +1,147 @@
+package remux
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// The outcome of processing a single partition, as written to the batch report
+type Result struct {
+	Source          string    `json:"source"`
+	Partition       int       `json:"partition"`
+	Status          string    `json:"status"`
+	Reason          string    `json:"reason,omitempty"`
+	Output          string    `json:"output,omitempty"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Size            int64     `json:"size"`
+
+	// The tracks extracted (0 if none)
+	VideoTrack int `json:"videoTrack,omitempty"`
+	AudioTrack int `json:"audioTrack,omitempty"`
+
+	// Every file produced, starting with Output (e.g. a kept bitstream or subtitles as well as the MP4)
+	Files []string `json:"files,omitempty"`
+
+	// The SHA-256 of each of Files, if checksums were requested
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// A file produced by a run, as written to the manifest
+type ManifestEntry struct {
+	File            string    `json:"file"`
+	Source          string    `json:"source"`
+	Partition       int       `json:"partition"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	VideoTrack      int       `json:"videoTrack,omitempty"`
+	AudioTrack      int       `json:"audioTrack,omitempty"`
+	Size            int64     `json:"size"`
+	SHA256          string    `json:"sha256,omitempty"`
+}
+
+// Lists every file produced according to results
+func Manifest(results []Result) []ManifestEntry {
+	entries := []ManifestEntry{}
+	for _, result := range results {
+		for _, file := range result.Files {
+			entry := ManifestEntry{
+				File:            file,
+				Source:          result.Source,
+				Partition:       result.Partition,
+				Start:           result.Start,
+				DurationSeconds: result.DurationSeconds,
+				VideoTrack:      result.VideoTrack,
+				AudioTrack:      result.AudioTrack,
+				SHA256:          result.Checksums[file],
+			}
+			if stat, err := os.Stat(file); err == nil {
+				entry.Size = stat.Size()
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Writes a manifest of the files produced according to results to manifestFile; JSON if the filename ends .json,
+// otherwise CSV
+func WriteManifest(manifestFile string, results []Result) error {
+	f, err := os.Create(manifestFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries := Manifest(results)
+
+	if strings.EqualFold(path.Ext(manifestFile), ".json") {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"file", "source", "partition", "start", "duration_seconds", "video_track", "audio_track", "size", "sha256"})
+	for _, entry := range entries {
+		w.Write([]string{
+			entry.File,
+			entry.Source,
+			strconv.Itoa(entry.Partition),
+			entry.Start.Format(time.RFC3339Nano),
+			strconv.FormatFloat(entry.DurationSeconds, 'f', 3, 64),
+			strconv.Itoa(entry.VideoTrack),
+			strconv.Itoa(entry.AudioTrack),
+			strconv.FormatInt(entry.Size, 10),
+			entry.SHA256,
+		})
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+// Writes a batch report of results to reportFile; JSON if the filename ends .json, otherwise CSV
+func WriteReport(reportFile string, rows []Result) error {
+	f, err := os.Create(reportFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(path.Ext(reportFile), ".json") {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"source", "partition", "status", "reason", "output", "duration_seconds", "size"})
+	for _, row := range rows {
+		w.Write([]string{
+			row.Source,
+			strconv.Itoa(row.Partition),
+			row.Status,
+			row.Reason,
+			row.Output,
+			strconv.FormatFloat(row.DurationSeconds, 'f', 3, 64),
+			strconv.FormatInt(row.Size, 10),
+		})
+	}
+	w.Flush()
+
+	return w.Error()
+}
@@ -0,0 +1,87 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"ubvremux/demux"
+	"ubvremux/ffmpegutil"
+	"ubvremux/ubv"
+)
+
+// The length of the sample generated by SelfTest
+const (
+	selfTestFrames = 10
+	selfTestRate   = 10
+)
+
+// Checks that FFmpeg can copy-mux what the demuxer produces: a tiny H.264 sample is generated in a temporary .ubv,
+// demuxed and muxed with opts (so the container and mux options are exercised too), reporting each step and the exact
+// FFmpeg command to out. Nothing is written outside the temporary folder, which is removed afterwards.
+func SelfTest(ctx context.Context, opts Options, out io.Writer) error {
+	ffmpeg, err := ffmpegutil.FindFfmpeg()
+	if err != nil {
+		return err
+	}
+	if version, err := ffmpegutil.Version(ffmpeg); err != nil {
+		fmt.Fprintf(out, "FFmpeg: %s (version unknown: %s)\n", ffmpeg, err)
+	} else if len(version) > 0 {
+		fmt.Fprintf(out, "FFmpeg: %s (%s)\n", ffmpeg, version)
+	} else {
+		fmt.Fprintf(out, "FFmpeg: %s\n", ffmpeg)
+	}
+
+	folder, err := ioutil.TempDir("", "ubvremux-selftest-")
+	if err != nil {
+		return fmt.Errorf("could not create a temporary folder: %w", err)
+	}
+	defer os.RemoveAll(folder)
+
+	ubvFile := filepath.Join(folder, "sample.ubv")
+	f, err := os.Create(ubvFile)
+	if err != nil {
+		return err
+	}
+	partition, err := demux.WriteSample(f, demux.SampleFrames(selfTestFrames), selfTestRate, time.Now().UTC().Truncate(time.Second))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write sample: %w", err)
+	}
+	fmt.Fprintf(out, "Generated sample: %d frames of 16x16 H.264 at %d fps\n", selfTestFrames, selfTestRate)
+
+	videoFile := filepath.Join(folder, "sample."+ubv.CodecH264)
+	report, err := demux.DemuxSinglePartitionToNewFiles(ctx, ubvFile, videoFile, ubv.TrackVideo, "", 0, partition, demux.DemuxOptions{})
+	if err != nil {
+		return fmt.Errorf("demux failed: %w", err)
+	}
+	fmt.Fprintf(out, "Demux: OK (%s)\n", report)
+
+	muxOpts := opts.Mux
+	var commands [][]string
+	muxOpts.OnCommand = func(args []string) {
+		commands = append(commands, args)
+	}
+
+	output := filepath.Join(folder, "sample."+muxOpts.Extension(true))
+	err = ffmpegutil.MuxVideoOnly(ctx, partition, videoFile, ubv.TrackVideo, output, muxOpts)
+
+	for _, command := range commands {
+		fmt.Fprintf(out, "FFmpeg command: %s\n", strings.Join(command, " "))
+	}
+
+	if err != nil {
+		return fmt.Errorf("mux failed: %w", err)
+	} else if stat, statErr := os.Stat(output); statErr != nil || stat.Size() == 0 {
+		return fmt.Errorf("mux failed: FFmpeg did not write %s", filepath.Base(output))
+	}
+	fmt.Fprintf(out, "Mux: OK\n")
+
+	return nil
+}
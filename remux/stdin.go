@@ -0,0 +1,85 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"ubvremux/logging"
+)
+
+// The input filename meaning "read the .ubv from stdin"
+const StdinFile = "-"
+
+// Resolves an input filename to a .ubv on disk, returning it along with a function to call once it is no longer
+// needed. Stdin is spooled to a temporary file first, since both ubnt_ubvinfo and the demuxer need to seek; URLs are
+// downloaded to one for the same reason
+func resolveInput(ctx context.Context, input string, download DownloadOptions) (string, func(), error) {
+	if IsURL(input) {
+		return downloadInput(ctx, input, download)
+	} else if strings.HasSuffix(strings.ToLower(input), ".ubv.txt") {
+		// A pre-prepared analysis given directly stands for the .ubv it describes (which may not be present)
+		return input[:len(input)-len(".txt")], func() {}, nil
+	} else if input != StdinFile {
+		return input, func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "ubvremux-stdin-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logging.Warn("Warning: could not delete spooled stdin ", dir+": ", err)
+		}
+	}
+
+	// Outputs are named after the input, so give the spooled file a meaningful name
+	filename := filepath.Join(dir, "stdin.ubv")
+
+	f, err := os.Create(filename)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	logging.Info("Reading .ubv from stdin into ", filename)
+	written, err := io.Copy(f, os.Stdin)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	logging.Debug("Read ", written, " bytes from stdin")
+
+	return filename, cleanup, nil
+}
+
+// resolveInput for every input, returning a single function that cleans up after all of them
+func resolveInputs(ctx context.Context, inputs []string, download DownloadOptions) ([]string, func(), error) {
+	var ubvFiles []string
+	var cleanups []func()
+	cleanup := func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+
+	for _, input := range inputs {
+		ubvFile, inputCleanup, err := resolveInput(ctx, input, download)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("could not read %s: %w", input, err)
+		}
+
+		ubvFiles = append(ubvFiles, ubvFile)
+		cleanups = append(cleanups, inputCleanup)
+	}
+
+	return ubvFiles, cleanup, nil
+}
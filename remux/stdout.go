@@ -0,0 +1,78 @@
+package remux
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"ubvremux/demux"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Writes the demuxed video of every selected partition of opts.Files to out as one continuous Annex B bitstream (e.g.
+// to feed a transcoder), without muxing or writing any files. A partition that does not open with parameter sets has
+// the most recent ones written ahead of it (from an earlier partition of its file, or else from the previous partition
+// streamed), so each partition can be decoded from its start.
+func StreamVideo(ctx context.Context, opts Options, out io.Writer) error {
+	inputs, cleanup, err := resolveInputs(ctx, opts.Files, opts.Download)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	w := bufio.NewWriter(out)
+	var codec string
+	var lastParameterSets [][]byte
+
+	return analyseFiles(ctx, opts, inputs, func(i int, analysis fileAnalysis) error {
+		input := opts.Files[i]
+		if analysis.err != nil {
+			if opts.Strict {
+				return fmt.Errorf("analysis of %s failed: %w", input, analysis.err)
+			}
+
+			logging.Warn("Analysis of ", input, " failed, skipping: ", analysis.err)
+			return nil
+		}
+
+		info, videoTrackNum := analysis.info, analysis.videoTrackNum
+		for _, partition := range opts.Filter.apply(info.Partitions, videoTrackNum) {
+			if !opts.Trim.isZero() {
+				partition = opts.Trim.apply(partition, videoTrackNum)
+			}
+
+			track, ok := partition.Tracks[videoTrackNum]
+			if !ok || !track.IsVideo || track.FrameCount == 0 {
+				logging.Info("Partition ", partition.Index, " of ", input, " has no frames on video track ", videoTrackNum, ", skipping")
+				continue
+			}
+
+			// The stream cannot switch codec part way through
+			if len(codec) == 0 {
+				codec = track.Codec
+			} else if track.Codec != codec {
+				return fmt.Errorf("partition %d of %s is %s, but the stream so far is %s", partition.Index, input, track.Codec, codec)
+			}
+
+			demuxOptions := opts.Demux
+			demuxOptions.FallbackParameterSets = earlierParameterSets(info, partition, videoTrackNum)
+			if demuxOptions.FallbackParameterSets == nil {
+				demuxOptions.FallbackParameterSets = lastParameterSets
+			}
+
+			logging.Info("Streaming partition ", partition.Index, " of ", input)
+			report, err := demux.DemuxSinglePartitionToWriters(ctx, analysis.ubvFile, partition, w, videoTrackNum, nil, 0, demuxOptions)
+			if err != nil {
+				return err
+			}
+			logging.Info("Partition ", partition.Index, ": ", report)
+
+			if parameterSets, err := demux.FindParameterSets(analysis.ubvFile, []*ubv.UbvPartition{partition}, videoTrackNum); err == nil && parameterSets != nil {
+				lastParameterSets = parameterSets
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package remux
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Formats for the wall-clock timestamp subtitles
+const (
+	SubtitlesSRT = "srt"
+	SubtitlesVTT = "vtt"
+)
+
+// Writes a subtitle file with a cue for every second of playback whose text is the wall-clock time of the frame shown
+// at the start of that second. Playback time is the frame index over the track rate (as FFmpeg is told the rate), so
+// any drift or gaps in the recording show up in the timestamps.
+func writeTimecodeSubtitles(filename string, format string, partition *ubv.UbvPartition, videoTrackNum int) error {
+	timecodes, rate := subtitleTimecodes(partition, videoTrackNum)
+	if len(timecodes) == 0 {
+		return fmt.Errorf("no frames with timecodes in partition %d", partition.Index)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	if format == SubtitlesVTT {
+		fmt.Fprint(w, "WEBVTT\n\n")
+	}
+
+	duration := time.Duration(len(timecodes)) * time.Second / time.Duration(rate)
+	for cue := 0; time.Duration(cue)*time.Second < duration; cue++ {
+		start := time.Duration(cue) * time.Second
+		end := start + time.Second
+		if end > duration {
+			end = duration
+		}
+
+		if format == SubtitlesSRT {
+			fmt.Fprintf(w, "%d\n", cue+1)
+		}
+		fmt.Fprintf(w, "%s --> %s\n", formatCueTime(start, format), formatCueTime(end, format))
+		fmt.Fprintf(w, "%s\n\n", timecodes[cue*rate].Format("2006-01-02 15:04:05 MST"))
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// The timecode of each frame of the video track (or of each second of the audio track if there is no video), along
+// with the number of entries per second of playback
+func subtitleTimecodes(partition *ubv.UbvPartition, videoTrackNum int) ([]time.Time, int) {
+	if track, ok := partition.Tracks[videoTrackNum]; ok && track.IsVideo && track.Rate > 0 {
+		var timecodes []time.Time
+		for _, frame := range partition.Frames {
+			if frame.TrackNumber == videoTrackNum {
+				timecodes = append(timecodes, frame.Timecode)
+			}
+		}
+
+		return timecodes, track.Rate
+	}
+
+	// Audio only: audio packets do not map neatly onto seconds, so count on from the start
+	for _, track := range partition.Tracks {
+		if !track.IsVideo && !track.Unsupported {
+			var timecodes []time.Time
+			for t := track.StartTimecode; !t.After(track.LastTimecode); t = t.Add(time.Second) {
+				timecodes = append(timecodes, t)
+			}
+
+			return timecodes, 1
+		}
+	}
+
+	return nil, 0
+}
+
+// Formats a playback offset as a cue time: HH:MM:SS,mmm for SRT, HH:MM:SS.mmm for WebVTT
+func formatCueTime(offset time.Duration, format string) string {
+	separator := ","
+	if format == SubtitlesVTT {
+		separator = "."
+	}
+
+	millis := offset.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000)
+}
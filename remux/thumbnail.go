@@ -0,0 +1,64 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"ubvremux/demux"
+	"ubvremux/ffmpegutil"
+	"ubvremux/ubv"
+)
+
+// Writes a JPEG still of the video frame opts.ThumbnailOffset into a partition (the first keyframe by default). Only
+// the frames from the preceding keyframe up to that frame are demuxed, so this is quick even for long partitions.
+func writeThumbnail(ctx context.Context, opts Options, ubvFile string, partition *ubv.UbvPartition, videoTrackNum int, thumbnail string) error {
+	frames := thumbnailFrames(partition, videoTrackNum, opts.ThumbnailOffset)
+	if len(frames) == 0 {
+		return fmt.Errorf("no keyframes on video track %d", videoTrackNum)
+	}
+
+	// Demux just those frames
+	gop := *partition
+	gop.Frames = frames
+
+	demuxOptions := opts.Demux
+	demuxOptions.Progress = nil
+	demuxOptions.Resume = false
+
+	bitstream := strings.TrimSuffix(thumbnail, ".jpg") + ".thumbnail" + videoExtension(partition, videoTrackNum)
+	if _, err := demux.DemuxSinglePartitionToNewFiles(ctx, ubvFile, bitstream, videoTrackNum, "", 0, &gop, demuxOptions); err != nil {
+		return err
+	}
+	defer os.Remove(bitstream)
+
+	return ffmpegutil.ExtractFrame(ctx, bitstream, len(frames)-1, thumbnail, opts.Mux)
+}
+
+// The frames of the video track from the last keyframe at or before offset into the partition, up to the frame at
+// offset. If there is no keyframe by then, the first keyframe is used instead; nil if the track has no keyframes.
+func thumbnailFrames(partition *ubv.UbvPartition, videoTrackNum int, offset time.Duration) []ubv.UbvFrame {
+	var target time.Time
+	var frames []ubv.UbvFrame
+
+	for _, frame := range partition.Frames {
+		if frame.TrackNumber != videoTrackNum {
+			continue
+		}
+
+		if target.IsZero() {
+			target = frame.Timecode.Add(offset)
+		}
+
+		if len(frames) > 0 && frame.Timecode.After(target) {
+			break
+		} else if frame.Keyframe {
+			frames = []ubv.UbvFrame{frame}
+		} else if len(frames) > 0 {
+			frames = append(frames, frame)
+		}
+	}
+
+	return frames
+}
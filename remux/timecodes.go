@@ -0,0 +1,76 @@
+package remux
+
+import (
+	"fmt"
+	"time"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Where the start timecode of a file comes from
+const (
+	// The wall-clock time of the first frame
+	TimecodeSourceFrame = "frame"
+
+	// The record start time in the Protect filename (for cameras whose clock is wrong)
+	TimecodeSourceFilename = "filename"
+)
+
+// Parses a -timecode-source value; empty means TimecodeSourceFrame
+func ParseTimecodeSource(value string) (string, error) {
+	switch value {
+	case "", TimecodeSourceFrame:
+		return TimecodeSourceFrame, nil
+	case TimecodeSourceFilename:
+		return TimecodeSourceFilename, nil
+	default:
+		return "", fmt.Errorf("unsupported timecode source %q (expected frame or filename)", value)
+	}
+}
+
+// Moves the timecodes of an analysed file (for TimecodeSourceFilename) so that its first partition starts at the
+// record start time from its filename; frames (and later partitions) keep their timing relative to that start
+func useFilenameTimecodes(info ubv.UbvFile) {
+	if info.RecordStart.IsZero() {
+		logging.Warn("Warning: ", info.Filename, " is not a Protect filename with a record start time; using the frame timecodes")
+		return
+	}
+
+	start := info.StartTimecode()
+	if start.IsZero() {
+		return
+	}
+
+	logging.Infof("Timecodes taken from the filename: start %s (frame timecodes start %s)", info.RecordStart.UTC().Format(time.RFC3339Nano), start.UTC().Format(time.RFC3339Nano))
+	info.ShiftTimecodes(info.RecordStart.Sub(start))
+}
+
+// Timecodes before this are taken to come from a camera whose clock was not set (e.g. 1970, from booting without NTP)
+var earliestPlausibleTimecode = time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Corrects partitions of an analysed file that start implausibly early: if the first partition does, and the filename
+// has a plausible record start time, the affected partitions are moved as -timecode-source filename would move them.
+// Otherwise (or for partitions whose offset from the record start is unknown) a warning is logged.
+func correctImplausibleTimecodes(info ubv.UbvFile) {
+	var offset time.Duration
+	if start := info.StartTimecode(); !start.IsZero() && start.Before(earliestPlausibleTimecode) {
+		if info.RecordStart.Before(earliestPlausibleTimecode) {
+			logging.Warnf("WARNING: %s starts at %s, which suggests the camera clock was not set, and the filename has no usable record start time; outputs will carry this date", info.Filename, start.UTC().Format(time.RFC3339))
+			return
+		}
+
+		logging.Warnf("WARNING: %s starts at %s, which suggests the camera clock was not set; using the record start time from the filename (%s) instead", info.Filename, start.UTC().Format(time.RFC3339), info.RecordStart.UTC().Format(time.RFC3339))
+		offset = info.RecordStart.Sub(start)
+	}
+
+	for _, partition := range info.Partitions {
+		if start := partition.StartTimecode(); start.IsZero() || !start.Before(earliestPlausibleTimecode) {
+			continue
+		} else if offset == 0 {
+			logging.Warnf("WARNING: partition %d of %s starts at %s, which suggests the camera clock was not set; its outputs will carry this date", partition.Index, info.Filename, start.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		partition.ShiftTimecodes(offset)
+	}
+}
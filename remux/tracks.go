@@ -0,0 +1,153 @@
+package remux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Analyses every track of each file (regardless of the track options) and prints a table of them per partition
+func ListTracks(files []string, download DownloadOptions, out io.Writer) error {
+	for _, input := range files {
+		ubvFile, cleanup, err := resolveInput(context.Background(), input, download)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", input, err)
+		}
+
+		info, err := ubv.Analyse(context.Background(), ubvFile, true, 0)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("analysis of %s failed: %w", input, err)
+		}
+
+		fmt.Fprintf(out, "%s\n", input)
+		for _, partition := range info.Partitions {
+			fmt.Fprintf(out, "Partition %d\n", partition.Index)
+
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "\tTrack\tType\tCodec\tFrames\tRate\tStart")
+			for _, track := range sortedTracks(partition) {
+				trackType := "A"
+				if track.Unsupported {
+					trackType = "?"
+				} else if track.IsVideo {
+					trackType = "V"
+				}
+
+				fmt.Fprintf(w, "\t%d\t%s\t%s\t%d\t%d\t%s\n", track.TrackNumber, trackType, track.Codec, track.FrameCount, track.Rate, track.StartTimecode.Format(time.RFC3339Nano))
+			}
+			w.Flush()
+		}
+	}
+
+	return nil
+}
+
+// Analyses each file and prints the probed framerate of each of its video tracks, one tab-separated "file track fps"
+// line per track (for scripts to pick a -force-rate). Where partitions were probed at different rates, the rate
+// covering the most frames is printed; 0 means the rate could not be probed (fewer than 2 frames)
+func ProbeRates(files []string, download DownloadOptions, out io.Writer) error {
+	for _, input := range files {
+		ubvFile, cleanup, err := resolveInput(context.Background(), input, download)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", input, err)
+		}
+
+		info, err := ubv.Analyse(context.Background(), ubvFile, false, 0)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("analysis of %s failed: %w", input, err)
+		}
+
+		// Frames at each rate, per track
+		frames := make(map[int]map[int]int)
+		for _, partition := range info.Partitions {
+			for _, track := range partition.Tracks {
+				if !track.IsVideo || track.Unsupported || track.FrameCount == 0 {
+					continue
+				}
+
+				if frames[track.TrackNumber] == nil {
+					frames[track.TrackNumber] = make(map[int]int)
+				}
+				frames[track.TrackNumber][track.Rate] += track.FrameCount
+			}
+		}
+
+		trackNums := make([]int, 0, len(frames))
+		for trackNum := range frames {
+			trackNums = append(trackNums, trackNum)
+		}
+		sort.Ints(trackNums)
+
+		for _, trackNum := range trackNums {
+			rate, most := 0, 0
+			for candidate, count := range frames[trackNum] {
+				// Ties go to the higher rate, so the output does not depend on map order
+				if count > most || (count == most && candidate > rate) {
+					rate, most = candidate, count
+				}
+			}
+
+			fmt.Fprintf(out, "%s\t%d\t%d\n", input, trackNum, rate)
+		}
+	}
+
+	return nil
+}
+
+// A partition's tracks in track number order
+func sortedTracks(partition *ubv.UbvPartition) []*ubv.UbvTrack {
+	tracks := make([]*ubv.UbvTrack, 0, len(partition.Tracks))
+	for _, track := range partition.Tracks {
+		tracks = append(tracks, track)
+	}
+
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].TrackNumber < tracks[j].TrackNumber
+	})
+
+	return tracks
+}
+
+// The video tracks with frames in any partition of a file (in track number order), along with the suffix each one's
+// outputs are named with under AllVideoTracks: main or sub by role, or the track number if the role is unknown or
+// shared with another track present
+func videoTrackLabels(info ubv.UbvFile) ([]int, map[int]string) {
+	present := make(map[int]bool)
+	for _, partition := range info.Partitions {
+		for _, track := range partition.Tracks {
+			if track.IsVideo && !track.Unsupported && track.FrameCount > 0 {
+				present[track.TrackNumber] = true
+			}
+		}
+	}
+
+	var trackNums []int
+	roles := make(map[string]int)
+	for trackNum := range present {
+		trackNums = append(trackNums, trackNum)
+		roles[ubv.KnownTracks[trackNum].Role]++
+	}
+	sort.Ints(trackNums)
+
+	labels := make(map[int]string)
+	for _, trackNum := range trackNums {
+		role := ubv.KnownTracks[trackNum].Role
+		switch {
+		case roles[role] > 1 || len(role) == 0:
+			labels[trackNum] = strconv.Itoa(trackNum)
+		case role == ubv.TrackRoleSecondary:
+			labels[trackNum] = "sub"
+		default:
+			labels[trackNum] = role
+		}
+	}
+
+	return trackNums, labels
+}
@@ -0,0 +1,112 @@
+package remux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"ubvremux/ubv"
+)
+
+// Restricts extraction to part of each partition, by offset from the start of the partition
+type Trim struct {
+	Start time.Duration
+
+	// Zero means the end of the partition
+	End time.Duration
+}
+
+// Parses a -trim value: start:end in seconds from the start of the partition, either of which may be omitted
+// (e.g. 30: or :90)
+func ParseTrim(value string) (Trim, error) {
+	var trim Trim
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return trim, fmt.Errorf("invalid -trim %q, expected start:end in seconds", value)
+	}
+
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+
+		seconds, err := strconv.ParseFloat(part, 64)
+		if err != nil || seconds < 0 {
+			return trim, fmt.Errorf("invalid -trim %q, expected start:end in seconds", value)
+		}
+
+		if i == 0 {
+			trim.Start = time.Duration(seconds * float64(time.Second))
+		} else {
+			trim.End = time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	if trim.End > 0 && trim.End <= trim.Start {
+		return trim, fmt.Errorf("invalid -trim %q, the end must be after the start", value)
+	}
+
+	return trim, nil
+}
+
+func (t Trim) isZero() bool {
+	return t.Start == 0 && t.End == 0
+}
+
+// Returns a copy of partition holding only the frames from the last video keyframe at or before Start, up to End (if
+// no keyframe precedes Start, from the first keyframe after it). The partition and its tracks are left untouched; the
+// copy has its own tracks, with frame counts and timecodes describing the frames that remain.
+func (t Trim) apply(partition *ubv.UbvPartition, videoTrackNum int) *ubv.UbvPartition {
+	base := getStartTimecode(partition, videoTrackNum)
+	start := base.Add(t.Start)
+	end := base.Add(t.End)
+
+	// Video can only start at a keyframe
+	from := start
+	if track, ok := partition.Tracks[videoTrackNum]; ok && track.IsVideo {
+		var keyframe time.Time
+		for _, frame := range partition.Frames {
+			if frame.TrackNumber != videoTrackNum || !frame.Keyframe {
+				continue
+			} else if keyframe.IsZero() || !frame.Timecode.After(start) {
+				keyframe = frame.Timecode
+			}
+
+			if frame.Timecode.After(start) {
+				break
+			}
+		}
+
+		if !keyframe.IsZero() {
+			from = keyframe
+		}
+	}
+
+	trimmed := *partition
+	trimmed.Frames = nil
+	trimmed.Tracks = make(map[int]*ubv.UbvTrack, len(partition.Tracks))
+	for trackNum, track := range partition.Tracks {
+		trackCopy := *track
+		trackCopy.FrameCount = 0
+		trimmed.Tracks[trackNum] = &trackCopy
+	}
+
+	for _, frame := range partition.Frames {
+		if frame.Timecode.Before(from) || (t.End > 0 && frame.Timecode.After(end)) {
+			continue
+		}
+
+		trimmed.Frames = append(trimmed.Frames, frame)
+
+		track := trimmed.Tracks[frame.TrackNumber]
+		if track.FrameCount == 0 {
+			track.StartTimecode = frame.Timecode
+		}
+		track.LastTimecode = frame.Timecode
+		track.FrameCount++
+	}
+	trimmed.FrameCount = len(trimmed.Frames)
+
+	return &trimmed
+}
@@ -0,0 +1,107 @@
+package remux
+
+import (
+	"context"
+	"os"
+	"time"
+	"ubvremux/logging"
+)
+
+// How often Watch looks for new or changed .ubv files
+const watchPollInterval = 5 * time.Second
+
+// The size and modification time of a watched file when it was last seen
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+
+	// When the size or modification time last changed
+	changed time.Time
+}
+
+// Remuxes .ubv files beneath dir (filtered by pattern and since, as for ExpandInputs) as they appear, until ctx is
+// cancelled. A file is taken to be completely written once its size and modification time have not changed for settle.
+// Files are only processed once (in this run) unless they change again; the outcome of each batch is logged.
+//
+// N.B. the directory is polled (every watchPollInterval) rather than watched for filesystem events, which keeps this
+// portable and also works on network shares
+func Watch(ctx context.Context, opts Options, dir string, pattern string, since time.Time, settle time.Duration) error {
+	seen := make(map[string]*watchedFile)
+	processed := make(map[string]watchedFile)
+
+	logging.Info("Watching ", dir, " for new .ubv files")
+
+	for {
+		files, err := ExpandInputs([]string{dir}, pattern, since)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var ready []string
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				// Most likely deleted since the search
+				delete(seen, file)
+				continue
+			}
+
+			if done, ok := processed[file]; ok && done.size == info.Size() && done.modTime.Equal(info.ModTime()) {
+				continue
+			}
+
+			state, ok := seen[file]
+			if !ok || state.size != info.Size() || !state.modTime.Equal(info.ModTime()) {
+				seen[file] = &watchedFile{size: info.Size(), modTime: info.ModTime(), changed: now}
+			} else if now.Sub(state.changed) >= settle {
+				ready = append(ready, file)
+			}
+		}
+
+		if len(ready) > 0 {
+			batch := opts
+			batch.Files = ready
+
+			results, err := RemuxContext(ctx, batch)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			} else if err != nil {
+				// Strict stops the whole batch at the first file that fails analysis; the rest are retried next time
+				logging.Error("Error remuxing new files: ", err)
+			}
+
+			failed := 0
+			for _, result := range results {
+				if result.Status == StatusFailed {
+					failed++
+				}
+			}
+			logging.Infof("Processed %d new files: %d outputs, %d failed", len(ready), len(results), failed)
+
+			for _, file := range ready {
+				if err == nil || hasResultFor(results, file) {
+					processed[file] = *seen[file]
+				}
+				delete(seen, file)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchPollInterval):
+		}
+	}
+}
+
+// Whether any of results came from source
+func hasResultFor(results []Result, source string) bool {
+	for _, result := range results {
+		if result.Source == source {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ubvremux/demux"
+	"ubvremux/ffmpegutil"
+	"ubvremux/logging"
+	"ubvremux/ubv"
+)
+
+// Serves the .ubv files under a directory over HTTP, remuxing partitions to fragmented MP4 on request
+type Server struct {
+	dir string
+
+	// How partitions are muxed (only the FFmpeg log level and extra arguments apply to streams)
+	muxOptions ffmpegutil.MuxOptions
+
+	// Analysis results, keyed by relative path
+	lock     sync.Mutex
+	analysed map[string]cachedAnalysis
+}
+
+type cachedAnalysis struct {
+	modTime time.Time
+	info    ubv.UbvFile
+}
+
+type partitionSummary struct {
+	Index         int       `json:"index"`
+	StartTimecode time.Time `json:"startTimecode"`
+	LastTimecode  time.Time `json:"lastTimecode"`
+	Frames        int       `json:"frames"`
+	HasVideo      bool      `json:"hasVideo"`
+	HasAudio      bool      `json:"hasAudio"`
+}
+
+// Starts an HTTP server on addr serving the recordings beneath dir; does not return unless the server fails
+//
+// Endpoints:
+//
+//	GET /                                  web player
+//	GET /files                             JSON list of .ubv files (relative paths)
+//	GET /partitions?file=F                 JSON list of partitions within F
+//	GET /stream?file=F&partition=N         partition N of F as a fragmented MP4
+func Serve(addr string, dir string, muxOptions ffmpegutil.MuxOptions) error {
+	s := &Server{
+		dir:        dir,
+		muxOptions: muxOptions,
+		analysed:   make(map[string]cachedAnalysis),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/files", s.handleFiles)
+	mux.HandleFunc("/partitions", s.handlePartitions)
+	mux.HandleFunc("/stream", s.handleStream)
+
+	logging.Info("Serving ", dir, " on ", addr)
+
+	return http.ListenAndServe(addr, mux)
+}
+
+// Resolves a client-supplied relative path, refusing anything outside the served directory
+func (s *Server) resolve(relative string) (string, bool) {
+	if len(relative) == 0 || !strings.HasSuffix(strings.ToLower(relative), ".ubv") {
+		return "", false
+	}
+
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+relative))), true
+}
+
+var errNotFound = errors.New("recording not found")
+
+// Analyses (or returns the cached analysis of) a recording. ubnt_ubvinfo is killed if ctx is cancelled, e.g. because
+// the client went away
+func (s *Server) analyse(ctx context.Context, relative string) (ubv.UbvFile, error) {
+	file, ok := s.resolve(relative)
+	if !ok {
+		return ubv.UbvFile{}, errNotFound
+	}
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		return ubv.UbvFile{}, errNotFound
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if cached, ok := s.analysed[relative]; ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.info, nil
+	}
+
+	info, err := ubv.Analyse(ctx, file, true, 0)
+	if err != nil {
+		return ubv.UbvFile{}, err
+	}
+	s.analysed[relative] = cachedAnalysis{modTime: stat.ModTime(), info: info}
+
+	return info, nil
+}
+
+// Writes the response for a failed analysis
+func analysisError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errNotFound {
+		http.NotFound(w, r)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	files := []string{}
+
+	err := filepath.Walk(s.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && strings.EqualFold(filepath.Ext(file), ".ubv") {
+			if relative, err := filepath.Rel(s.dir, file); err == nil {
+				files = append(files, filepath.ToSlash(relative))
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, files)
+}
+
+func (s *Server) handlePartitions(w http.ResponseWriter, r *http.Request) {
+	info, err := s.analyse(r.Context(), r.URL.Query().Get("file"))
+	if err != nil {
+		analysisError(w, r, err)
+		return
+	}
+
+	partitions := []partitionSummary{}
+	for _, partition := range info.Partitions {
+		summary := partitionSummary{
+			Index:    partition.Index,
+			Frames:   partition.FrameCount,
+			HasVideo: partition.VideoTrackCount > 0,
+			HasAudio: partition.AudioTrackCount > 0,
+		}
+
+		if track := videoTrack(partition); track != nil {
+			summary.StartTimecode = track.StartTimecode
+			summary.LastTimecode = track.LastTimecode
+		}
+
+		partitions = append(partitions, summary)
+	}
+
+	writeJSON(w, partitions)
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	relative := r.URL.Query().Get("file")
+	info, err := s.analyse(r.Context(), relative)
+	if err != nil {
+		analysisError(w, r, err)
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("partition"))
+	if err != nil || index < 0 || index >= len(info.Partitions) {
+		http.Error(w, "invalid partition", http.StatusBadRequest)
+		return
+	}
+
+	partition := info.Partitions[index]
+	track := videoTrack(partition)
+	if track == nil {
+		http.Error(w, "partition has no video", http.StatusNotFound)
+		return
+	}
+
+	video, err := demux.OpenTrackReader(info.Filename, partition, track.TrackNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer video.Close()
+
+	var audio io.Reader
+	audioTrackNum := ubv.TrackSelector{Keyword: ubv.TrackSelectorAuto}.Resolve(info, false, nil)
+	if _, ok := partition.Tracks[audioTrackNum]; ok {
+		audioReader, err := demux.OpenTrackReader(info.Filename, partition, audioTrackNum)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer audioReader.Close()
+		audio = audioReader
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+
+	if err := ffmpegutil.StreamFragmentedMP4(r.Context(), s.muxOptions, partition, video, track.TrackNumber, audio, audioTrackNum, w); err != nil {
+		logging.Error("Streaming partition ", index, " of ", relative, " failed: ", err)
+	}
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, nil)
+}
+
+// The main video track of a partition (the lowest-numbered video track), or nil if it has no video
+func videoTrack(partition *ubv.UbvPartition) *ubv.UbvTrack {
+	var best *ubv.UbvTrack
+	for _, track := range partition.Tracks {
+		if track.IsVideo && (best == nil || track.TrackNumber < best.TrackNumber) {
+			best = track
+		}
+	}
+
+	return best
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.Error("Error writing JSON response: ", err)
+	}
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>UBV Remux</title>
+<style>
+body { font-family: sans-serif; display: flex; margin: 0; }
+#files, #partitions { width: 20em; height: 100vh; overflow-y: auto; border-right: 1px solid #ccc; }
+a { display: block; padding: 0.3em; cursor: pointer; }
+video { max-width: 100%; }
+</style>
+</head>
+<body>
+<div id="files"></div>
+<div id="partitions"></div>
+<div><video id="player" controls autoplay></video></div>
+<script>
+function link(text, onclick) {
+	var a = document.createElement("a");
+	a.textContent = text;
+	a.onclick = onclick;
+	return a;
+}
+
+fetch("files").then(r => r.json()).then(files => {
+	files.forEach(file => document.getElementById("files").appendChild(link(file, () => {
+		var partitions = document.getElementById("partitions");
+		partitions.textContent = "Analysing...";
+		fetch("partitions?file=" + encodeURIComponent(file)).then(r => r.json()).then(list => {
+			partitions.textContent = "";
+			list.filter(p => p.hasVideo).forEach(p => partitions.appendChild(link(p.index + ": " + p.startTimecode, () => {
+				document.getElementById("player").src = "stream?file=" + encodeURIComponent(file) + "&partition=" + p.index;
+			})));
+		});
+	})));
+});
+</script>
+</body>
+</html>
+`))
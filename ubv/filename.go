@@ -0,0 +1,57 @@
+package ubv
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record types found in Protect filenames
+const (
+	RecordTypeRotating  = "rotating"
+	RecordTypeTimelapse = "timelapse"
+)
+
+// The components of a Unifi Protect recording filename: <MAC>_<channel>_<type>_<unixtime millis>.ubv
+// Fields are left empty if the filename does not follow this convention
+type ProtectFilename struct {
+	// The filename without directory, extension or trailing unixtime
+	Base string
+
+	Mac         string
+	Channel     string
+	RecordType  string
+	RecordStart time.Time
+}
+
+func ParseProtectFilename(filename string) ProtectFilename {
+	baseFilename := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+
+	var parsed ProtectFilename
+
+	// If the filename contains underscores, assume it's a Unifi Protect Filename
+	// and drop the final component (the unixtime).
+	if strings.Contains(baseFilename, "_") {
+		parsed.Base = baseFilename[0:strings.LastIndex(baseFilename, "_")]
+	} else {
+		parsed.Base = baseFilename
+	}
+
+	parts := strings.Split(baseFilename, "_")
+	if len(parts) == 4 {
+		if millis, err := strconv.ParseInt(parts[3], 10, 64); err == nil {
+			parsed.Mac = parts[0]
+			parsed.Channel = parts[1]
+			parsed.RecordType = parts[2]
+			parsed.RecordStart = time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond))
+		}
+	}
+
+	return parsed
+}
+
+// Whether the filename says this is a timelapse recording (whose frames are seconds apart)
+func (filename ProtectFilename) IsTimelapse() bool {
+	return filename.RecordType == RecordTypeTimelapse
+}
@@ -0,0 +1,194 @@
+package ubv
+
+import (
+	"sort"
+	"time"
+)
+
+// Structured description of an analysed .ubv file, intended for JSON output
+type FileSummary struct {
+	Filename string `json:"filename"`
+
+	// Parsed from the Protect filename, if it follows the convention
+	Mac         string     `json:"mac,omitempty"`
+	Channel     string     `json:"channel,omitempty"`
+	RecordType  string     `json:"recordType,omitempty"`
+	RecordStart *time.Time `json:"recordStart,omitempty"`
+
+	Partitions []PartitionSummary `json:"partitions"`
+
+	// The totals of the partition estimates
+	EstimatedDurationSeconds float64 `json:"estimatedDurationSeconds"`
+	EstimatedSizeBytes       int64   `json:"estimatedSizeBytes"`
+}
+
+type PartitionSummary struct {
+	Index           int `json:"index"`
+	FrameCount      int `json:"frameCount"`
+	VideoTrackCount int `json:"videoTrackCount"`
+	AudioTrackCount int `json:"audioTrackCount"`
+
+	// The range of bytes within the .ubv holding this partition's frames (ByteEnd is exclusive)
+	ByteStart int64 `json:"byteStart"`
+	ByteEnd   int64 `json:"byteEnd"`
+
+	// Wall-clock duration (see PartitionSpan), and the gap from its end to the start of the next partition (absent for
+	// the last partition). A negative gap means the partitions overlap
+	DurationSeconds  float64  `json:"durationSeconds"`
+	GapToNextSeconds *float64 `json:"gapToNextSeconds,omitempty"`
+
+	// The playback duration of the output (frames over rate, of the track DurationSeconds is taken from), and its size
+	// (the total size of the frames to extract). A duration far from DurationSeconds means the rate is probably wrong
+	EstimatedDurationSeconds float64 `json:"estimatedDurationSeconds"`
+	EstimatedSizeBytes       int64   `json:"estimatedSizeBytes"`
+
+	Tracks []TrackSummary `json:"tracks"`
+
+	// If non-empty, why the partition was abandoned during parsing
+	Abandoned string `json:"abandoned,omitempty"`
+}
+
+type TrackSummary struct {
+	TrackNumber   int       `json:"trackNumber"`
+	IsVideo       bool      `json:"isVideo"`
+	Codec         string    `json:"codec"`
+	Unsupported   bool      `json:"unsupported,omitempty"`
+	FrameCount    int       `json:"frameCount"`
+	Rate          int       `json:"rate"`
+	Channels      int       `json:"channels,omitempty"`
+	StartTimecode time.Time `json:"startTimecode"`
+	LastTimecode  time.Time `json:"lastTimecode"`
+
+	// The wall-clock duration (LastTimecode - StartTimecode), and for video the duration implied by FrameCount and Rate;
+	// if these diverge the rate is probably wrong
+	DurationSeconds         float64 `json:"durationSeconds"`
+	ExpectedDurationSeconds float64 `json:"expectedDurationSeconds,omitempty"`
+}
+
+// Summarise an analysed file; tracks are listed in track number order
+func Summarise(info UbvFile) FileSummary {
+	summary := FileSummary{
+		Filename:   info.Filename,
+		Mac:        info.Mac,
+		Channel:    info.Channel,
+		RecordType: info.RecordType,
+		Partitions: []PartitionSummary{},
+	}
+	if !info.RecordStart.IsZero() {
+		recordStart := info.RecordStart
+		summary.RecordStart = &recordStart
+	}
+
+	for _, partition := range info.Partitions {
+		partitionSummary := PartitionSummary{
+			Index:           partition.Index,
+			FrameCount:      partition.FrameCount,
+			VideoTrackCount: partition.VideoTrackCount,
+			AudioTrackCount: partition.AudioTrackCount,
+			ByteStart:       partition.StartOffset,
+			ByteEnd:         partition.EndOffset,
+			Tracks:          []TrackSummary{},
+			Abandoned:       partition.Abandoned,
+		}
+
+		for _, frame := range partition.Frames {
+			if track, ok := partition.Tracks[frame.TrackNumber]; ok && !track.Unsupported {
+				partitionSummary.EstimatedSizeBytes += int64(frame.Size)
+			}
+		}
+
+		for _, track := range partition.Tracks {
+			partitionSummary.Tracks = append(partitionSummary.Tracks, TrackSummary{
+				TrackNumber:   track.TrackNumber,
+				IsVideo:       track.IsVideo,
+				Codec:         track.Codec,
+				Unsupported:   track.Unsupported,
+				FrameCount:    track.FrameCount,
+				Rate:          track.Rate,
+				Channels:      track.Channels,
+				StartTimecode: track.StartTimecode,
+				LastTimecode:  track.LastTimecode,
+
+				DurationSeconds:         track.Duration().Seconds(),
+				ExpectedDurationSeconds: track.ExpectedDuration().Seconds(),
+			})
+		}
+
+		sort.Slice(partitionSummary.Tracks, func(i, j int) bool {
+			return partitionSummary.Tracks[i].TrackNumber < partitionSummary.Tracks[j].TrackNumber
+		})
+
+		if start, end, ok := PartitionSpan(partition); ok {
+			partitionSummary.DurationSeconds = end.Sub(start).Seconds()
+		}
+		partitionSummary.EstimatedDurationSeconds = estimatedPlayback(partition).Seconds()
+
+		summary.EstimatedDurationSeconds += partitionSummary.EstimatedDurationSeconds
+		summary.EstimatedSizeBytes += partitionSummary.EstimatedSizeBytes
+		summary.Partitions = append(summary.Partitions, partitionSummary)
+	}
+
+	for i, gap := range PartitionGaps(info) {
+		if i < len(summary.Partitions)-1 {
+			seconds := gap.Seconds()
+			summary.Partitions[i].GapToNextSeconds = &seconds
+		}
+	}
+
+	return summary
+}
+
+// The wall-clock span of a partition, taken from its lowest-numbered video track (or, without video, its
+// lowest-numbered track). Returns false if the partition has no tracks
+func PartitionSpan(partition *UbvPartition) (time.Time, time.Time, bool) {
+	chosen := spanTrack(partition)
+	if chosen == nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	return chosen.StartTimecode, chosen.LastTimecode, true
+}
+
+// The track PartitionSpan is taken from, or nil if there are no supported tracks
+func spanTrack(partition *UbvPartition) *UbvTrack {
+	var chosen *UbvTrack
+	for _, track := range partition.Tracks {
+		if track.Unsupported {
+			continue
+		} else if chosen == nil || (track.IsVideo && !chosen.IsVideo) || (track.IsVideo == chosen.IsVideo && track.TrackNumber < chosen.TrackNumber) {
+			chosen = track
+		}
+	}
+
+	return chosen
+}
+
+// How long the output of a partition will play for: its video frames over their rate (including the display time of
+// the last frame), or without video (or a known rate) its wall-clock span
+func estimatedPlayback(partition *UbvPartition) time.Duration {
+	track := spanTrack(partition)
+	if track == nil {
+		return 0
+	} else if track.IsVideo && track.Rate > 0 {
+		return time.Duration(track.FrameCount) * time.Second / time.Duration(track.Rate)
+	}
+
+	return track.Duration()
+}
+
+// The gap between the end of each partition and the start of the next (one fewer than the number of partitions)
+func PartitionGaps(info UbvFile) []time.Duration {
+	var gaps []time.Duration
+	for i := 0; i+1 < len(info.Partitions); i++ {
+		_, end, ok := PartitionSpan(info.Partitions[i])
+		nextStart, _, nextOk := PartitionSpan(info.Partitions[i+1])
+
+		if ok && nextOk {
+			gaps = append(gaps, nextStart.Sub(end))
+		} else {
+			gaps = append(gaps, 0)
+		}
+	}
+
+	return gaps
+}
@@ -0,0 +1,81 @@
+package ubv
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Formats for the timecode written to muxed outputs
+const (
+	// HH:MM:SS.FF as produced by GenerateTimecode
+	TimecodeFormatDefault = "default"
+
+	// Non-drop-frame HH:MM:SS:FF, counting whole frames at the nominal (rounded) rate
+	TimecodeFormatNonDrop = "ndf"
+
+	// Drop-frame HH:MM:SS;FF for NTSC rates (29.97 and 59.94 fps), which skips frame numbers so the timecode keeps
+	// pace with the wall clock
+	TimecodeFormatDropFrame = "df"
+)
+
+// Parses a timecode format name (see the TimecodeFormat constants); an empty value means the default
+func ParseTimecodeFormat(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "":
+		return TimecodeFormatDefault, nil
+	case TimecodeFormatDefault, TimecodeFormatNonDrop, TimecodeFormatDropFrame:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid timecode format %q, expected one of: default, ndf, df", value)
+	}
+}
+
+// The NTSC rate (e.g. 29.97 for 30) corresponding to an integer rate, which drop-frame timecode counts at
+func NTSCRate(framerate int) float64 {
+	return float64(framerate) * 1000 / 1001
+}
+
+// Generates a timecode in the given format (see the TimecodeFormat constants) for a video starting at startTimecode,
+// where framerate may be fractional (e.g. 29.97 or NTSCRate(30)). Like GenerateTimecode, the timecode is the wall
+// clock time of day. Drop-frame timecode is only defined for rates that round to a multiple of 30 fps.
+func FormatTimecode(startTimecode time.Time, framerate float64, format string) (string, error) {
+	if framerate <= 0 {
+		return "", fmt.Errorf("invalid framerate %g for a timecode", framerate)
+	}
+
+	if format == TimecodeFormatDefault || len(format) == 0 {
+		return GenerateTimecode(startTimecode, framerate), nil
+	}
+
+	nominal := int64(math.Round(framerate))
+
+	// The frame the wall clock time of day falls on, counting at the real rate
+	midnight := time.Date(startTimecode.Year(), startTimecode.Month(), startTimecode.Day(), 0, 0, 0, 0, startTimecode.Location())
+	frames := int64(startTimecode.Sub(midnight).Seconds() * framerate)
+
+	separator := ":"
+	if format == TimecodeFormatDropFrame {
+		if nominal%30 != 0 {
+			return "", fmt.Errorf("drop-frame timecode is only defined for 29.97 and 59.94 fps, not %g", framerate)
+		}
+
+		// Frame numbers 0 and 1 (0-3 at 59.94) are skipped at the start of each minute, except every tenth minute
+		drop := nominal / 15
+		framesPerMinute := nominal*60 - drop
+		framesPer10Minutes := framesPerMinute*10 + drop
+
+		tens, remainder := frames/framesPer10Minutes, frames%framesPer10Minutes
+		frames += drop * 9 * tens
+		if remainder > drop {
+			frames += drop * ((remainder - drop) / framesPerMinute)
+		}
+
+		separator = ";"
+	}
+
+	frame := frames % nominal
+	seconds := frames / nominal
+	return fmt.Sprintf("%02d:%02d:%02d%s%02d", seconds/3600%24, seconds/60%60, seconds%60, separator, frame), nil
+}
@@ -0,0 +1,102 @@
+package ubv
+
+import (
+	"testing"
+	"time"
+)
+
+// The time of day at which frame number frames (counting from midnight at framerate) is shown; halfway through the
+// frame, so float rounding cannot land on the frame before
+func frameTime(frames int64, framerate float64) time.Time {
+	midnight := time.Date(2023, time.Month(5), 16, 0, 0, 0, 0, time.UTC)
+	return midnight.Add(time.Duration((float64(frames) + 0.5) * float64(time.Second) / framerate))
+}
+
+func TestFormatTimecode(t *testing.T) {
+	tests := []struct {
+		frames    int64
+		framerate float64
+		format    string
+		want      string
+	}{
+		{0, 30, TimecodeFormatNonDrop, "00:00:00:00"},
+		{1799, 30, TimecodeFormatNonDrop, "00:00:59:29"},
+		{1800, 30, TimecodeFormatNonDrop, "00:01:00:00"},
+		{90000, 25, TimecodeFormatNonDrop, "01:00:00:00"},
+
+		// Non-drop-frame at 29.97 counts at the nominal 30 fps, so falls behind the wall clock
+		{1800, NTSCRate(30), TimecodeFormatNonDrop, "00:01:00:00"},
+
+		// Drop-frame at 29.97: frame numbers 0 and 1 are skipped at each minute, except every tenth
+		{1798, NTSCRate(30), TimecodeFormatDropFrame, "00:00:59;28"},
+		{1799, NTSCRate(30), TimecodeFormatDropFrame, "00:00:59;29"},
+		{1800, NTSCRate(30), TimecodeFormatDropFrame, "00:01:00;02"},
+		{3597, NTSCRate(30), TimecodeFormatDropFrame, "00:01:59;29"},
+		{3598, NTSCRate(30), TimecodeFormatDropFrame, "00:02:00;02"},
+		{17981, NTSCRate(30), TimecodeFormatDropFrame, "00:09:59;29"},
+		{17982, NTSCRate(30), TimecodeFormatDropFrame, "00:10:00;00"},
+		{17983, NTSCRate(30), TimecodeFormatDropFrame, "00:10:00;01"},
+		{19781, NTSCRate(30), TimecodeFormatDropFrame, "00:10:59;29"},
+		{19782, NTSCRate(30), TimecodeFormatDropFrame, "00:11:00;02"},
+		{107892, NTSCRate(30), TimecodeFormatDropFrame, "01:00:00;00"},
+
+		// Drop-frame at 59.94 skips frame numbers 0-3
+		{3599, NTSCRate(60), TimecodeFormatDropFrame, "00:00:59;59"},
+		{3600, NTSCRate(60), TimecodeFormatDropFrame, "00:01:00;04"},
+		{35964, NTSCRate(60), TimecodeFormatDropFrame, "00:10:00;00"},
+	}
+
+	for _, test := range tests {
+		timecode, err := FormatTimecode(frameTime(test.frames, test.framerate), test.framerate, test.format)
+		if err != nil {
+			t.Errorf("Timecode for frame %d at %g fps (%s) failed: %v", test.frames, test.framerate, test.format, err)
+		} else if timecode != test.want {
+			t.Errorf("Timecode for frame %d at %g fps (%s) is incorrect, got: %s, want: %s.", test.frames, test.framerate, test.format, timecode, test.want)
+		}
+	}
+}
+
+func TestFormatTimecodeDefault(t *testing.T) {
+	start := time.Date(2023, time.Month(5), 16, 11, 58, 26, 500000000, time.UTC)
+
+	for _, format := range []string{"", TimecodeFormatDefault} {
+		if timecode, err := FormatTimecode(start, 30, format); err != nil {
+			t.Errorf("Default timecode failed: %v", err)
+		} else if want := GenerateTimecode(start, 30); timecode != want {
+			t.Errorf("Default timecode is incorrect, got: %s, want: %s.", timecode, want)
+		}
+	}
+}
+
+func TestFormatTimecodeFailures(t *testing.T) {
+	start := time.Date(2023, time.Month(5), 16, 11, 58, 26, 0, time.UTC)
+
+	if _, err := FormatTimecode(start, 25, TimecodeFormatDropFrame); err == nil {
+		t.Error("Expected drop-frame timecode at 25 fps to fail")
+	}
+	if _, err := FormatTimecode(start, 0, TimecodeFormatNonDrop); err == nil {
+		t.Error("Expected a zero framerate to fail")
+	}
+}
+
+func TestParseTimecodeFormat(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", TimecodeFormatDefault},
+		{"default", TimecodeFormatDefault},
+		{" NDF ", TimecodeFormatNonDrop},
+		{"df", TimecodeFormatDropFrame},
+	}
+
+	for _, test := range tests {
+		if format, err := ParseTimecodeFormat(test.value); err != nil || format != test.want {
+			t.Errorf("Timecode format %q is incorrect, got: %q (%v), want: %q.", test.value, format, err, test.want)
+		}
+	}
+
+	if _, err := ParseTimecodeFormat("smpte"); err == nil {
+		t.Error("Expected an unknown timecode format to fail")
+	}
+}
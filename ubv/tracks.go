@@ -0,0 +1,214 @@
+package ubv
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"ubvremux/logging"
+)
+
+const (
+	CodecH264    = "h264"
+	CodecHEVC    = "hevc"
+	CodecAAC     = "aac"
+	CodecOpus    = "opus"
+	CodecUnknown = "unknown"
+)
+
+const (
+	TrackRoleMain      = "main"
+	TrackRoleSecondary = "secondary"
+)
+
+// Describes what a particular ubv track number holds
+type TrackKind struct {
+	IsVideo bool
+	Codec   string
+
+	// Whether this is the main or a secondary stream of its type (see the TrackRole constants)
+	Role string
+}
+
+// Known track numbers. Ubiquiti add new track numbers from time to time; add them here as they are reported.
+// Tracks not listed here are classified using the track type field (FIELD_TRACK_TYPE) of the ubnt_ubvinfo output.
+var KnownTracks = map[int]TrackKind{
+	TrackVideo:            {IsVideo: true, Codec: CodecH264, Role: TrackRoleMain},
+	TrackVideoHevcUnknown: {IsVideo: true, Codec: CodecHEVC, Role: TrackRoleMain},
+	TrackVideoSecondary:   {IsVideo: true, Codec: CodecH264, Role: TrackRoleSecondary},
+	TrackAudio:            {IsVideo: false, Codec: CodecAAC, Role: TrackRoleMain},
+}
+
+// The codec assumed for audio tracks whose codec cannot be determined
+const DefaultAudioCodec = CodecAAC
+
+// The extension (including the dot) of the raw bitstream demuxed from an audio track of the given codec
+func AudioExtension(codec string) string {
+	if codec == CodecOpus {
+		return ".opus"
+	}
+
+	return ".aac"
+}
+
+// Keyword selecting the highest-resolution video track (or, if no resolution is known, the highest-bitrate one), or
+// the first audio track
+const TrackSelectorAuto = "auto"
+
+// Reports the dimensions of a video track within a partition (e.g. parsed from its SPS), returning false if they
+// cannot be determined
+type ResolutionProbe func(filename string, partition *UbvPartition, trackNumber int) (width int, height int, ok bool)
+
+// Selects a track either by number or by keyword (main, secondary, auto)
+type TrackSelector struct {
+	Number  int
+	Keyword string
+}
+
+// Parses a track number or keyword; an empty value means auto
+func ParseTrackSelector(value string) (TrackSelector, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch value {
+	case "":
+		return TrackSelector{Keyword: TrackSelectorAuto}, nil
+	case TrackRoleMain, TrackRoleSecondary, TrackSelectorAuto:
+		return TrackSelector{Keyword: value}, nil
+	}
+
+	if number, err := strconv.Atoi(value); err == nil && number > 0 {
+		return TrackSelector{Number: number}, nil
+	}
+
+	return TrackSelector{}, fmt.Errorf("invalid track %q, expected a track number or one of: main, secondary, auto", value)
+}
+
+func (s TrackSelector) String() string {
+	if len(s.Keyword) > 0 {
+		return s.Keyword
+	}
+
+	return strconv.Itoa(s.Number)
+}
+
+// The track number if known before analysis, otherwise 0 (keywords can only be resolved against an analysed file)
+func (s TrackSelector) KnownNumber() int {
+	return s.Number
+}
+
+// Resolves the selector to a track number present in the analysed file. Returns 0 if no suitable track exists.
+// probe is used to compare video track resolutions for auto, and may be nil (in which case bitrate alone is used).
+func (s TrackSelector) Resolve(info UbvFile, video bool, probe ResolutionProbe) int {
+	if s.Number > 0 {
+		return s.Number
+	}
+
+	// Total bytes of each track of the requested type across all partitions
+	trackBytes := make(map[int]int)
+	for _, partition := range info.Partitions {
+		for _, frame := range partition.Frames {
+			if track, ok := partition.Tracks[frame.TrackNumber]; ok && track.IsVideo == video && !track.Unsupported {
+				trackBytes[frame.TrackNumber] += frame.Size
+			}
+		}
+	}
+
+	var present []int
+	for trackNumber := range trackBytes {
+		present = append(present, trackNumber)
+	}
+	sort.Ints(present)
+
+	// The zero TrackSelector also means auto
+	if s.Keyword == TrackSelectorAuto || len(s.Keyword) == 0 {
+		if !video {
+			// First audio track
+			if len(present) == 0 {
+				return 0
+			}
+			return present[0]
+		}
+
+		trackPixels := probeTrackPixels(info, present, probe)
+
+		// Tracks of known resolution are preferred; bitrate breaks ties (and decides if no resolution is known)
+		best := 0
+		for _, trackNumber := range present {
+			if best == 0 || trackPixels[trackNumber] > trackPixels[best] ||
+				(trackPixels[trackNumber] == trackPixels[best] && trackBytes[trackNumber] > trackBytes[best]) {
+				best = trackNumber
+			}
+		}
+
+		return best
+	}
+
+	for _, trackNumber := range present {
+		if kind, ok := KnownTracks[trackNumber]; ok && kind.Role == s.Keyword {
+			return trackNumber
+		}
+	}
+
+	return 0
+}
+
+// The width x height of each track, probed in the first partition holding it. Tracks whose resolution cannot be
+// determined are absent.
+func probeTrackPixels(info UbvFile, trackNumbers []int, probe ResolutionProbe) map[int]int {
+	trackPixels := make(map[int]int)
+	if probe == nil {
+		return trackPixels
+	}
+
+	for _, trackNumber := range trackNumbers {
+		for _, partition := range info.Partitions {
+			if track, ok := partition.Tracks[trackNumber]; !ok || track.FrameCount <= 0 {
+				continue
+			}
+
+			if width, height, ok := probe(info.Filename, partition, trackNumber); ok {
+				trackPixels[trackNumber] = width * height
+			}
+			break
+		}
+	}
+
+	return trackPixels
+}
+
+// Classifies a track from its type field (V=Video, A=Audio) together with its number: the registry supplies the codec
+// and role when the type agrees with it. If the type field is unreadable the registry alone is used, and if the track
+// is not registered either it is unsupported (false is returned).
+// The unknownTracks map records which unexpected track numbers have already been logged, so each is only reported once.
+func classifyTrack(trackNumber int, trackType string, unknownTracks map[int]bool) (TrackKind, bool) {
+	known, registered := KnownTracks[trackNumber]
+
+	var kind TrackKind
+	switch trackType {
+	case "V":
+		kind = TrackKind{IsVideo: true, Codec: CodecUnknown}
+	case "A":
+		kind = TrackKind{IsVideo: false, Codec: CodecUnknown}
+	default:
+		if !registered && !unknownTracks[trackNumber] {
+			unknownTracks[trackNumber] = true
+			logging.Warn("Encountered unsupported track number ", trackNumber, " with type ", trackType, ", its frames will be skipped. Please report this")
+		}
+		return known, registered
+	}
+
+	if registered && known.IsVideo == kind.IsVideo {
+		return known, true
+	}
+
+	if !unknownTracks[trackNumber] {
+		unknownTracks[trackNumber] = true
+		if registered {
+			logging.Warn("Track number ", trackNumber, " has type ", trackType, ", which disagrees with the track registry; trusting the type field. Please report this")
+		} else {
+			logging.Warn("Encountered unregistered track number ", trackNumber, " with type ", trackType, ", please report this so it can be added")
+		}
+	}
+
+	return kind, true
+}
@@ -2,9 +2,11 @@ package ubv
 
 import (
 	"fmt"
-	"log"
+	"math"
+	"sort"
 	"strconv"
 	"time"
+	"ubvremux/logging"
 )
 
 const (
@@ -25,20 +27,68 @@ const (
 	//Timebase for track
 	FIELD_WC_TBC = 8
 
+	// The default number of frames at the start of each partition used to determine the framerate (see SetProbeFrames)
 	PROBE_FRAMES = 70
+
+	// The default sanity limits on the size of a frame (in bytes) and the number of frames in a partition (see
+	// SetPartitionLimits). A day of 4K video at 60fps is well within both
+	MAX_FRAME_SIZE       = 64 * 1024 * 1024
+	MAX_PARTITION_FRAMES = 10000000
 )
 
+// The number of frames used to determine the framerate
+var probeFrames = PROBE_FRAMES
+
+// Partitions with a frame larger than this, or with more frames than this, are abandoned (0 means no limit)
+var maxFrameSize = MAX_FRAME_SIZE
+var maxPartitionFrames = MAX_PARTITION_FRAMES
+
+// Sets how many frames at the start of each partition are sampled to determine the framerate. More frames smooth out
+// jitter in the early frames; fewer keep less probe data per track
+func SetProbeFrames(frames int) error {
+	if frames < 2 {
+		return fmt.Errorf("at least 2 frames are needed to probe the framerate, got %d", frames)
+	}
+
+	probeFrames = frames
+	return nil
+}
+
+// Sets the sanity limits applied while parsing: a partition with a frame of more than frameSize bytes, or more than
+// partitionFrames frames, is abandoned rather than risk exhausting memory on a corrupt analysis. 0 means no limit
+func SetPartitionLimits(frameSize int, partitionFrames int) error {
+	if frameSize < 0 || partitionFrames < 0 {
+		return fmt.Errorf("partition limits cannot be negative, got frame size %d and frame count %d", frameSize, partitionFrames)
+	}
+
+	maxFrameSize = frameSize
+	maxPartitionFrames = partitionFrames
+	return nil
+}
+
 type UbvFrame struct {
 	//The track ID; observed values are 7 for the main video, 1003 for some hevc alt video, and 1000 for main audio (AAC)
 	TrackNumber int
 	Offset      int
 	Size        int
+
+	// The wall-clock time of this frame (from its WC and TBC fields)
+	Timecode time.Time
+
+	// Whether this is a keyframe (on video tracks), from which decoding can start
+	Keyframe bool
 }
 
 type UbvTrack struct {
 	IsVideo     bool
 	TrackNumber int
 
+	// The codec of this track (see the Codec constants), based on the track number registry
+	Codec string
+
+	// If true, the track could not be classified as audio or video; its frames are recorded but never extracted
+	Unsupported bool
+
 	// The date+time of the first frame in this partition
 	StartTimecode time.Time
 
@@ -50,15 +100,56 @@ type UbvTrack struct {
 	// For audio, the number of samples (N.B. we do not index individual samples)
 	Rate int
 
-	// For Video tracks, holds a window of rate estimations per-frame
-	// This is populated and used to determine Rate
-	RateProbeWindow      [32]int
+	// For audio, the number of channels (if it has been probed from the audio itself; 0 if unknown)
+	Channels int
+
+	// For Video tracks, holds the intervals (in units of RateProbeTBC) between the first probeFrames frames
+	// This is populated during parsing and used to determine Rate once the partition is complete
+	RateProbeIntervals   []int64
+	RateProbeTBC         int64
 	RateProbeLastFrameWC int64
 
 	// The date+time of the last frame in this partition
 	LastTimecode time.Time
 }
 
+// The wall-clock time between the first and last frames of this track
+func (track *UbvTrack) Duration() time.Duration {
+	return track.LastTimecode.Sub(track.StartTimecode)
+}
+
+// The duration implied by the frame count and Rate of a video track (as FFmpeg will play it), or 0 if the rate is unknown.
+// Like Duration this excludes the display time of the last frame
+func (track *UbvTrack) ExpectedDuration() time.Duration {
+	if !track.IsVideo || track.Rate <= 0 || track.FrameCount < 1 {
+		return 0
+	}
+
+	return time.Duration(track.FrameCount-1) * time.Second / time.Duration(track.Rate)
+}
+
+// The expected duration of a video track must be within this fraction of its actual duration...
+const durationMismatchFraction = 0.2
+
+// ...or within this much of it (so short partitions do not warn over a few frames)
+const durationMismatchSlack = 2 * time.Second
+
+// Whether the duration implied by a video track's frame count and rate diverges from its wall-clock duration by enough
+// to suggest the rate is wrong
+func (track *UbvTrack) DurationMismatch() bool {
+	expected := track.ExpectedDuration()
+	if expected == 0 {
+		return false
+	}
+
+	difference := expected - track.Duration()
+	if difference < 0 {
+		difference = -difference
+	}
+
+	return difference > durationMismatchSlack && float64(difference) > durationMismatchFraction*float64(track.Duration())
+}
+
 type UbvPartition struct {
 	Index           int
 	FrameCount      int
@@ -66,29 +157,81 @@ type UbvPartition struct {
 	VideoTrackCount int
 	AudioTrackCount int
 	Frames          []UbvFrame
+
+	// The range of the .ubv holding this partition's frames: from the lowest frame offset up to (but excluding) the
+	// end of the frame that ends last
+	StartOffset int64
+	EndOffset   int64
+
+	// If non-empty, why the partition was abandoned during parsing (see SetPartitionLimits); it has no tracks or frames
+	Abandoned string
 }
 
 type UbvFile struct {
 	Complete   bool
 	Filename   string
 	Partitions []*UbvPartition
+
+	// The camera MAC, channel, record type and recording start parsed from Filename (empty if it does not follow the
+	// Protect naming convention)
+	ProtectFilename
+}
+
+// The earliest start timecode of any track in the partition
+func (partition *UbvPartition) StartTimecode() time.Time {
+	var start time.Time
+	for _, track := range partition.Tracks {
+		if start.IsZero() || track.StartTimecode.Before(start) {
+			start = track.StartTimecode
+		}
+	}
+
+	return start
+}
+
+// Moves every timecode (of every frame and track) of the partition by offset, keeping their relative timing
+func (partition *UbvPartition) ShiftTimecodes(offset time.Duration) {
+	for _, track := range partition.Tracks {
+		track.StartTimecode = track.StartTimecode.Add(offset)
+		track.LastTimecode = track.LastTimecode.Add(offset)
+	}
+
+	for i := range partition.Frames {
+		partition.Frames[i].Timecode = partition.Frames[i].Timecode.Add(offset)
+	}
+}
+
+// The start timecode of the first partition, or the zero time if there are no partitions
+func (info UbvFile) StartTimecode() time.Time {
+	if len(info.Partitions) == 0 {
+		return time.Time{}
+	}
+
+	return info.Partitions[0].StartTimecode()
 }
 
-func extractTimecodeAndRate(fields []string, line string, track *UbvTrack) {
+// Moves every timecode of the file by offset (see UbvPartition.ShiftTimecodes)
+func (info UbvFile) ShiftTimecodes(offset time.Duration) {
+	for _, partition := range info.Partitions {
+		partition.ShiftTimecodes(offset)
+	}
+}
+
+func extractTimecodeAndRate(fields []string, line string, track *UbvTrack) error {
 	var err error
 	var wc int64
 	var tbc int64
 
 	if wc, err = strconv.ParseInt(fields[FIELD_WC], 10, 64); err != nil {
-		log.Fatal("Error parsing field offset!", err)
+		return fmt.Errorf("error parsing WC field of line %q: %w", line, err)
 	}
 	if tbc, err = strconv.ParseInt(fields[FIELD_WC_TBC], 10, 64); err != nil {
-		log.Fatal("Error parsing frame size!", err)
+		return fmt.Errorf("error parsing TBC field of line %q: %w", line, err)
 	}
 
 	// Bail if we encounter a TBC of 0, otherwise we'll have a divide by zeor
 	if tbc == 0 {
-		log.Fatal("Parsed TBC returned 0! ", tbc, " for line ", line)
+		return fmt.Errorf("parsed TBC returned 0 for line %q", line)
 	}
 
 	utcMillis := (wc * 1000) / tbc
@@ -105,73 +248,105 @@ func extractTimecodeAndRate(fields []string, line string, track *UbvTrack) {
 			// Ubiquiti use the audio sample rate directly for audio packet tbc
 			track.Rate = int(tbc)
 		} else {
-			log.Printf("First Frame: %s", frameTimecode)
+			logging.Debugf("First Frame: %s", frameTimecode)
+			track.RateProbeTBC = tbc
 			track.RateProbeLastFrameWC = wc
 		}
-	} else if track.Rate == 0 && track.IsVideo {
-		if track.FrameCount < len(track.RateProbeWindow) {
-			// Compute rate based on current+last frame time
-			track.RateProbeWindow[track.FrameCount] = int(tbc / (wc - track.RateProbeLastFrameWC))
-			track.RateProbeLastFrameWC = wc
-		} else {
-			// Find the most frequent rate in the probe window
-			rate := guessVideoRate(track.RateProbeWindow)
-
-			// Pick 75fps as a reasonable maximum rate
-			// The Unifi line currently tops out at 55fps on G4 Pro HFR mode
-			if rate > 0 && rate < 76 {
-				track.Rate = rate
-
-				log.Println("Video Rate Probe: File appears to be", track.Rate, "fps. Use -force-rate if incorrect.")
-			} else if rate == 0 {
-				log.Println("Video Rate Probe: WARNING probed rate was", rate, "fps. Assuming timelapse file and using 1fps")
-				track.Rate = 1
-			} else {
-				log.Fatal("Video Rate Probe: WARNING probed rate was", rate, "fps. Assuming invalid. Please use -force-rate ## (e.g. -force-rate 25) based on your camera's frame rate")
-				panic("Could not determine sensible video framerate based on data stored in .ubv")
-			}
-		}
+	} else if track.IsVideo && track.FrameCount < probeFrames {
+		// Record the interval since the last frame; the rate is computed once the partition is complete
+		track.RateProbeIntervals = append(track.RateProbeIntervals, wc-track.RateProbeLastFrameWC)
+		track.RateProbeLastFrameWC = wc
 	}
 
 	track.LastTimecode = frameTimecode
+
+	return nil
 }
 
-func guessVideoRate(durations [32]int) int {
-	var mostFrequent int
-	var frequency int
+// The range of plausible video framerates. The Unifi line currently tops out at 55fps on G4 Pro HFR mode, so anything
+// above maxVideoRate is taken to be the product of corrupt timecodes
+const (
+	minVideoRate = 1
+	maxVideoRate = 120
+)
 
-	counts := map[int]int{}
-	for _, val := range durations {
-		// Only consider positive values
-		if val > 0 {
-			counts[val]++
-			if counts[val] > frequency {
-				frequency++
-				mostFrequent = val
-			}
+// The rate used when the probed rate is implausible
+const fallbackVideoRate = 30
+
+// Determines the framerate of a video track from the median interval between its first probeFrames frames. timelapse
+// is whether the filename says this is a timelapse recording. An implausible rate is replaced with fallbackVideoRate
+// (with a warning) rather than failing, as -force-rate overrides it anyway
+func probeVideoRate(track *UbvTrack, timelapse bool) {
+	if !track.IsVideo || track.Rate != 0 {
+		return
+	}
+
+	median := medianInterval(track.RateProbeIntervals)
+	if median <= 0 {
+		// Fewer than 2 frames (or no usable intervals); leave the rate unknown
+		return
+	}
+
+	rate := int(math.Round(float64(track.RateProbeTBC) / float64(median)))
+
+	if rate >= minVideoRate && rate <= maxVideoRate {
+		track.Rate = rate
+
+		logging.Debug("Video Rate Probe: File appears to be", track.Rate, "fps. Use -force-rate if incorrect.")
+	} else if rate == 0 && timelapse {
+		// Frames are more than 2 seconds apart, as expected for a timelapse
+		logging.Debug("Video Rate Probe: timelapse recording, using 1fps")
+		track.Rate = 1
+	} else if rate == 0 {
+		// Frames are more than 2 seconds apart, but this is not a timelapse: most likely a stall in the recording
+		logging.Warn("Video Rate Probe: WARNING probed rate was", rate, "fps (frames over 2 seconds apart) but this is not a timelapse recording. Using 1fps; use -force-rate ## with your camera's frame rate if incorrect")
+		track.Rate = 1
+	} else {
+		logging.Warnf("Video Rate Probe: WARNING probed rate was %d fps, which is implausible. Using %d fps; use -force-rate ## with your camera's frame rate if incorrect", rate, fallbackVideoRate)
+		track.Rate = fallbackVideoRate
+	}
+}
+
+// The median of the positive intervals, or 0 if there are none
+func medianInterval(intervals []int64) int64 {
+	var positive []int64
+	for _, interval := range intervals {
+		if interval > 0 {
+			positive = append(positive, interval)
 		}
 	}
 
-	return mostFrequent
+	if len(positive) == 0 {
+		return 0
+	}
+
+	sort.Slice(positive, func(i, j int) bool { return positive[i] < positive[j] })
+
+	return positive[len(positive)/2]
 }
 
 /**
  * Generates a timecode string from a StartTimecode object and framerate.
  * The timecode is set as the wall clock time (so a clip starting at 03:45 pm and 13 seconds will have a timestamp of 03:45:13)
- * Additionally, the nanosecond time value is rounded to the nearest frame index based on the framerate,
- * so a 13.50000 second time is frame 16 on a 30 fps clip (frames are indexed from 1 onwards).
- * So the clip will have a full timestamp of 03:34:13.16
+ * Additionally, the nanosecond time value is rounded down to the frame it falls within based on the framerate,
+ * so a 13.50000 second time is frame 15 on a 30 fps clip (frames are indexed from 0, so are always less than the framerate).
+ * So the clip will have a full timestamp of 03:45:13.15
  *
  * @param startTimecode The StartTimecode object to generate a timecode string from
- * @param framerate The framerate of the video
+ * @param framerate The framerate of the video (which may be fractional, e.g. 29.97)
  * @return The timecode string
  */
-func GenerateTimecode(startTimecode time.Time, framerate int) string {
-
-	var timecode string
+func GenerateTimecode(startTimecode time.Time, framerate float64) string {
 	// calculate timecode ( HH:MM:SS.FF ) from seconds and nanoseconds for frame part
-	timecode = startTimecode.Format("15:04:05") + "." + fmt.Sprintf("%02.0f", ((float32(startTimecode.Nanosecond())/float32(1000000000.0)*float32(framerate))+1))
-	// log.Println("Timecode: ", timecode)
-	// log.Printf("Date/Time: %s", videoTrack.StartTimecode)
-	return timecode
+	frame := int(math.Floor(float64(startTimecode.Nanosecond()) * framerate / float64(time.Second)))
+
+	// Keep the frame within [0, framerate), whatever rounding the float arithmetic does at the second boundary
+	if maxFrame := int(math.Ceil(framerate)) - 1; frame > maxFrame {
+		frame = maxFrame
+	}
+	if frame < 0 {
+		frame = 0
+	}
+
+	return startTimecode.Format("15:04:05") + "." + fmt.Sprintf("%02d", frame)
 }
@@ -0,0 +1,53 @@
+package ubv
+
+import "testing"
+
+func TestMedianInterval(t *testing.T) {
+	tests := []struct {
+		intervals []int64
+		want      int64
+	}{
+		{nil, 0},
+		{[]int64{0, 0}, 0},
+		{[]int64{-3000}, 0},
+		{[]int64{3000}, 3000},
+		{[]int64{3000, 3600, 2400}, 3000},
+		// Zero and negative intervals (same-millisecond or out-of-order frames) are ignored
+		{[]int64{0, 3000, -90000, 3000, 0}, 3000},
+		// A single stall does not move the median
+		{[]int64{3000, 3000, 180000, 3000}, 3000},
+	}
+
+	for _, test := range tests {
+		if median := medianInterval(test.intervals); median != test.want {
+			t.Errorf("Median of %v is incorrect, got: %d, want: %d.", test.intervals, median, test.want)
+		}
+	}
+}
+
+func TestProbeVideoRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []int64 // in a 90kHz TBC
+		timelapse bool
+		want      int
+	}{
+		{"30fps", []int64{3000, 3000, 3000, 3000}, false, 30},
+		{"25fps with jitter", []int64{3600, 3510, 3690, 3600, 3600}, false, 25},
+		{"15fps with a dropped frame", []int64{6000, 12000, 6000, 6000}, false, 15},
+		{"first interval only would give 45fps", []int64{2000, 3000, 3000, 3000, 3000}, false, 30},
+		{"fewer than 2 frames", nil, false, 0},
+		{"timelapse", []int64{900000, 900000}, true, 1},
+		{"stalled recording", []int64{900000, 900000}, false, 1},
+		{"implausibly fast", []int64{90, 90, 90}, false, fallbackVideoRate},
+	}
+
+	for _, test := range tests {
+		track := &UbvTrack{IsVideo: true, RateProbeTBC: 90000, RateProbeIntervals: test.intervals}
+		probeVideoRate(track, test.timelapse)
+
+		if track.Rate != test.want {
+			t.Errorf("%s: rate is incorrect, got: %d, want: %d.", test.name, track.Rate, test.want)
+		}
+	}
+}
@@ -2,12 +2,17 @@ package ubv
 
 import (
 	"bufio"
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
+	"ubvremux/logging"
 	"unicode"
 )
 
@@ -17,87 +22,250 @@ const ubntUbvInfoPath1 = "ubnt_ubvinfo"
 // The path to ubnt_ubvinfo on a Protect installation
 const ubntUbvInfoPath2 = "/usr/share/unifi-protect/app/node_modules/.bin/ubnt_ubvinfo"
 
+// If set (see SetUbvInfoCommand), the ubnt_ubvinfo binary to use instead of searching for one
+var ubvInfoOverride string
+
+// If true (see SetSaveAnalysis), ubnt_ubvinfo output is saved alongside the .ubv for later runs to reuse
+var saveAnalysis bool
+
+// Pre-prepared analyses (see SetAnalysisFile) to use instead of <file>.ubv.txt, by .ubv filename
+var analysisFiles = make(map[string]string)
+
 const TrackAudio = 1000
 const TrackVideo = 7
 const TrackVideoHevcUnknown = 1003
+const TrackVideoSecondary = 1007
 
 // Analyse a .ubv file (picking between ubnt_ubvinfo or a pre-prepared .txt file as appropriate)
-func Analyse(ubvFile string, includeAudio bool, videoTrackNum int) UbvFile {
-	cachedUbvInfoFile := ubvFile + ".txt"
+// If includeAudio is false and videoTrackNum is non-zero, only that video track is analysed
+// ubnt_ubvinfo is killed (and ctx.Err() returned) if ctx is cancelled
+func Analyse(ctx context.Context, ubvFile string, includeAudio bool, videoTrackNum int) (UbvFile, error) {
+	cachedUbvInfoFile := cachedAnalysisFilename(ubvFile)
 
 	if _, err := os.Stat(cachedUbvInfoFile); err != nil {
 		// No existing analysis, must run ubnt_ubvinfo
-		return runUbvInfo(ubvFile, includeAudio, videoTrackNum)
+		return runUbvInfo(ctx, ubvFile, includeAudio, videoTrackNum)
 	} else {
 		// Analysis file exists, read that instead of re-running ubnt_ubvinfo
 		return parseUbvInfoFile(ubvFile, cachedUbvInfoFile)
 	}
 }
 
-// Looks for ubnt_ubvinfo on the path and in the default Protect install location
-func getUbvInfoCommand() string {
+// Whether there is a pre-prepared analysis of ubvFile, which Analyse reads without needing the .ubv itself
+func HasCachedAnalysis(ubvFile string) bool {
+	_, err := os.Stat(cachedAnalysisFilename(ubvFile))
+	return err == nil
+}
+
+// The pre-prepared ubnt_ubvinfo output Analyse looks for (and SetSaveAnalysis writes)
+func cachedAnalysisFilename(ubvFile string) string {
+	if analysisFile, ok := analysisFiles[filepath.Clean(ubvFile)]; ok {
+		return analysisFile
+	}
+
+	return ubvFile + ".txt"
+}
+
+// Makes Analyse read the analysis of ubvFile from analysisFile (pre-generated ubnt_ubvinfo output, e.g. from
+// prepare.sh) rather than looking for <file>.ubv.txt, for when a sidecar cannot be written next to the .ubv
+func SetAnalysisFile(ubvFile string, analysisFile string) error {
+	if _, err := os.Stat(analysisFile); err != nil {
+		return fmt.Errorf("cannot read analysis file: %w", err)
+	}
+
+	analysisFiles[filepath.Clean(ubvFile)] = analysisFile
+	return nil
+}
+
+// Whether to save the output of ubnt_ubvinfo to <file>.ubv.txt, which Analyse then uses instead of re-running it
+func SetSaveAnalysis(enabled bool) {
+	saveAnalysis = enabled
+}
+
+// Use a specific ubnt_ubvinfo binary rather than searching the PATH and default Protect install location
+func SetUbvInfoCommand(path string) error {
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("ubnt_ubvinfo path %s is not an executable file: %w", path, err)
+	}
+
+	ubvInfoOverride = path
+
+	return nil
+}
+
+// Looks for ubnt_ubvinfo on the path and in the default Protect install location (unless SetUbvInfoCommand has been
+// used)
+func FindUbvInfo() (string, error) {
+	return getUbvInfoCommand()
+}
+
+// The first line ubnt_ubvinfo prints when asked for its version. It has no documented version flag, so this is best
+// effort: whatever it prints in response to --version (even if it exits with an error) is returned
+func UbvInfoVersion(path string) (string, error) {
+	output, err := exec.Command(path, "--version").CombinedOutput()
+	if line := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]); len(line) > 0 {
+		return line, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return "", errors.New("no version reported")
+}
+
+func getUbvInfoCommand() (string, error) {
+	if len(ubvInfoOverride) > 0 {
+		return ubvInfoOverride, nil
+	}
+
 	paths := [...]string{ubntUbvInfoPath1, ubntUbvInfoPath2}
 
 	for _, path := range paths {
 		if _, err := exec.LookPath(path); err == nil {
-			return path
+			return path, nil
 		}
 	}
 
-	log.Fatal("ubnt_ubvinfo not on PATH, nor in any default search locations!")
-
-	// Keep compiler happy (log.Fatal dies)
-	return paths[0]
+	return "", errors.New("ubnt_ubvinfo not on PATH, nor in any default search locations")
 }
 
-func runUbvInfo(ubvFile string, includeAudio bool, videoTrackNum int) UbvFile {
-	ubntUbvinfo := getUbvInfoCommand()
-	cmd := exec.Command(ubntUbvinfo, "-P", "-f", ubvFile)
+func runUbvInfo(ctx context.Context, ubvFile string, includeAudio bool, videoTrackNum int) (UbvFile, error) {
+	ubntUbvinfo, err := getUbvInfoCommand()
+	if err != nil {
+		return UbvFile{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, ubntUbvinfo, "-P", "-f", ubvFile)
 
 	// Optimise video-only extraction to speed ubnt_ubvinfo part of process
-	if !includeAudio {
-		cmd = exec.Command(ubntUbvinfo, "-t", strconv.Itoa(videoTrackNum), "-P", "-f", ubvFile)
+	if !includeAudio && videoTrackNum > 0 {
+		cmd = exec.CommandContext(ctx, ubntUbvinfo, "-t", strconv.Itoa(videoTrackNum), "-P", "-f", ubvFile)
 	}
 
-	// Parse stdout in the background
-	var info UbvFile
-	{
-		cmdReader, err := cmd.StdoutPipe()
+	// Keep stderr so it can be reported if ubnt_ubvinfo fails
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	// N.B. we use our own pipe rather than StdoutPipe so that we may Wait for the command while still reading its output
+	cmdReader, cmdWriter, err := os.Pipe()
+	if err != nil {
+		return UbvFile{}, fmt.Errorf("error creating stdout pipe for ubnt_ubvinfo: %w", err)
+	}
+	defer cmdReader.Close()
+	cmd.Stdout = cmdWriter
+
+	var input io.Reader = cmdReader
+
+	// Optionally tee the output to a temporary file, only renamed into place once the analysis succeeds
+	var saved *os.File
+	var savedWriter *bufio.Writer
+	if saveAnalysis {
+		saved, err = os.Create(cachedAnalysisFilename(ubvFile) + ".tmp")
 		if err != nil {
-			log.Fatal("Error creating StdoutPipe for Cmd: ", err)
+			cmdWriter.Close()
+			return UbvFile{}, fmt.Errorf("error creating analysis file for %s: %w", ubvFile, err)
 		}
 
-		scanner := bufio.NewScanner(cmdReader)
+		// Discard the partial analysis unless it is renamed into place below
+		defer os.Remove(saved.Name())
+		defer saved.Close()
 
-		go func() {
-			info = parseUbvInfo(ubvFile, scanner)
-		}()
+		savedWriter = bufio.NewWriter(saved)
+		input = io.TeeReader(cmdReader, savedWriter)
 	}
 
-	err := cmd.Start()
+	err = cmd.Start()
+
+	// The child has its own copy of the write end; closing ours means reads end when it exits
+	cmdWriter.Close()
+
 	if err != nil {
-		log.Fatal("ubnt_ubvinfo command failed against ", ubvFile, ": ", err)
+		return UbvFile{}, fmt.Errorf("ubnt_ubvinfo command failed against %s: %w", ubvFile, err)
 	}
 
-	// Await the parsed UBV Info
-	for !info.Complete {
-		time.Sleep(100 * time.Millisecond)
+	// Parse stdout in the background
+	// N.B. parseErr is written before the result is sent, so it is safe to read once done has been received from
+	var parseErr error
+	done := make(chan UbvFile, 1)
+	go func() {
+		var result UbvFile
+		result, parseErr = parseUbvInfo(ubvFile, bufio.NewScanner(input))
+		done <- result
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	var info UbvFile
+	select {
+	case info = <-done:
+		if parseErr != nil {
+			// We've stopped reading stdout, so ubnt_ubvinfo could block forever; kill it
+			cmd.Process.Kill()
+			<-exited
+
+			if ctx.Err() != nil {
+				// The parse failed because ubnt_ubvinfo was killed part way through
+				return UbvFile{}, ctx.Err()
+			}
+			return UbvFile{}, withStderr(parseErr, &stderr)
+		}
+
+		if err := <-exited; err != nil && ctx.Err() != nil {
+			return UbvFile{}, ctx.Err()
+		} else if err != nil {
+			return UbvFile{}, withStderr(fmt.Errorf("ubnt_ubvinfo failed against %s: %w", ubvFile, err), &stderr)
+		}
+	case err := <-exited:
+		if err != nil && ctx.Err() != nil {
+			// Killed because we were cancelled
+			cmdReader.Close()
+			<-done
+
+			return UbvFile{}, ctx.Err()
+		} else if err != nil {
+			// e.g. exit status 5 for a truncated file; stop parsing whatever partial output it produced
+			cmdReader.Close()
+			<-done
+
+			return UbvFile{}, withStderr(fmt.Errorf("ubnt_ubvinfo failed against %s: %w", ubvFile, err), &stderr)
+		}
+
+		// Exited cleanly: finish parsing the remainder of its output
+		info = <-done
+		if parseErr != nil {
+			return UbvFile{}, parseErr
+		}
 	}
 
-	// Call wait so stdout/stderr pipes are cleaned up
-	err = cmd.Wait()
-	if err != nil {
-		log.Fatal("Error waiting for ubv: ", err)
+	if saved != nil {
+		if err := savedWriter.Flush(); err != nil {
+			logging.Warn("Warning: could not save analysis for ", ubvFile, ": ", err)
+		} else if err := os.Rename(saved.Name(), cachedAnalysisFilename(ubvFile)); err != nil {
+			logging.Warn("Warning: could not save analysis for ", ubvFile, ": ", err)
+		} else {
+			logging.Info("Saved analysis to ", cachedAnalysisFilename(ubvFile))
+		}
+	}
+
+	return info, nil
+}
+
+// Appends anything ubnt_ubvinfo wrote to stderr to err
+func withStderr(err error, stderr *bytes.Buffer) error {
+	if message := strings.TrimSpace(stderr.String()); len(message) > 0 {
+		return fmt.Errorf("%w (ubnt_ubvinfo stderr: %s)", err, message)
 	}
 
-	return info
+	return err
 }
 
-func parseUbvInfoFile(ubvFile string, ubvInfoFile string) UbvFile {
+func parseUbvInfoFile(ubvFile string, ubvInfoFile string) (UbvFile, error) {
 	f, err := os.Open(ubvInfoFile)
 
 	if err != nil {
-		log.Fatal(err)
+		return UbvFile{}, err
 	}
 
 	defer f.Close()
@@ -107,9 +275,14 @@ func parseUbvInfoFile(ubvFile string, ubvInfoFile string) UbvFile {
 	return parseUbvInfo(ubvFile, scanner)
 }
 
-func parseUbvInfo(ubvFile string, scanner *bufio.Scanner) UbvFile {
+func parseUbvInfo(ubvFile string, scanner *bufio.Scanner) (UbvFile, error) {
 	var err error
 
+	protectFilename := ParseProtectFilename(ubvFile)
+
+	// Timelapse recordings are expected to probe as 0fps, so are treated differently by the rate probe
+	timelapse := protectFilename.IsTimelapse()
+
 	var firstLine bool
 	var partitions []*UbvPartition
 
@@ -121,12 +294,17 @@ func parseUbvInfo(ubvFile string, scanner *bufio.Scanner) UbvFile {
 
 	firstLine = true
 
+	// Unregistered (or inconsistently typed) track numbers already reported to the user
+	unknownTracks := make(map[int]bool)
+
 	for scanner.Scan() {
 		line := scanner.Text()
 
 		if firstLine {
 			firstLine = false
 		} else if line == "----------- PARTITION START -----------" {
+			probePartitionRates(current, timelapse)
+
 			// Start a new partition
 			current = &UbvPartition{
 				Index:  len(partitions),
@@ -142,45 +320,67 @@ func parseUbvInfo(ubvFile string, scanner *bufio.Scanner) UbvFile {
 
 			var frame = UbvFrame{}
 
+			if len(fields) <= FIELD_WC_TBC {
+				return UbvFile{}, fmt.Errorf("too few fields in frame line %q", line)
+			}
+
 			if frame.TrackNumber, err = strconv.Atoi(fields[FIELD_TRACK_ID]); err != nil {
-				log.Fatal("Error parsing track number!", err)
+				return UbvFile{}, fmt.Errorf("error parsing track number: %w", err)
 			}
 			if frame.Offset, err = strconv.Atoi(fields[FIELD_OFFSET]); err != nil {
-				log.Fatal("Error parsing field offset!", err)
+				return UbvFile{}, fmt.Errorf("error parsing field offset: %w", err)
 			}
 			if frame.Size, err = strconv.Atoi(fields[FIELD_SIZE]); err != nil {
-				log.Fatal("Error parsing frame size!", err)
+				return UbvFile{}, fmt.Errorf("error parsing frame size: %w", err)
 			}
+			frame.Keyframe = fields[FIELD_IS_KEYFRAME] == "1"
 
-			isRecognisedVideoTrack := frame.TrackNumber == TrackVideo || frame.TrackNumber == TrackVideoHevcUnknown
-
-			// Bail if we encounter an unexpected track number
-			// We could silently ignore it, but it seems more useful to know about new cases
-			if !isRecognisedVideoTrack && frame.TrackNumber != TrackAudio {
-				log.Fatal("Encountered unrecognisdd track number, please report this. Track Number: ", frame.TrackNumber)
+			if len(current.Abandoned) > 0 {
+				continue
+			} else if reason := exceedsPartitionLimits(current, frame); len(reason) > 0 {
+				abandonPartition(current, reason)
+				continue
 			}
 
+			// Tracks we cannot classify at all are recorded (so they can be reported) but never extracted
+			kind, recognised := classifyTrack(frame.TrackNumber, fields[FIELD_TRACK_TYPE], unknownTracks)
+
 			track, ok := current.Tracks[frame.TrackNumber]
 
 			if !ok {
 				track = &UbvTrack{
-					// TODO should really test field FIELD_TRACK_TYPE holds (A or V)
-					IsVideo:     isRecognisedVideoTrack,
+					IsVideo:     kind.IsVideo,
+					Codec:       kind.Codec,
+					Unsupported: !recognised,
 					TrackNumber: frame.TrackNumber,
 					FrameCount:  0,
 				}
 
+				if track.Unsupported {
+					track.Codec = CodecUnknown
+				}
+
 				current.Tracks[frame.TrackNumber] = track
 
-				if track.IsVideo {
+				if track.IsVideo && !track.Unsupported {
 					current.VideoTrackCount++
-				} else {
+				} else if !track.Unsupported {
 					current.AudioTrackCount++
 				}
 			}
 
 			// Add Timecode and Rate data to the Track record
-			extractTimecodeAndRate(fields, line, track)
+			if err := extractTimecodeAndRate(fields, line, track); err != nil {
+				return UbvFile{}, err
+			}
+			frame.Timecode = track.LastTimecode
+
+			if current.FrameCount == 0 || int64(frame.Offset) < current.StartOffset {
+				current.StartOffset = int64(frame.Offset)
+			}
+			if end := int64(frame.Offset + frame.Size); end > current.EndOffset {
+				current.EndOffset = end
+			}
 
 			current.FrameCount++
 			track.FrameCount++
@@ -189,12 +389,44 @@ func parseUbvInfo(ubvFile string, scanner *bufio.Scanner) UbvFile {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal("error reading ubv", ubvFile, err)
+		return UbvFile{}, fmt.Errorf("error reading ubv info for %s: %w", ubvFile, err)
 	}
 
+	probePartitionRates(current, timelapse)
+
 	return UbvFile{
-		Complete:   true,
-		Filename:   ubvFile,
-		Partitions: partitions,
+		Complete:        true,
+		Filename:        ubvFile,
+		Partitions:      partitions,
+		ProtectFilename: protectFilename,
+	}, nil
+}
+
+// Why adding frame to partition would break the limits set by SetPartitionLimits, or "" if it would not
+func exceedsPartitionLimits(partition *UbvPartition, frame UbvFrame) string {
+	if frame.Size < 0 || (maxFrameSize > 0 && frame.Size > maxFrameSize) {
+		return fmt.Sprintf("frame at offset %d has an implausible size of %d bytes (limit %d)", frame.Offset, frame.Size, maxFrameSize)
+	} else if maxPartitionFrames > 0 && partition.FrameCount >= maxPartitionFrames {
+		return fmt.Sprintf("more than %d frames", maxPartitionFrames)
+	}
+
+	return ""
+}
+
+// Discards everything parsed of a partition (its remaining frames are skipped), recording why
+func abandonPartition(partition *UbvPartition, reason string) {
+	logging.Errorf("Partition %d: %s, so the analysis is probably corrupt; skipping this partition", partition.Index, reason)
+
+	*partition = UbvPartition{
+		Index:     partition.Index,
+		Tracks:    make(map[int]*UbvTrack),
+		Abandoned: reason,
+	}
+}
+
+// Determines the rate of each video track once a partition has been fully parsed
+func probePartitionRates(partition *UbvPartition, timelapse bool) {
+	for _, track := range partition.Tracks {
+		probeVideoRate(track, timelapse)
 	}
 }
@@ -1,24 +1,60 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"testing"
 	"time"
+	"ubvremux/ffmpegutil"
 	"ubvremux/ubv"
 )
 
 func TestGenerateTimecode(t *testing.T) {
 	timecode := ubv.GenerateTimecode(time.Date(2023, time.Month(5), 16, 11, 58, 26, 500000000, time.UTC), 30)
 	log.Printf("Timecode Generated")
-	if timecode != "11:58:26.16" {
-		t.Errorf("Timecode generated is incorrect, got: %s, want: %s.", timecode, "11:58:26.16")
+	if timecode != "11:58:26.15" {
+		t.Errorf("Timecode generated is incorrect, got: %s, want: %s.", timecode, "11:58:26.15")
+	}
+}
+
+func TestGenerateTimecodeFrameBounds(t *testing.T) {
+	tests := []struct {
+		millis    int
+		framerate float64
+		want      string
+	}{
+		{0, 24, "11:58:26.00"},
+		{0, 25, "11:58:26.00"},
+		{0, 30, "11:58:26.00"},
+		{500, 24, "11:58:26.12"},
+		{500, 25, "11:58:26.12"},
+		{500, 30, "11:58:26.15"},
+		{999, 24, "11:58:26.23"},
+		{999, 25, "11:58:26.24"},
+		{999, 30, "11:58:26.29"},
+	}
+
+	for _, test := range tests {
+		start := time.Date(2023, time.Month(5), 16, 11, 58, 26, test.millis*1000000, time.UTC)
+		if timecode := ubv.GenerateTimecode(start, test.framerate); timecode != test.want {
+			t.Errorf("Timecode for %dms at %g fps is incorrect, got: %s, want: %s.", test.millis, test.framerate, timecode, test.want)
+		}
 	}
 }
 
 func TestCopyFrames(t *testing.T) {
 	ubvFile := "samples/FCECDA1F0A63_0_rotating_1597425468956.ubv"
 
-	info := ubv.Analyse(ubvFile, true, ubv.TrackVideo)
+	info, err := ubv.Analyse(context.Background(), ubvFile, true, ubv.TrackVideo)
+	if err != nil {
+		t.Fatal("Analysis failed: ", err)
+	}
 
 	log.Printf("\n\n*** Parsing complete! ***\n\n")
 	log.Printf("Number of partitions: %d", len(info.Partitions))
@@ -43,3 +79,86 @@ func TestCopyFrames(t *testing.T) {
 
 	t.Log("Analysis completed")
 }
+
+func TestMuxAudioOnlyPartition(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script in place of FFmpeg")
+	}
+
+	dir, err := ioutil.TempDir("", "ubvremux-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Stand-in for FFmpeg that just creates its output (the last argument)
+	fakeFfmpeg := filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\n[ \"$1\" = -version ] && exit 0\nfor last; do :; done\necho > \"$last\"\n"
+	if err := ioutil.WriteFile(fakeFfmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ffmpegutil.SetFfmpegCommand(fakeFfmpeg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A doorbell-style partition with audio but no video track at all
+	start := time.Date(2023, time.Month(5), 16, 11, 58, 26, 0, time.UTC)
+	partition := &ubv.UbvPartition{
+		FrameCount: 1,
+		Tracks: map[int]*ubv.UbvTrack{
+			ubv.TrackAudio: {TrackNumber: ubv.TrackAudio, StartTimecode: start, LastTimecode: start, FrameCount: 1, Rate: 16000},
+		},
+		AudioTrackCount: 1,
+		Frames:          []ubv.UbvFrame{{TrackNumber: ubv.TrackAudio, Timecode: start}},
+	}
+
+	output := filepath.Join(dir, "audio.m4a")
+	err = ffmpegutil.MuxAudioAndVideo(context.Background(), partition, "", ubv.TrackVideo, filepath.Join(dir, "audio.aac"), ubv.TrackAudio, output, ffmpegutil.MuxOptions{})
+	if err != nil {
+		t.Fatal("Audio-only mux failed: ", err)
+	}
+
+	if _, err := os.Stat(output); err != nil {
+		t.Error("Audio-only mux did not produce its output: ", err)
+	}
+}
+
+// Frames sharing a millisecond timecode give a zero interval, which must neither crash the rate probe nor skew it
+func TestProbeRateFramesInSameMillisecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubvremux-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		wcs  []int64 // frame WC values in a 90kHz TBC
+		want int
+	}{
+		{"two frames 0ms apart", []int64{144000000000000, 144000000000000}, 0},
+		{"0ms apart then 30fps", []int64{144000000000000, 144000000000000, 144000000003000, 144000000006000, 144000000009000}, 30},
+	}
+
+	for i, test := range tests {
+		ubvFile := filepath.Join(dir, "same-ms-"+strconv.Itoa(i)+".ubv")
+
+		analysis := "header\n----------- PARTITION START -----------\n"
+		for j, wc := range test.wcs {
+			analysis += fmt.Sprintf("    V 7 1 %d 100 0 0 %d 90000\n", j*100, wc)
+		}
+		if err := ioutil.WriteFile(ubvFile+".txt", []byte(analysis), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := ubv.Analyse(context.Background(), ubvFile, false, ubv.TrackVideo)
+		if err != nil {
+			t.Errorf("%s: analysis failed: %v", test.name, err)
+			continue
+		}
+
+		if rate := info.Partitions[0].Tracks[ubv.TrackVideo].Rate; rate != test.want {
+			t.Errorf("%s: got rate %d, want %d", test.name, rate, test.want)
+		}
+	}
+}